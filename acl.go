@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"strings"
+)
+
+var (
+	allowFlags stringList
+	denyFlags  stringList
+	aclAction  = flag.String("acl-action", "drop", "what to do with queries from clients outside the ACL: drop or refused")
+)
+
+func init() {
+	flag.Var(&allowFlags, "allow", "only serve clients in these CIDRs, comma-separated (repeatable)")
+	flag.Var(&denyFlags, "deny", "never serve clients in these CIDRs, comma-separated, even if allowed (repeatable)")
+}
+
+var allowNets, denyNets []*net.IPNet
+
+func parseCIDRs(specs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, spec := range specs {
+		for _, s := range strings.Split(spec, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			if !strings.Contains(s, "/") {
+				if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+					s += "/32"
+				} else {
+					s += "/128"
+				}
+			}
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, n)
+		}
+	}
+	return nets, nil
+}
+
+func setupACL() {
+	var err error
+	if allowNets, err = parseCIDRs(allowFlags); err != nil {
+		log.Fatalf("bad -allow: %v", err)
+	}
+	if denyNets, err = parseCIDRs(denyFlags); err != nil {
+		log.Fatalf("bad -deny: %v", err)
+	}
+	switch *aclAction {
+	case "drop", "refused":
+	default:
+		log.Fatalf("bad -acl-action %q, want drop or refused", *aclAction)
+	}
+	if len(allowNets) > 0 || len(denyNets) > 0 {
+		infof("Access control: %d allowed and %d denied networks", len(allowNets), len(denyNets))
+	}
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAllowed reports whether client may use the proxy: it must not be
+// denied, and must be allowed if there is an allow list.
+func clientAllowed(client net.IP) bool {
+	if client == nil {
+		return true
+	}
+	if containsIP(denyNets, client) {
+		return false
+	}
+	return len(allowNets) == 0 || containsIP(allowNets, client)
+}
+
+// aclRejected reports whether query comes from a client outside the ACL,
+// and the reply to send if so. A nil reply means the query is dropped.
+func aclRejected(query dnsMsg, client net.IP) ([]byte, bool) {
+	if clientAllowed(client) {
+		return nil, false
+	}
+	debugf("Rejected query from %s by ACL", client)
+	if *aclAction == "refused" {
+		return packDNSMsg(newReply(query, dnsRcodeRefused)), true
+	}
+	return nil, true
+}
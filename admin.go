@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	adminListen = flag.String("admin-listen", "", "serve the admin HTTP API on this address, e.g. 127.0.0.1:8053; without -admin-token anyone who can reach it may use it, so keep it on localhost")
+	adminToken  = flag.String("admin-token", "", "require this token in an \"Authorization: Bearer TOKEN\" header on every admin API request")
+)
+
+// adminHeader must be sent with the requests that change something when
+// there is no -admin-token. Browsers only send custom headers to other
+// sites after a CORS preflight, which the admin API never allows, so web
+// pages cannot forge these requests.
+const adminHeader = "X-Dns2tcp-Admin"
+
+func startAdmin() {
+	if *adminListen == "" {
+		return
+	}
+	if host, _, err := net.SplitHostPort(*adminListen); err == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			warnf("The admin API on %s is reachable from other hosts", *adminListen)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", byMethod{http.MethodGet: adminStats}.serve)
+	mux.HandleFunc("/config", byMethod{http.MethodGet: adminConfig}.serve)
+	mux.HandleFunc("/cache/flush", byMethod{http.MethodPost: adminFlushCache}.serve)
+	mux.HandleFunc("/blocklist", byMethod{
+		http.MethodGet:    adminListBlocked,
+		http.MethodPost:   adminBlock,
+		http.MethodDelete: adminUnblock,
+	}.serve)
+	mux.HandleFunc("/clients", byMethod{http.MethodGet: adminClients}.serve)
+	mux.HandleFunc("/clients/reset", byMethod{http.MethodPost: adminResetClient}.serve)
+	mux.HandleFunc("/upstreams/enable", byMethod{http.MethodPost: adminToggleUpstream(false)}.serve)
+	mux.HandleFunc("/upstreams/disable", byMethod{http.MethodPost: adminToggleUpstream(true)}.serve)
+	srv := &http.Server{Handler: mux, ReadTimeout: *tcpIdleTimeout, ErrorLog: log.Default()}
+	l := listenTCP(*adminListen)
+	infof("Serving the admin API on %s", *adminListen)
+	go func() {
+		if err := srv.Serve(l); err != nil && !stopping.Load() {
+			log.Fatalf("Admin API: %v", err)
+		}
+	}()
+}
+
+// byMethod dispatches a request to the handler for its method.
+type byMethod map[string]http.HandlerFunc
+
+func (m byMethod) serve(w http.ResponseWriter, r *http.Request) {
+	h, ok := m[r.Method]
+	if !ok {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if *adminToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	} else if r.Method != http.MethodGet && r.Header.Get(adminHeader) == "" {
+		http.Error(w, "missing "+adminHeader+" header", http.StatusForbidden)
+		return
+	}
+	h(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+type upstreamStatus struct {
+	Addr     string  `json:"addr"`
+	Healthy  bool    `json:"healthy"`
+	Disabled bool    `json:"disabled"`
+	Failures int     `json:"failures"`
+	RTT      float64 `json:"rtt_ms"`
+}
+
+func (u *upstream) status() upstreamStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return upstreamStatus{
+		Addr:     u.addr,
+		Healthy:  !u.disabled && time.Now().After(u.deadUntil),
+		Disabled: u.disabled,
+		Failures: u.failures,
+		RTT:      float64(u.rtt) / float64(time.Millisecond),
+	}
+}
+
+func adminStats(w http.ResponseWriter, r *http.Request) {
+	var ups []upstreamStatus
+	for _, u := range knownUpstreams() {
+		ups = append(ups, u.status())
+	}
+	blockedMu.RLock()
+	nblocked := blocked.len()
+	blockedMu.RUnlock()
+	p := latencyPercentiles(50, 99)
+	writeJSON(w, map[string]any{
+		"uptime_seconds":    int(time.Since(startTime).Seconds()),
+		"queries":           queriesServed.Load(),
+		"in_flight":         inflight.Load(),
+		"cache_entries":     cache.len(),
+		"cache_hits":        stats.cacheHits.Load(),
+		"cache_misses":      stats.cacheMisses.Load(),
+		"upstream_failures": stats.upstreamFailures.Load(),
+		"latency_p50_ms":    float64(p[0]) / float64(time.Millisecond),
+		"latency_p99_ms":    float64(p[1]) / float64(time.Millisecond),
+		"blocked_names":     nblocked,
+		"upstreams":         ups,
+	})
+}
+
+// secretFlags are the flags whose values adminConfig never shows.
+var secretFlags = []string{"admin-token", "dns-cookie-secret"}
+
+// adminConfig returns the value of every flag, as set on the command
+// line, in the config file or by default. Credentials in URLs and the
+// secretFlags are hidden.
+func adminConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		cfg[f.Name] = redactURLs(f.Value.String())
+		if slices.Contains(secretFlags, f.Name) && f.Value.String() != "" {
+			cfg[f.Name] = "xxxxx"
+		}
+	})
+	writeJSON(w, cfg)
+}
+
+// urlUserinfo matches the user information of the URLs in a flag value,
+// also those in the ?proxy= option of an upstream.
+var urlUserinfo = regexp.MustCompile(`([A-Za-z][A-Za-z0-9+.-]*://)[^/?#@,\s]+@`)
+
+// redactURLs replaces the user information of the URLs in a flag value,
+// such as proxy URLs with user:password, by xxxxx.
+func redactURLs(value string) string {
+	return urlUserinfo.ReplaceAllString(value, "${1}xxxxx@")
+}
+
+// adminFlushCache empties the cache, or with ?name=domain only drops the
+// answers for the domain and its subdomains.
+func adminFlushCache(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	n := cache.flush(name)
+	infof("Admin API: flushed %d cache entries for %q", n, name)
+	writeJSON(w, map[string]int{"flushed": n})
+}
+
+// adminListBlocked lists the blocklist rules, only those containing ?q=
+// if given.
+func adminListBlocked(w http.ResponseWriter, r *http.Request) {
+	q := strings.ToLower(r.URL.Query().Get("q"))
+	names := []string{}
+	blockedMu.RLock()
+	for _, name := range blocked.rules() {
+		if strings.Contains(name, q) {
+			names = append(names, name)
+		}
+	}
+	blockedMu.RUnlock()
+	writeJSON(w, names)
+}
+
+// blockRule returns the blocklist rule in the ?name= parameter.
+func blockRule(r *http.Request) string {
+	rule := strings.TrimSpace(r.URL.Query().Get("name"))
+	if isPattern(rule) {
+		return rule
+	}
+	return canonicalName(rule)
+}
+
+func adminBlock(w http.ResponseWriter, r *http.Request) {
+	rule := blockRule(r)
+	if rule == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	blockedMu.Lock()
+	err := blocked.add(rule)
+	if err == nil {
+		adminRules[rule] = true
+	}
+	blocked.compile()
+	blockedMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Earlier answers would be served from the cache until they expire.
+	if isPattern(rule) {
+		cache.flush("")
+	} else {
+		cache.flush(strings.TrimPrefix(rule, "*."))
+	}
+	infof("Admin API: blocked %s", rule)
+	writeJSON(w, map[string]string{"blocked": rule})
+}
+
+func adminUnblock(w http.ResponseWriter, r *http.Request) {
+	rule := blockRule(r)
+	blockedMu.Lock()
+	found := blocked.remove(rule)
+	if found {
+		adminRules[rule] = false
+	}
+	blocked.compile()
+	blockedMu.Unlock()
+	if !found {
+		http.Error(w, "name not blocked", http.StatusNotFound)
+		return
+	}
+	infof("Admin API: unblocked %s", rule)
+	writeJSON(w, map[string]string{"unblocked": rule})
+}
+
+// adminClients returns the daily query counts of the clients.
+func adminClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, usageReport())
+}
+
+// adminResetClient clears today's count of the client ?client=, or of
+// all clients without it.
+func adminResetClient(w http.ResponseWriter, r *http.Request) {
+	key := ""
+	if c := r.URL.Query().Get("client"); c != "" {
+		ip := net.ParseIP(c)
+		if ip == nil {
+			http.Error(w, "bad client address", http.StatusBadRequest)
+			return
+		}
+		key = rateKey(ip)
+	}
+	if !resetUsage(key) {
+		http.Error(w, "no queries from client today", http.StatusNotFound)
+		return
+	}
+	infof("Admin API: reset the daily query count of %q", key)
+	writeJSON(w, map[string]string{"reset": key})
+}
+
+// adminToggleUpstream disables or enables the upstreams with address
+// ?addr= in every view and route.
+func adminToggleUpstream(disable bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr := r.URL.Query().Get("addr")
+		var changed []upstreamStatus
+		for _, u := range knownUpstreams() {
+			if u.addr == addr {
+				u.setDisabled(disable)
+				changed = append(changed, u.status())
+			}
+		}
+		if len(changed) == 0 {
+			http.Error(w, "unknown upstream", http.StatusNotFound)
+			return
+		}
+		infof("Admin API: upstream %s disabled=%v", addr, disable)
+		writeJSON(w, changed)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchQuery packs a query for name, under a random label when unique is
+// set so that it misses the cache.
+func benchQuery(name string, qtype uint16, unique bool) []byte {
+	if unique {
+		name = fmt.Sprintf("b%08x.%s", rand.Uint32(), name)
+	}
+	var msg dnsMsg
+	msg.id = uint16(rand.Uint32())
+	msg.recursion_desired = true
+	msg.question = []dnsQuestion{{Name: name, Qtype: qtype, Qclass: dnsClassINET}}
+	return packDNSMsg(msg)
+}
+
+// benchExchange sends one query to server and returns the rcode of the
+// reply.
+func benchExchange(server string, query []byte, useTCP bool, timeout time.Duration) (int, error) {
+	network := "udp"
+	if useTCP {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, server, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	reply := make([]byte, 65535)
+	var n int
+	if useTCP {
+		msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err := conn.Write(append(msg, query...)); err != nil {
+			return 0, err
+		}
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return 0, err
+		}
+		if n, err = io.ReadFull(conn, reply[:length]); err != nil {
+			return 0, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return 0, err
+		}
+		if n, err = conn.Read(reply); err != nil {
+			return 0, err
+		}
+	}
+	if n < 4 || !matchesQuery(query, reply[:n]) {
+		return 0, fmt.Errorf("reply does not match the query")
+	}
+	return int(reply[3] & 0xF), nil
+}
+
+// benchMain implements the "bench" subcommand.
+func benchMain(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	server := fs.String("server", "127.0.0.1:53", "proxy to send queries to")
+	qps := fs.Int("qps", 1000, "queries to send per second")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send queries")
+	names := fs.String("names", "example.com", "comma-separated names to ask for, in turn")
+	qtypeName := fs.String("type", "A", "query type")
+	unique := fs.Bool("unique", false, "ask for a random name under each of -names, so that every query misses the cache")
+	useTCP := fs.Bool("tcp", false, "send queries over TCP, one connection each")
+	timeout := fs.Duration("timeout", 2*time.Second, "how long to wait for each reply")
+	maxInflight := fs.Int("max-inflight", 10000, "queries waiting for a reply at most; beyond that queries are skipped")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dns2tcp bench [options]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || *qps <= 0 || *duration <= 0 || *maxInflight <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	qtype, ok := parseType(*qtypeName)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown type %q\n", *qtypeName)
+		os.Exit(2)
+	}
+	var queryNames []string
+	for _, n := range strings.Split(*names, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			queryNames = append(queryNames, n)
+		}
+	}
+	if len(queryNames) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var (
+		mu                              sync.Mutex
+		wg                              sync.WaitGroup
+		sent, skipped, answered, failed int
+		rcodes                          = make(map[int]int)
+		latencies                       []time.Duration
+	)
+	slots := make(chan struct{}, *maxInflight)
+	fmt.Printf("sending %d queries per second to %s for %v\n", *qps, *server, *duration)
+	// Queries go out in bursts every millisecond or so, as sleeping for
+	// the gap between two queries is too coarse at high rates.
+	const tick = time.Millisecond
+	start := time.Now()
+	for i := 0; ; i++ {
+		due := start.Add(time.Duration(float64(i) / float64(*qps) * float64(time.Second)))
+		if due.Sub(start) >= *duration {
+			break
+		}
+		if wait := time.Until(due); wait > tick {
+			time.Sleep(wait)
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			skipped++
+			continue
+		}
+		sent++
+		query := benchQuery(queryNames[i%len(queryNames)], qtype, *unique)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			t := time.Now()
+			rcode, err := benchExchange(*server, query, *useTCP, *timeout)
+			d := time.Since(t)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+				return
+			}
+			answered++
+			rcodes[rcode]++
+			latencies = append(latencies, d)
+		}()
+	}
+	sendTime := time.Since(start)
+	wg.Wait()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	pct := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	var codes []string
+	for rcode, n := range rcodes {
+		codes = append(codes, fmt.Sprintf("%s %d", rcodeName(rcode), n))
+	}
+	sort.Strings(codes)
+	fmt.Printf("queries: %d sent, %d answered, %d failed or timed out, %d skipped\n", sent, answered, failed, skipped)
+	fmt.Printf("rcodes: %s\n", strings.Join(codes, ", "))
+	fmt.Printf("throughput: %.0f queries/s sent, %.0f answers/s\n", float64(sent)/sendTime.Seconds(), float64(answered)/time.Since(start).Seconds())
+	fmt.Printf("latency p50: %v p90: %v p99: %v max: %v\n", pct(0.5), pct(0.9), pct(0.99), pct(1))
+}
+
+func rcodeName(rcode int) string {
+	switch rcode {
+	case dnsRcodeSuccess:
+		return "NOERROR"
+	case dnsRcodeFormatError:
+		return "FORMERR"
+	case dnsRcodeServerFailure:
+		return "SERVFAIL"
+	case dnsRcodeNameError:
+		return "NXDOMAIN"
+	case dnsRcodeNotImplemented:
+		return "NOTIMP"
+	case dnsRcodeRefused:
+		return "REFUSED"
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
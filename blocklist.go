@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	blocklistFiles stringList
+	allowlistFiles stringList
+	blockMode      = flag.String("block-mode", "null", "answer for blocked names: null (0.0.0.0 and ::), nxdomain or refused")
+	blockTTL       = flag.Uint("block-ttl", 60, "TTL of answers to blocked names")
+	blockCNAMEs    = flag.Bool("block-cnames", true, "also block answers whose CNAME chain leads to a blocked name, as trackers hide behind first-party names")
+	blockRefresh   = flag.Duration("blocklist-refresh", 24*time.Hour, "how often to download the blocklist URLs again and reread changed files, 0 for never")
+)
+
+func init() {
+	flag.Var(&blocklistFiles, "blocklist", "refuse to resolve the names in this hosts or domain-per-line file or http(s) URL, where *.domain blocks the subdomains of domain and /regexp/ the names it matches (repeatable)")
+	flag.Var(&allowlistFiles, "allowlist", "never block the names in this file, *.domain entries cover its subdomains and /regexp/ lines are patterns (repeatable)")
+}
+
+// The blocklist rules, loaded at startup and changed through the admin
+// API. Refreshing the lists replaces blocked with a new matcher.
+var (
+	blockedMu sync.RWMutex
+	blocked   = newBlockMatcher()
+
+	// Rules added (true) or removed (false) through the admin API, which
+	// still apply after the lists are refreshed.
+	adminRules = make(map[string]bool)
+)
+
+// blocklistSource is a -blocklist file or URL and the rules last read
+// from it.
+type blocklistSource struct {
+	loc   string
+	rules []string
+
+	// The validators of the last download, or the file's modification
+	// time.
+	etag, modified string
+}
+
+var blocklistSources []*blocklistSource
+
+// Largest blocklist download accepted.
+const maxBlocklistSize = 64 << 20
+
+// blocklistClient downloads the blocklists. It is set up to go out the
+// way the upstream connections do, from the -outbound address and
+// through the -upstream-proxy.
+var blocklistClient = &http.Client{Timeout: time.Minute}
+
+// Names that bypass blocking, as rules like those of the blocklists.
+var allowlist = newBlockMatcher()
+
+// Names hosts-format blocklists usually carry that must keep working.
+var blocklistIgnored = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+func setupBlocklists() {
+	switch *blockMode {
+	case "null", "nxdomain", "refused":
+	default:
+		log.Fatalf("bad -block-mode %q, want null, nxdomain or refused", *blockMode)
+	}
+	blocklistClient.Transport = odohClient.Transport
+	if proxy, err := parseProxy(*upstreamProxy); err == nil && proxy != nil {
+		blocklistClient.Transport = proxiedHTTPClient(proxy).Transport
+	}
+	for _, loc := range blocklistFiles {
+		src := &blocklistSource{loc: loc}
+		if _, err := src.load(); err != nil {
+			// A download may work once the network is up.
+			if !src.isURL() {
+				log.Fatal(err)
+			}
+			warnf("blocklist: %v", err)
+		} else {
+			infof("blocklist: loaded %d rules from %s", len(src.rules), loc)
+		}
+		blocklistSources = append(blocklistSources, src)
+	}
+	rebuildBlocklist()
+	if len(blocklistSources) > 0 && *blockRefresh > 0 {
+		go refreshBlocklists(blocklistSources, rebuildBlocklist)
+	}
+	for _, path := range allowlistFiles {
+		names, err := parseBlocklist(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, name := range names {
+			if err := allowlist.add(name); err != nil {
+				log.Fatalf("%s: %v", path, err)
+			}
+		}
+		infof("allowlist: loaded %d names from %s", len(names), path)
+	}
+	allowlist.compile()
+}
+
+// isAllowed reports whether name is exempt from blocking.
+func isAllowed(name string) bool {
+	return allowlist.match(name)
+}
+
+func (src *blocklistSource) isURL() bool {
+	return strings.HasPrefix(src.loc, "http://") || strings.HasPrefix(src.loc, "https://")
+}
+
+// load reads the source again if it changed, reporting whether it did.
+func (src *blocklistSource) load() (bool, error) {
+	if src.isURL() {
+		return src.download()
+	}
+	fi, err := os.Stat(src.loc)
+	if err != nil {
+		return false, err
+	}
+	modified := fi.ModTime().String()
+	if modified == src.modified {
+		return false, nil
+	}
+	rules, err := parseBlocklist(src.loc)
+	if err != nil {
+		return false, err
+	}
+	src.rules, src.modified = rules, modified
+	return true, nil
+}
+
+// download fetches the list unless the server says it has not changed
+// since the last time.
+func (src *blocklistSource) download() (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, src.loc, nil)
+	if err != nil {
+		return false, err
+	}
+	if src.etag != "" {
+		req.Header.Set("If-None-Match", src.etag)
+	}
+	if src.modified != "" {
+		req.Header.Set("If-Modified-Since", src.modified)
+	}
+	resp, err := blocklistClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s: %s", src.loc, resp.Status)
+	}
+	rules, err := readBlocklist(io.LimitReader(resp.Body, maxBlocklistSize))
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", src.loc, err)
+	}
+	src.rules = rules
+	src.etag, src.modified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return true, nil
+}
+
+// rebuildBlocklist compiles the rules of all sources and the admin API
+// into a new matcher and swaps it in, so that queries keep being
+// checked against the old rules until the new ones are ready.
+func rebuildBlocklist() {
+	blockedMu.RLock()
+	changes := maps.Clone(adminRules)
+	blockedMu.RUnlock()
+
+	m := newBlockMatcher()
+	for _, src := range blocklistSources {
+		for _, rule := range src.rules {
+			if err := m.add(rule); err != nil {
+				warnf("blocklist %s: %v", src.loc, err)
+			}
+		}
+	}
+	applyAdminRules(m, changes)
+	m.compile()
+
+	blockedMu.Lock()
+	defer blockedMu.Unlock()
+	// Catch up with changes made in the meantime.
+	applyAdminRules(m, adminRules)
+	m.compile()
+	blocked = m
+}
+
+func applyAdminRules(m *blockMatcher, changes map[string]bool) {
+	for rule, add := range changes {
+		if add {
+			m.add(rule)
+		} else {
+			m.remove(rule)
+		}
+	}
+}
+
+// refreshBlocklists reloads sources every -blocklist-refresh, or every
+// few minutes while a download has never succeeded, and calls rebuild
+// when one of them changed.
+func refreshBlocklists(sources []*blocklistSource, rebuild func()) {
+	for {
+		wait := *blockRefresh
+		for _, src := range sources {
+			if src.rules == nil {
+				wait = min(wait, 5*time.Minute)
+			}
+		}
+		time.Sleep(wait)
+		changed := false
+		for _, src := range sources {
+			ok, err := src.load()
+			if err != nil {
+				warnf("blocklist: %v", err)
+				continue
+			}
+			if ok {
+				infof("blocklist: loaded %d rules from %s", len(src.rules), src.loc)
+				changed = true
+			}
+		}
+		if changed {
+			rebuild()
+		}
+	}
+}
+
+// parseBlocklist reads a blocklist file.
+func parseBlocklist(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readBlocklist(f)
+}
+
+// readBlocklist reads a list that is either in hosts(5) format, as most
+// ad-blocking lists are, or has one domain per line. Lines holding a
+// /regexp/ are kept as they are.
+func readBlocklist(r io.Reader) ([]string, error) {
+	var names []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); isPattern(line) {
+			names = append(names, line)
+			continue
+		}
+		line, _, _ := strings.Cut(s.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			name = canonicalName(name)
+			if !blocklistIgnored[name] {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, s.Err()
+}
+
+// isBlocked reports whether the blocklist, the one of the client group
+// g or a scheduled one in force covers name and the allowlist does not.
+func isBlocked(name string, g *clientGroup) bool {
+	name = canonicalName(name)
+	match := false
+	if g == nil || g.globalBlocklist {
+		blockedMu.RLock()
+		match = blocked.match(name)
+		blockedMu.RUnlock()
+	}
+	if !match && g != nil {
+		match = g.blocked.Load().match(name)
+	}
+	if !match {
+		match = scheduleBlocked(name, g)
+	}
+	if !match {
+		return false
+	}
+	if isAllowed(name) {
+		debugf("Allowed %s despite blocklist", name)
+		return false
+	}
+	return true
+}
+
+func blockedNameError(query dnsMsg) []byte {
+	reply := newReply(query, dnsRcodeNameError)
+	soa := syntheticSOA(canonicalName(query.question[0].Name))
+	soa.Ttl = uint32(*blockTTL)
+	reply.ns = []dnsRR{soa}
+	return packDNSMsg(reply)
+}
+
+// cnameBlockAnswer returns NXDOMAIN when the answer msg to query goes
+// through a CNAME to a blocked name, and nil otherwise.
+func cnameBlockAnswer(query, msg dnsMsg, g *clientGroup) []byte {
+	if !*blockCNAMEs || len(query.question) != 1 {
+		return nil
+	}
+	for _, rr := range msg.answer {
+		if rr.Rrtype != dnsTypeCNAME {
+			continue
+		}
+		target, _, err := getDomainName(rr.Data, 0)
+		if err != nil || !isBlocked(target, g) {
+			continue
+		}
+		debugf("Blocked %s, an alias of %s", query.question[0].Name, target)
+		return blockedNameError(query)
+	}
+	return nil
+}
+
+// blockAnswer answers queries for blocked names according to -block-mode
+// and returns nil for everything else.
+func blockAnswer(query dnsMsg, g *clientGroup) []byte {
+	if len(query.question) != 1 {
+		return nil
+	}
+	q := query.question[0]
+	if !isBlocked(q.Name, g) {
+		return nil
+	}
+	debugf("Blocked %s", q.Name)
+	switch *blockMode {
+	case "nxdomain":
+		return blockedNameError(query)
+	case "refused":
+		return packDNSMsg(newReply(query, dnsRcodeRefused))
+	}
+	reply := newReply(query, dnsRcodeSuccess)
+	rr := dnsRR{Name: q.Name, Rrtype: q.Qtype, Class: dnsClassINET, Ttl: uint32(*blockTTL)}
+	switch q.Qtype {
+	case dnsTypeA:
+		rr.Data = net.IPv4zero.To4()
+	case dnsTypeAAAA:
+		rr.Data = net.IPv6zero
+	}
+	if rr.Data != nil {
+		rr.Rdlength = uint16(len(rr.Data))
+		reply.answer = []dnsRR{rr}
+	}
+	return packDNSMsg(reply)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// blockMatcher matches names against blocklist rules: exact names,
+// *.domain wildcards covering the subdomains of domain, and /regexp/
+// patterns. Wildcards are kept in a trie of reversed labels and the
+// patterns compiled into a single regexp, so that the cost of a lookup
+// does not grow with the size of the list.
+type blockMatcher struct {
+	exact    map[string]bool
+	suffixes *labelTrie
+	nsuffix  int
+	patterns []string
+	re       *regexp.Regexp
+}
+
+func newBlockMatcher() *blockMatcher {
+	return &blockMatcher{exact: make(map[string]bool), suffixes: &labelTrie{}}
+}
+
+// isPattern reports whether a rule is a /regexp/ pattern.
+func isPattern(rule string) bool {
+	return len(rule) > 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/")
+}
+
+// add adds a rule, which is a canonical name, *.domain or /regexp/.
+func (m *blockMatcher) add(rule string) error {
+	switch {
+	case isPattern(rule):
+		if _, err := regexp.Compile(rule[1 : len(rule)-1]); err != nil {
+			return fmt.Errorf("bad blocklist pattern %s: %v", rule, err)
+		}
+		for _, p := range m.patterns {
+			if p == rule {
+				return nil
+			}
+		}
+		m.patterns = append(m.patterns, rule)
+		m.re = nil
+	case strings.HasPrefix(rule, "*."):
+		if m.suffixes.insert(rule[2:]) {
+			m.nsuffix++
+		}
+	default:
+		m.exact[rule] = true
+	}
+	return nil
+}
+
+// remove deletes a rule, reporting whether it was there.
+func (m *blockMatcher) remove(rule string) bool {
+	switch {
+	case isPattern(rule):
+		for i, p := range m.patterns {
+			if p == rule {
+				m.patterns = append(m.patterns[:i:i], m.patterns[i+1:]...)
+				m.re = nil
+				return true
+			}
+		}
+		return false
+	case strings.HasPrefix(rule, "*."):
+		if m.suffixes.remove(rule[2:]) {
+			m.nsuffix--
+			return true
+		}
+		return false
+	}
+	found := m.exact[rule]
+	delete(m.exact, rule)
+	return found
+}
+
+// compile builds the regexp of the patterns after they change. It has
+// to be called before match.
+func (m *blockMatcher) compile() {
+	if m.re != nil || len(m.patterns) == 0 {
+		return
+	}
+	alts := make([]string, len(m.patterns))
+	for i, p := range m.patterns {
+		alts[i] = "(?:" + p[1:len(p)-1] + ")"
+	}
+	m.re = regexp.MustCompile(strings.Join(alts, "|"))
+}
+
+// match reports whether the canonical name is blocked.
+func (m *blockMatcher) match(name string) bool {
+	return m.exact[name] || m.suffixes.covers(name) || m.re != nil && m.re.MatchString(name)
+}
+
+func (m *blockMatcher) len() int {
+	return len(m.exact) + m.nsuffix + len(m.patterns)
+}
+
+// rules returns every rule.
+func (m *blockMatcher) rules() []string {
+	rules := make([]string, 0, m.len())
+	for name := range m.exact {
+		rules = append(rules, name)
+	}
+	m.suffixes.walk(nil, func(domain string) {
+		rules = append(rules, "*."+domain)
+	})
+	rules = append(rules, m.patterns...)
+	sort.Strings(rules)
+	return rules
+}
+
+// labelTrie holds domains by their labels, from the top level down.
+type labelTrie struct {
+	children map[string]*labelTrie
+	end      bool
+}
+
+// insert adds domain, reporting whether it was new.
+func (t *labelTrie) insert(domain string) bool {
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if t.children == nil {
+			t.children = make(map[string]*labelTrie)
+		}
+		next := t.children[labels[i]]
+		if next == nil {
+			next = &labelTrie{}
+			t.children[labels[i]] = next
+		}
+		t = next
+	}
+	added := !t.end
+	t.end = true
+	return added
+}
+
+func (t *labelTrie) remove(domain string) bool {
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0 && t != nil; i-- {
+		t = t.children[labels[i]]
+	}
+	if t == nil || !t.end {
+		return false
+	}
+	t.end = false
+	return true
+}
+
+// covers reports whether name is a subdomain of a domain in t.
+func (t *labelTrie) covers(name string) bool {
+	labels := strings.Split(name, ".")
+	for i := len(labels) - 1; i > 0; i-- {
+		if t = t.children[labels[i]]; t == nil {
+			return false
+		}
+		if t.end {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *labelTrie) walk(labels []string, f func(domain string)) {
+	if t.end {
+		rev := make([]string, len(labels))
+		for i, l := range labels {
+			rev[len(labels)-1-i] = l
+		}
+		f(strings.Join(rev, "."))
+	}
+	for label, child := range t.children {
+		child.walk(append(labels, label), f)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	bootstrapServers = flag.String("bootstrap", "", "comma-separated resolvers, ip or ip:port, that look up the host names of upstreams and proxies instead of the system resolver")
+	bootstrapRefresh = flag.Duration("bootstrap-refresh", 10*time.Minute, "how often to look up the host names of upstreams again when -bootstrap is set")
+)
+
+// bootstrap resolves the host names of upstreams with the -bootstrap
+// servers, so that they can be reached without a working system resolver,
+// and caches the addresses until the next refresh.
+var bootstrap struct {
+	resolver *net.Resolver
+	next     atomic.Uint32
+
+	mu    sync.Mutex
+	hosts map[string][]net.IP
+}
+
+func setupBootstrap() {
+	var servers []string
+	for _, s := range strings.Split(*bootstrapServers, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if net.ParseIP(s) != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		host, _, err := net.SplitHostPort(s)
+		if err != nil || net.ParseIP(host) == nil {
+			log.Fatalf("bad -bootstrap server %q, want an IP address", s)
+		}
+		servers = append(servers, s)
+	}
+	if len(servers) == 0 {
+		return
+	}
+	bootstrap.hosts = make(map[string][]net.IP)
+	bootstrap.resolver = &net.Resolver{
+		PreferGo: true,
+		// Each attempt of the resolver goes to the next server, so that a
+		// dead one is skipped on retry.
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := servers[int(bootstrap.next.Add(1)-1)%len(servers)]
+			if strings.HasPrefix(network, "udp") {
+				return outboundDialer("udp").DialContext(ctx, network, server)
+			}
+			return outboundDialer("tcp").DialContext(ctx, network, server)
+		},
+	}
+
+	if *bootstrapRefresh > 0 {
+		go func() {
+			for range time.Tick(*bootstrapRefresh) {
+				refreshBootstrap()
+			}
+		}()
+	}
+	infof("Looking up upstream host names with %s", strings.Join(servers, ", "))
+}
+
+// bootstrapLookup returns the addresses of host, from the cache if it was
+// looked up before.
+func bootstrapLookup(ctx context.Context, host string) ([]net.IP, error) {
+	bootstrap.mu.Lock()
+	ips, ok := bootstrap.hosts[host]
+	bootstrap.mu.Unlock()
+	if ok {
+		return ips, nil
+	}
+	ips, err := bootstrap.resolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	debugf("bootstrap: %s is %v", host, ips)
+	bootstrap.mu.Lock()
+	bootstrap.hosts[host] = ips
+	bootstrap.mu.Unlock()
+	return ips, nil
+}
+
+// refreshBootstrap looks up the cached host names again. A host keeps its
+// old addresses if the lookup fails.
+func refreshBootstrap() {
+	bootstrap.mu.Lock()
+	hosts := make([]string, 0, len(bootstrap.hosts))
+	for host := range bootstrap.hosts {
+		hosts = append(hosts, host)
+	}
+	bootstrap.mu.Unlock()
+	for _, host := range hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), *queryTimeout)
+		ips, err := bootstrap.resolver.LookupIP(ctx, "ip", host)
+		cancel()
+		if err != nil {
+			warnf("bootstrap: keeping the old addresses of %s: %v", host, err)
+			continue
+		}
+		bootstrap.mu.Lock()
+		bootstrap.hosts[host] = ips
+		bootstrap.mu.Unlock()
+	}
+}
+
+// lookupHost returns the addresses of host, from the -bootstrap servers
+// if they are set and else from the system resolver.
+func lookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	if bootstrap.resolver == nil {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+	return bootstrapLookup(ctx, host)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"flag"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	cacheSize          = flag.Int("cache-size", 1000, "number of responses to cache, 0 to disable caching")
+	serveStale         = flag.Bool("serve-stale", false, "answer from expired cache entries when the upstreams fail or are slow (RFC 8767)")
+	staleTTL           = flag.Duration("stale-ttl", 30*time.Second, "TTL of stale answers")
+	staleMaxAge        = flag.Duration("stale-max-age", 24*time.Hour, "how long past expiry cache entries may be served stale")
+	staleAnswerTimeout = flag.Duration("stale-answer-timeout", 1800*time.Millisecond, "how long to wait for the upstreams before answering stale")
+	ttlFloor           = flag.Uint("min-ttl", 0, "raise lower TTLs in relayed and cached answers to this many seconds")
+	ttlCeiling         = flag.Uint("max-ttl", 0, "lower higher TTLs in relayed and cached answers to this many seconds, 0 for no limit")
+	prefetchHits       = flag.Int("prefetch-hits", 0, "refresh cache entries hit this many times once 90% of their TTL has passed, 0 to disable")
+)
+
+type cacheKey struct {
+	view   string
+	group  string
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     dnsMsg
+	stored  time.Time
+	expires time.Time
+
+	hits        int
+	prefetching bool
+}
+
+// responseCache is an LRU cache of upstream responses that are served
+// until the smallest TTL they contain runs out.
+type responseCache struct {
+	mu    sync.Mutex
+	size  int
+	lru   *list.List
+	items map[cacheKey]*list.Element
+}
+
+var cache *responseCache
+
+func setupCache() {
+	if *cacheSize <= 0 {
+		return
+	}
+	cache = &responseCache{size: *cacheSize, lru: list.New(), items: make(map[cacheKey]*list.Element)}
+	registerTrimHook(cache.trim)
+}
+
+func newCacheKey(v *view, query dnsMsg) (cacheKey, bool) {
+	if len(query.question) != 1 {
+		return cacheKey{}, false
+	}
+	q := query.question[0]
+	return cacheKey{v.name, v.group, canonicalName(q.Name), q.Qtype, q.Qclass}, true
+}
+
+// minTTL returns the smallest TTL in msg, ignoring EDNS OPT records
+// whose TTL field holds flags.
+func minTTL(msg dnsMsg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, rrs := range [][]dnsRR{msg.answer, msg.ns, msg.extra} {
+		for _, rr := range rrs {
+			if rr.Rrtype == dnsTypeOPT {
+				continue
+			}
+			if !found || rr.Ttl < ttl {
+				ttl, found = rr.Ttl, true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// RFC 2308 section 5 recommends capping negative caching at 3 hours.
+const maxNegativeTTL = 3 * 3600
+
+// negativeCacheTTL returns how long a NXDOMAIN or NODATA response may be
+// cached: the smaller of the TTL and the minimum field of the SOA in the
+// authority section (RFC 2308 section 5). Responses without an SOA must
+// not be cached.
+func negativeCacheTTL(msg dnsMsg) (uint32, bool) {
+	for _, rr := range msg.ns {
+		if rr.Rrtype == dnsTypeSOA {
+			return min(rr.Ttl, soaMinimum(rr), maxNegativeTTL), true
+		}
+	}
+	return 0, false
+}
+
+func (c *responseCache) put(v *view, query, msg dnsMsg) {
+	if c == nil || msg.truncated {
+		return
+	}
+	key, ok := newCacheKey(v, query)
+	if !ok {
+		return
+	}
+	var ttl uint32
+	switch {
+	case msg.rcode == dnsRcodeSuccess && len(msg.answer) > 0:
+		ttl, ok = minTTL(msg)
+	case msg.rcode == dnsRcodeSuccess || msg.rcode == dnsRcodeNameError:
+		ttl, ok = negativeCacheTTL(msg)
+		if ok {
+			msg.ns = append([]dnsRR{}, msg.ns...)
+			for i := range msg.ns {
+				if msg.ns[i].Rrtype == dnsTypeSOA {
+					msg.ns[i].Ttl = ttl
+				}
+			}
+		}
+	default:
+		return
+	}
+	if !ok {
+		return
+	}
+	if ttl = clampTTL(ttl); ttl == 0 {
+		return
+	}
+	now := time.Now()
+	e := &cacheEntry{key: key, msg: msg, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *responseCache) removeElement(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).key)
+}
+
+// get returns the cached response to query with the TTLs reduced by the
+// time spent in the cache and the ID of the query.
+func (c *responseCache) get(v *view, query dnsMsg) (dnsMsg, bool) {
+	if c == nil {
+		return dnsMsg{}, false
+	}
+	key, ok := newCacheKey(v, query)
+	if !ok {
+		return dnsMsg{}, false
+	}
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if !ok {
+		c.mu.Unlock()
+		return dnsMsg{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(e.expires) {
+		// Expired entries are kept around for serving stale.
+		if !*serveStale || !now.Before(e.expires.Add(*staleMaxAge)) {
+			c.removeElement(el)
+		}
+		c.mu.Unlock()
+		return dnsMsg{}, false
+	}
+	c.lru.MoveToFront(el)
+	e.hits++
+	c.mu.Unlock()
+
+	age := uint32(now.Sub(e.stored) / time.Second)
+	return e.reply(query, func(ttl uint32) uint32 {
+		return ttl - min(ttl, age)
+	}), true
+}
+
+// getStale returns the cached response to query even if it has expired,
+// as long as it is within -stale-max-age, with every TTL set to
+// -stale-ttl.
+func (c *responseCache) getStale(v *view, query dnsMsg) (dnsMsg, bool) {
+	if c == nil || !*serveStale {
+		return dnsMsg{}, false
+	}
+	key, ok := newCacheKey(v, query)
+	if !ok {
+		return dnsMsg{}, false
+	}
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if !ok {
+		c.mu.Unlock()
+		return dnsMsg{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !time.Now().Before(e.expires.Add(*staleMaxAge)) {
+		c.mu.Unlock()
+		return dnsMsg{}, false
+	}
+	c.mu.Unlock()
+
+	stale := uint32(staleTTL.Seconds())
+	return e.reply(query, func(uint32) uint32 {
+		return stale
+	}), true
+}
+
+// prefetchDue reports whether the cached response to query is popular
+// and close enough to expiry to be refreshed ahead of time. It reports
+// each entry once, so that it is refreshed by a single query.
+func (c *responseCache) prefetchDue(v *view, query dnsMsg) bool {
+	if c == nil || *prefetchHits <= 0 {
+		return false
+	}
+	key, ok := newCacheKey(v, query)
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*cacheEntry)
+	left := time.Until(e.expires)
+	if e.prefetching || e.hits < *prefetchHits || left*10 > e.expires.Sub(e.stored) {
+		return false
+	}
+	e.prefetching = true
+	return true
+}
+
+// reply returns the cached response for query with the TTLs changed by
+// ttl and the ID of the query.
+func (e *cacheEntry) reply(query dnsMsg, ttl func(uint32) uint32) dnsMsg {
+	msg := e.msg
+	msg.id = query.id
+	msg.question = query.question
+	msg.answer = adjustTTLs(e.msg.answer, ttl)
+	msg.ns = adjustTTLs(e.msg.ns, ttl)
+	msg.extra = adjustTTLs(e.msg.extra, ttl)
+	return msg
+}
+
+func adjustTTLs(rrs []dnsRR, ttl func(uint32) uint32) []dnsRR {
+	if rrs == nil {
+		return nil
+	}
+	out := make([]dnsRR, len(rrs))
+	for i, rr := range rrs {
+		if rr.Rrtype != dnsTypeOPT {
+			rr.Ttl = ttl(rr.Ttl)
+		}
+		out[i] = rr
+	}
+	return out
+}
+
+// clampTTL applies -min-ttl and -max-ttl to a TTL.
+func clampTTL(ttl uint32) uint32 {
+	if *ttlCeiling > 0 && ttl > uint32(*ttlCeiling) {
+		ttl = uint32(*ttlCeiling)
+	}
+	return max(ttl, uint32(*ttlFloor))
+}
+
+// clampTTLs applies -min-ttl and -max-ttl to the records of an upstream
+// answer, reporting whether it had any to change.
+func clampTTLs(msg dnsMsg) (dnsMsg, bool) {
+	if *ttlFloor == 0 && *ttlCeiling == 0 {
+		return msg, false
+	}
+	msg.answer = adjustTTLs(msg.answer, clampTTL)
+	msg.ns = adjustTTLs(msg.ns, clampTTL)
+	msg.extra = adjustTTLs(msg.extra, clampTTL)
+	return msg, true
+}
+
+// forwardOrStale is forward for queries that have a stale cache entry:
+// if the upstreams fail or take longer than -stale-answer-timeout the
+// stale entry is returned and the exchange goes on in the background to
+// refresh it.
+func forwardOrStale(ctx context.Context, v *view, g upstreamGroup, query dnsMsg, data []byte) (reply []byte, msg dnsMsg, final []byte, stale bool) {
+	old, ok := cache.getStale(v, query)
+	if !ok {
+		reply, msg, final = forward(ctx, v, g, query, data)
+		return reply, msg, final, false
+	}
+	type result struct {
+		reply, final []byte
+		msg          dnsMsg
+	}
+	done := make(chan result, 1)
+	go func() {
+		reply, msg, final := forward(context.Background(), v, g, query, data)
+		done <- result{reply, final, msg}
+	}()
+	select {
+	case r := <-done:
+		if r.final == nil {
+			return r.reply, r.msg, nil, false
+		}
+	case <-time.After(*staleAnswerTimeout):
+	}
+	debugf("Serving stale answer for %v", query.question)
+	return nil, old, nil, true
+}
+
+// flush removes the cached responses for domain and its subdomains, or
+// all of them if domain is empty, and returns how many it removed.
+func (c *responseCache) flush(domain string) int {
+	if c == nil {
+		return 0
+	}
+	domain = canonicalName(domain)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, el := range c.items {
+		if domain == "" || key.name == domain || strings.HasSuffix(key.name, "."+domain) {
+			c.removeElement(el)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *responseCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// trim drops the older half of the cache to release memory.
+func (c *responseCache) trim() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n := c.lru.Len() / 2; n > 0; n-- {
+		c.removeElement(c.lru.Back())
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// benchCache returns an empty cache of size entries with the queries and
+// replies for n names to fill it with.
+func benchCache(size, n int) (*responseCache, []dnsMsg, []dnsMsg) {
+	c := &responseCache{size: size, lru: list.New(), items: make(map[cacheKey]*list.Element)}
+	var queries, replies []dnsMsg
+	for i := range n {
+		var query dnsMsg
+		query.id = uint16(i)
+		query.question = []dnsQuestion{{Name: fmt.Sprintf("host%d.example.com", i), Qtype: dnsTypeA, Qclass: dnsClassINET}}
+		reply := newReply(query, dnsRcodeSuccess)
+		reply.answer = addressRRs(query.question[0].Name, dnsTypeA, []net.IP{net.IPv4(192, 0, 2, byte(i))})
+		reply.answer[0].Ttl = 3600
+		queries, replies = append(queries, query), append(replies, reply)
+	}
+	return c, queries, replies
+}
+
+func BenchmarkCachePut(b *testing.B) {
+	// Twice as many names as fit, so that puts also evict.
+	c, queries, replies := benchCache(10000, 20000)
+	v := &view{}
+	i := 0
+	for b.Loop() {
+		c.put(v, queries[i], replies[i])
+		i = (i + 1) % len(queries)
+	}
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	c, queries, replies := benchCache(10000, 10000)
+	v := &view{}
+	for i := range queries {
+		c.put(v, queries[i], replies[i])
+	}
+	i := 0
+	for b.Loop() {
+		if _, ok := c.get(v, queries[i]); !ok {
+			b.Fatalf("%s not cached", queries[i].question[0].Name)
+		}
+		i = (i + 1) % len(queries)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	captiveProbe   = flag.String("captive-portal-probe", "", "URL that answers 204 No Content on an open network, e.g. http://connectivitycheck.gstatic.com/generate_204; when no upstream can be reached and fetching it gets redirected, the names of the login portal and of the usual connectivity checks are looked up with the system resolver, which must not be this proxy, until the upstreams answer again")
+	captiveDomains stringList
+)
+
+func init() {
+	flag.Var(&captiveDomains, "captive-portal-domain", "also look up names under this domain with the system resolver while behind a captive portal, for portals that redirect through several hosts (repeatable)")
+	useMiddleware("captive", "forward", captiveStage)
+}
+
+// The connectivity checks of the common operating systems and browsers,
+// which open their portal login windows when they get redirected.
+var connectivityChecks = []string{
+	"captive.apple.com",
+	"connectivitycheck.gstatic.com",
+	"clients3.google.com",
+	"www.msftconnecttest.com",
+	"www.msftncsi.com",
+	"detectportal.firefox.com",
+	"nmcheck.gnome.org",
+	"connectivity-check.ubuntu.com",
+}
+
+const (
+	// How often the probe may run while the upstreams fail.
+	captiveProbeInterval = 30 * time.Second
+	// The TTL of answers from the system resolver, short as they only
+	// hold until the portal lets us through.
+	captiveTTL = 10
+)
+
+// captive is the state of captive portal detection. While detected is set
+// the names in domains are looked up with the system resolver.
+var captive struct {
+	detected atomic.Bool
+
+	mu        sync.Mutex
+	domains   []string
+	probing   bool
+	lastProbe time.Time
+}
+
+// suspectCaptivePortal is called when no upstream can be reached. It
+// fetches the -captive-portal-probe URL in the background, at most every
+// captiveProbeInterval.
+func suspectCaptivePortal() {
+	if *captiveProbe == "" {
+		return
+	}
+	captive.mu.Lock()
+	defer captive.mu.Unlock()
+	if captive.probing || time.Since(captive.lastProbe) < captiveProbeInterval {
+		return
+	}
+	captive.probing, captive.lastProbe = true, time.Now()
+	go probeCaptivePortal()
+}
+
+func probeCaptivePortal() {
+	defer func() {
+		captive.mu.Lock()
+		captive.probing = false
+		captive.mu.Unlock()
+	}()
+	probe, err := url.Parse(*captiveProbe)
+	if err != nil {
+		warnf("captive portal: bad probe URL: %v", err)
+		return
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = outboundDialer("tcp").DialContext
+	client := &http.Client{
+		Transport: t,
+		Timeout:   *queryTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(probe.String())
+	if err != nil {
+		debugf("captive portal: probe failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		debugf("captive portal: none, the probe got through")
+		captivePortalGone()
+		return
+	}
+	domains := append([]string{canonicalName(probe.Hostname())}, connectivityChecks...)
+	portal := "unknown"
+	if loc, err := resp.Location(); err == nil && loc.Hostname() != "" {
+		portal = loc.Hostname()
+		domains = append(domains, canonicalName(portal))
+	}
+	for _, d := range captiveDomains {
+		domains = append(domains, canonicalName(d))
+	}
+	captive.mu.Lock()
+	captive.domains = domains
+	captive.mu.Unlock()
+	if !captive.detected.Swap(true) {
+		warnf("Captive portal detected (probe answered %s, portal %s), looking up its names with the system resolver until the upstreams answer", resp.Status, portal)
+	}
+}
+
+// captivePortalGone ends captive portal mode once the upstreams answer or
+// the probe gets through.
+func captivePortalGone() {
+	if captive.detected.Swap(false) {
+		infof("Captive portal passed, back to using only the upstreams")
+	}
+}
+
+// portalName reports whether the canonical name is at or under one of the
+// domains of the portal.
+func portalName(name string) bool {
+	captive.mu.Lock()
+	defer captive.mu.Unlock()
+	for _, d := range captive.domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// captiveStage answers address queries for the portal's names with the
+// system resolver while behind a captive portal.
+func captiveStage(r *request, next handler) []byte {
+	if !captive.detected.Load() || len(r.query.question) != 1 {
+		return next(r)
+	}
+	q := r.query.question[0]
+	name := canonicalName(q.Name)
+	if q.Qtype != dnsTypeA && q.Qtype != dnsTypeAAAA || !portalName(name) {
+		return next(r)
+	}
+	network := "ip4"
+	if q.Qtype == dnsTypeAAAA {
+		network = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupIP(r.ctx, network, name)
+	var dnsErr *net.DNSError
+	var addrErr *net.AddrError
+	switch {
+	case errors.As(err, &addrErr):
+		// The name has addresses, only not of this family.
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return packDNSMsg(newReply(r.query, dnsRcodeNameError))
+	case err != nil:
+		debugf("captive portal: %s: %v", name, err)
+		return packDNSMsg(newReply(r.query, dnsRcodeServerFailure))
+	}
+	debugf("captive portal: %s is %v", name, ips)
+	reply := newReply(r.query, dnsRcodeSuccess)
+	reply.answer = addressRRs(q.Name, q.Qtype, ips)
+	for i := range reply.answer {
+		reply.answer[i].Ttl = captiveTTL
+	}
+	return packDNSMsg(reply)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var captureFile = flag.String("capture", "", "write client queries and replies to this pcap file, wrapped in synthetic IP and UDP headers, for Wireshark")
+
+// LINKTYPE_RAW: packets start with an IPv4 or IPv6 header.
+const pcapLinkRaw = 101
+
+var capture struct {
+	sync.Mutex
+	f *os.File
+}
+
+func setupCapture() {
+	if *captureFile == "" {
+		return
+	}
+	f, err := os.Create(*captureFile)
+	if err != nil {
+		log.Fatalf("capture: %v", err)
+	}
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr, 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkRaw)
+	if _, err := f.Write(hdr); err != nil {
+		log.Fatalf("capture: %v", err)
+	}
+	capture.f = f
+	infof("Capturing DNS traffic to %s", *captureFile)
+}
+
+// capturePacket records a DNS message between client and the local
+// address server, as a UDP datagram whatever transport carried it.
+func capturePacket(client, server net.Addr, msg []byte, fromClient bool) {
+	if capture.f == nil {
+		return
+	}
+	cip, cport := addrIP(client), addrPort(client)
+	sip, sport := addrIP(server), addrPort(server)
+	if cip == nil {
+		cip = net.IPv4zero
+	}
+	// Dual-stack listeners see IPv4 clients but have an IPv6 address.
+	if cip.To4() != nil && (sip == nil || sip.To4() == nil) {
+		sip = net.IPv4zero
+	} else if cip.To4() == nil && sip.To4() != nil {
+		sip = net.IPv6unspecified
+	}
+	src, dst, srcPort, dstPort := sip, cip, sport, cport
+	if fromClient {
+		src, dst, srcPort, dstPort = cip, sip, cport, sport
+	}
+	pkt := ipUDPPacket(src, dst, srcPort, dstPort, msg[:min(len(msg), 65535-48)])
+
+	now := time.Now()
+	rec := make([]byte, 16, 16+len(pkt))
+	binary.LittleEndian.PutUint32(rec, uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	rec = append(rec, pkt...)
+	capture.Lock()
+	defer capture.Unlock()
+	if _, err := capture.f.Write(rec); err != nil {
+		errorf("capture: %v", err)
+	}
+}
+
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.Port
+	case *net.TCPAddr:
+		return a.Port
+	}
+	return 0
+}
+
+// ipUDPPacket builds an IPv4 or IPv6 packet carrying payload in a UDP
+// datagram.
+func ipUDPPacket(src, dst net.IP, srcPort, dstPort int, payload []byte) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp, uint16(srcPort))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+
+	var ip, pseudo []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64
+		ip[9] = 17
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], ^checksum(0, ip))
+		pseudo = append(append([]byte{}, src4...), dst4...)
+	} else {
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+		ip[6] = 17
+		ip[7] = 64
+		copy(ip[8:], src.To16())
+		copy(ip[24:], dst.To16())
+		pseudo = append([]byte{}, ip[8:40]...)
+	}
+	pseudo = append(pseudo, 0, 17)
+	pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(udp)))
+	sum := ^checksum(checksum(0, pseudo), udp)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return append(ip, udp...)
+}
+
+// checksum adds b to the ones' complement sum of 16-bit words sum.
+func checksum(sum uint16, b []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
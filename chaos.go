@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"math/rand/v2"
+	"time"
+)
+
+var (
+	chaosDrop     = flag.Float64("chaos-drop", 0, "percentage of upstream responses to drop, for testing")
+	chaosJitter   = flag.Duration("chaos-jitter", 0, "random extra delay of up to this much on upstream responses, for testing")
+	chaosTruncate = flag.Float64("chaos-truncate", 0, "percentage of upstream responses to truncate, for testing")
+	chaosServfail = flag.Float64("chaos-servfail", 0, "percentage of upstream responses to turn into SERVFAIL, for testing")
+)
+
+var errChaosDrop = errors.New("chaos: upstream response dropped")
+
+func chaosEnabled() bool {
+	return *chaosDrop > 0 || *chaosJitter > 0 || *chaosTruncate > 0 || *chaosServfail > 0
+}
+
+func setupChaos() {
+	if chaosEnabled() {
+		infof("Fault injection enabled: drop %.1f%%, jitter %v, truncate %.1f%%, servfail %.1f%%",
+			*chaosDrop, *chaosJitter, *chaosTruncate, *chaosServfail)
+	}
+}
+
+func chance(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// chaosReply applies the configured faults to an upstream reply.
+func chaosReply(reply []byte) ([]byte, error) {
+	if *chaosJitter > 0 {
+		time.Sleep(rand.N(*chaosJitter))
+	}
+	if chance(*chaosDrop) {
+		return nil, errChaosDrop
+	}
+	truncate, servfail := chance(*chaosTruncate), chance(*chaosServfail)
+	if !truncate && !servfail {
+		return reply, nil
+	}
+	msg, err := parseDNSMsg(reply)
+	if err != nil {
+		return reply, nil
+	}
+	msg.answer, msg.ns, msg.extra = nil, nil, nil
+	if truncate {
+		msg.truncated = true
+	}
+	if servfail {
+		msg.rcode = dnsRcodeServerFailure
+	}
+	return packDNSMsg(msg), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"sync"
+	"time"
+)
+
+var logClientNames = flag.Bool("log-client-names", false, "show client host names from local PTR data in query logs")
+
+// How long a resolved (or unresolvable) client name is remembered.
+const clientNameTTL = 5 * time.Minute
+
+type clientNameEntry struct {
+	name    string
+	expires time.Time
+}
+
+var clientNames = struct {
+	sync.Mutex
+	m       map[string]clientNameEntry
+	pending map[string]bool
+}{m: make(map[string]clientNameEntry), pending: make(map[string]bool)}
+
+// clientName returns the known host name of ip, or "". Unknown addresses
+// are resolved in the background so the query being logged never waits.
+func clientName(ip net.IP) string {
+	if !*logClientNames || ip == nil {
+		return ""
+	}
+	key := ip.String()
+	clientNames.Lock()
+	defer clientNames.Unlock()
+	e, ok := clientNames.m[key]
+	if ok && time.Now().Before(e.expires) {
+		return e.name
+	}
+	if !clientNames.pending[key] {
+		clientNames.pending[key] = true
+		go resolveClientName(ip)
+	}
+	return e.name
+}
+
+func resolveClientName(ip net.IP) {
+	name, ok := localRecords.lookupAddr(ip)
+	if !ok && *mdnsEnabled && inLAN(ip) {
+		// Most LAN devices announce their own reverse name over mDNS.
+		q := dnsQuestion{Name: reverseName(ip), Qtype: dnsTypePTR, Qclass: dnsClassINET}
+		answer, _, _, err := mdnsQuery(q, false)
+		if err == nil && len(answer) > 0 {
+			name, _, _ = getDomainName(answer[0].Data, 0)
+		}
+	}
+	key := ip.String()
+	clientNames.Lock()
+	clientNames.m[key] = clientNameEntry{name, time.Now().Add(clientNameTTL)}
+	delete(clientNames.pending, key)
+	clientNames.Unlock()
+}
+
+// clientLabel formats addr for query logs, with its host name if known.
+func clientLabel(addr net.Addr) string {
+	if name := clientName(addrIP(addr)); name != "" {
+		return addr.String() + " (" + name + ")"
+	}
+	return addr.String()
+}
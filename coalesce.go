@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"slices"
+	"sync"
+)
+
+// flightKey identifies queries that can share an upstream exchange: the
+// same question in the same view, to the same upstreams, asking for the
+// same DNSSEC treatment.
+type flightKey struct {
+	cacheKey
+	first  *upstream
+	dnssec bool
+	cd     bool
+}
+
+// A flight is an upstream exchange in progress that the queries for the
+// same question wait on. It is cancelled when they have all gone.
+type flight struct {
+	done         chan struct{}
+	cancel       context.CancelFunc
+	waiters      int
+	reply, final []byte
+	msg          dnsMsg
+}
+
+var flights = struct {
+	sync.Mutex
+	m map[flightKey]*flight
+}{m: make(map[flightKey]*flight)}
+
+// forward resolves query through the upstreams g like resolveUpstream,
+// but while an exchange for the same question is in flight it waits for
+// that answer instead of sending another one.
+func forward(ctx context.Context, v *view, g upstreamGroup, query dnsMsg, data []byte) (reply []byte, msg dnsMsg, final []byte) {
+	c, ok := newCacheKey(v, query)
+	if !ok || len(g) == 0 {
+		return resolveUpstream(ctx, v, g, query, data)
+	}
+	key := flightKey{c, g[0], wantsDNSSEC(query), query.checking_disabled}
+	flights.Lock()
+	f, ok := flights.m[key]
+	if !ok {
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		flights.m[key] = f
+		go func() {
+			f.reply, f.msg, f.final = resolveUpstream(fctx, v, g, query, data)
+			flights.Lock()
+			delete(flights.m, key)
+			flights.Unlock()
+			cancel()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	flights.Unlock()
+
+	select {
+	case <-f.done:
+		return f.answer(query)
+	case <-ctx.Done():
+		flights.Lock()
+		if f.waiters--; f.waiters == 0 {
+			f.cancel()
+		}
+		flights.Unlock()
+		return nil, msg, packDNSMsg(newReply(query, dnsRcodeServerFailure))
+	}
+}
+
+// answer returns the result of f for a query that waited on it, with the
+// ID and question of that query.
+func (f *flight) answer(query dnsMsg) ([]byte, dnsMsg, []byte) {
+	if f.final == nil && f.reply != nil && f.msg.id == query.id && sameQuestion(f.msg, query) {
+		return f.reply, f.msg, nil
+	}
+	if f.final != nil {
+		final := bytes.Clone(f.final)
+		if len(final) >= 2 {
+			binary.BigEndian.PutUint16(final, query.id)
+		}
+		return nil, f.msg, final
+	}
+	msg := f.msg
+	msg.id = query.id
+	msg.question = query.question
+	return packDNSMsg(msg), msg, nil
+}
+
+func sameQuestion(a, b dnsMsg) bool {
+	return slices.Equal(a.question, b.question)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var configFile = flag.String("config", "", "read settings from this TOML file; flags on the command line take precedence")
+
+// setupConfig applies the config file to every flag that was not given on
+// the command line, so the usual defaults still hold for anything the
+// file leaves out.
+//
+// The file is a small subset of TOML: key = value pairs, optionally
+// grouped under [section] headers. A key in a section names the flag
+// section-key (falling back to key), with underscores read as dashes, so
+// size under [cache] sets -cache-size. Values are strings, numbers,
+// booleans or arrays of them; an array sets a repeatable flag once per
+// element.
+//
+//	listen = ":53"
+//	upstream = ["1.1.1.1:53", "8.8.8.8:53"]
+//
+//	[cache]
+//	size = 5000
+func setupConfig() {
+	if *configFile == "" {
+		return
+	}
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	n, err := loadConfig(*configFile, given)
+	if err != nil {
+		log.Fatal(err)
+	}
+	infof("Loaded %d settings from %s", n, *configFile)
+}
+
+func loadConfig(path string, given map[string]bool) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	section := ""
+	applied := 0
+	s := bufio.NewScanner(f)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		errf := func(format string, a ...any) error {
+			return fmt.Errorf("%s:%d: %s", path, lineno, fmt.Sprintf(format, a...))
+		}
+		line := strings.TrimSpace(stripConfigComment(s.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			name, ok := strings.CutSuffix(strings.TrimPrefix(line, "["), "]")
+			if !ok || strings.HasPrefix(name, "[") {
+				return 0, errf("bad section header %q", line)
+			}
+			section = strings.TrimSpace(name)
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return 0, errf("expected key = value")
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		// Arrays may span several lines.
+		for strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") && s.Scan() {
+			lineno++
+			value += " " + strings.TrimSpace(stripConfigComment(s.Text()))
+		}
+		values, err := parseConfigValue(value)
+		if err != nil {
+			return 0, errf("%s: %v", key, err)
+		}
+		name := configFlagName(section, key)
+		if name == "" {
+			return 0, errf("unknown setting %q", key)
+		}
+		if given[name] {
+			continue
+		}
+		for _, v := range values {
+			if err := flag.Set(name, v); err != nil {
+				return 0, errf("%s: %v", key, err)
+			}
+		}
+		applied++
+	}
+	return applied, s.Err()
+}
+
+// configFlagName finds the flag a key in section refers to.
+func configFlagName(section, key string) string {
+	key = strings.ReplaceAll(key, "_", "-")
+	names := []string{key}
+	if section != "" {
+		names = []string{strings.ReplaceAll(section, "_", "-") + "-" + key, key}
+	}
+	for _, name := range names {
+		if name != "config" && flag.Lookup(name) != nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// stripConfigComment removes a # comment that is not inside a string.
+func stripConfigComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseConfigValue returns the flag values a TOML value stands for.
+func parseConfigValue(value string) ([]string, error) {
+	if inner, ok := strings.CutPrefix(value, "["); ok {
+		inner, ok = strings.CutSuffix(inner, "]")
+		if !ok {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		var values []string
+		for {
+			inner = strings.TrimSpace(inner)
+			if inner == "" {
+				return values, nil
+			}
+			v, rest, err := configScalar(inner)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			rest = strings.TrimSpace(rest)
+			if rest != "" && rest[0] != ',' {
+				return nil, fmt.Errorf("expected , between array elements")
+			}
+			inner = strings.TrimPrefix(rest, ",")
+		}
+	}
+	v, rest, err := configScalar(value)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("unexpected %q after value", rest)
+	}
+	return []string{v}, nil
+}
+
+// configScalar reads one string, number or boolean from the start of s
+// and returns it with the remaining input.
+func configScalar(s string) (string, string, error) {
+	if s == "" {
+		return "", "", fmt.Errorf("empty value")
+	}
+	switch s[0] {
+	case '"':
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				v, err := strconv.Unquote(s[:i+1])
+				return v, s[i+1:], err
+			}
+		}
+		return "", "", fmt.Errorf("unterminated string")
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+	end := strings.IndexAny(s, ", \t")
+	if end < 0 {
+		end = len(s)
+	}
+	v := s[:end]
+	if v != "true" && v != "false" {
+		if _, err := strconv.ParseFloat(strings.ReplaceAll(v, "_", ""), 64); err != nil {
+			return "", "", fmt.Errorf("bad value %q, strings must be quoted", v)
+		}
+		v = strings.ReplaceAll(v, "_", "")
+	}
+	return v, s[end:], nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"log"
+	"net"
+	"time"
+)
+
+var (
+	dnsCookies        = flag.Bool("dns-cookies", true, "answer DNS cookies (RFC 7873) on the plain DNS listeners, so that clients can tell our replies from spoofed ones")
+	dnsCookiesRequire = flag.Bool("dns-cookies-require", false, "answer UDP queries that carry a client cookie but no valid server cookie with BADCOOKIE instead of a full reply")
+	dnsCookieSecret   = flag.String("dns-cookie-secret", "", "hex secret of at least 16 bytes the server cookies are made with, to share them between servers behind one address; random if unset")
+)
+
+const (
+	ednsOptionCookie = 10
+
+	// Extended rcode 23 (RFC 7873 section 8).
+	dnsRcodeBadCookie = 23
+
+	clientCookieLen = 8
+	// A server cookie of RFC 9018: version, three reserved bytes, a
+	// timestamp and a hash.
+	serverCookieLen = 16
+)
+
+// The age at which a server cookie is replaced, the age at which it is no
+// longer accepted, and how far a clock between servers sharing the
+// secret may run ahead (RFC 9018 section 4.3).
+const (
+	cookieRenew   = 30 * time.Minute
+	cookieExpiry  = time.Hour
+	cookieAheadBy = 5 * time.Minute
+)
+
+var cookieSecret []byte
+
+func init() {
+	useMiddleware("cookies", "policy", cookieStage)
+}
+
+// cookieKey marks the context of a query to a plain DNS listener, with
+// whether it came over UDP.
+type cookieKey struct{}
+
+func withCookies(ctx context.Context, udp bool) context.Context {
+	return context.WithValue(ctx, cookieKey{}, udp)
+}
+
+func setupCookies() {
+	if !*dnsCookies {
+		return
+	}
+	if *dnsCookieSecret != "" {
+		secret, err := hex.DecodeString(*dnsCookieSecret)
+		if err != nil || len(secret) < 16 {
+			log.Fatalf("bad -dns-cookie-secret, want at least 32 hex digits")
+		}
+		cookieSecret = secret
+		return
+	}
+	cookieSecret = make([]byte, 16)
+	if _, err := rand.Read(cookieSecret); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// ednsOption returns the value of the first option with code in the rdata
+// of an OPT record.
+func ednsOption(data []byte, code uint16) ([]byte, bool) {
+	for len(data) >= 4 {
+		n := 4 + int(binary.BigEndian.Uint16(data[2:]))
+		if n > len(data) {
+			break
+		}
+		if binary.BigEndian.Uint16(data) == code {
+			return data[4:n], true
+		}
+		data = data[n:]
+	}
+	return nil, false
+}
+
+// setEDNSOption returns the rdata of an OPT record with the options with
+// code replaced by one carrying value, or left out if value is nil.
+func setEDNSOption(data []byte, code uint16, value []byte) []byte {
+	var out []byte
+	for len(data) >= 4 {
+		n := 4 + int(binary.BigEndian.Uint16(data[2:]))
+		if n > len(data) {
+			break
+		}
+		if binary.BigEndian.Uint16(data) != code {
+			out = append(out, data[:n]...)
+		}
+		data = data[n:]
+	}
+	if value != nil {
+		out = binary.BigEndian.AppendUint16(out, code)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(value)))
+		out = append(out, value...)
+	}
+	return out
+}
+
+// hasCookie reports whether opt carries a DNS cookie we answer, which is
+// then not forwarded.
+func hasCookie(opt dnsRR) bool {
+	if cookieSecret == nil {
+		return false
+	}
+	_, ok := ednsOption(opt.Data, ednsOptionCookie)
+	return ok
+}
+
+// queryCookie returns the client and server cookie of query. ok is false
+// if query has no cookie, and malformed true if its cookie has a length
+// RFC 7873 section 4 does not allow.
+func queryCookie(query dnsMsg) (cc, sc []byte, ok, malformed bool) {
+	opt := ednsOPT(query)
+	if opt == nil {
+		return nil, nil, false, false
+	}
+	cookie, ok := ednsOption(opt.Data, ednsOptionCookie)
+	if !ok {
+		return nil, nil, false, false
+	}
+	if len(cookie) != clientCookieLen && (len(cookie) < clientCookieLen+8 || len(cookie) > clientCookieLen+32) {
+		return nil, nil, true, true
+	}
+	return cookie[:clientCookieLen], cookie[clientCookieLen:], true, false
+}
+
+// serverCookie returns the server cookie for the client cookie cc of
+// client made at the time t: the hash binds it to both, so that only the
+// client that got it can send it back. RFC 9018 uses SipHash-2-4 for the
+// hash, which only needs to agree between our own servers; the truncated
+// HMAC-SHA256 does as well.
+func serverCookie(cc []byte, client net.IP, t uint32) []byte {
+	sc := []byte{1, 0, 0, 0}
+	sc = binary.BigEndian.AppendUint32(sc, t)
+	h := hmac.New(sha256.New, cookieSecret)
+	h.Write(cc)
+	h.Write(sc)
+	if ip4 := client.To4(); ip4 != nil {
+		h.Write(ip4)
+	} else {
+		h.Write(client.To16())
+	}
+	return h.Sum(sc)[:serverCookieLen]
+}
+
+// validCookie reports whether sc is a server cookie we gave client for
+// cc that has not expired, and whether it is due to be replaced.
+func validCookie(cc, sc []byte, client net.IP) (valid, renew bool) {
+	if len(sc) != serverCookieLen || sc[0] != 1 {
+		return false, false
+	}
+	t := binary.BigEndian.Uint32(sc[4:])
+	if !hmac.Equal(sc, serverCookie(cc, client, t)) {
+		return false, false
+	}
+	// Serial number arithmetic copes with the wrap of the timestamp.
+	age := time.Duration(int32(uint32(time.Now().Unix())-t)) * time.Second
+	if age > cookieExpiry || age < -cookieAheadBy {
+		return false, false
+	}
+	return true, age > cookieRenew
+}
+
+// cookieRejected checks the DNS cookie of a query to a plain DNS listener.
+// It returns a FORMERR reply to a malformed cookie and, with
+// -dns-cookies-require, a BADCOOKIE reply carrying a fresh server cookie
+// to a UDP query without a valid one, which the client retries with.
+func cookieRejected(query dnsMsg, client net.IP, udp bool) ([]byte, bool) {
+	if cookieSecret == nil {
+		return nil, false
+	}
+	cc, sc, ok, malformed := queryCookie(query)
+	switch {
+	case !ok:
+		return nil, false
+	case malformed:
+		debugf("Malformed DNS cookie from %s", client)
+		return packDNSMsg(newReply(query, dnsRcodeFormatError)), true
+	}
+	if !udp || !*dnsCookiesRequire {
+		return nil, false
+	}
+	if valid, _ := validCookie(cc, sc, client); valid {
+		return nil, false
+	}
+	debugf("No valid server cookie from %s", client)
+	reply := newReply(query, dnsRcodeBadCookie&0xF)
+	reply.extra[0].Ttl = dnsRcodeBadCookie >> 4 << 24
+	reply.extra[0].Data = setEDNSOption(nil, ednsOptionCookie, freshCookie(cc, client))
+	reply.extra[0].Rdlength = uint16(len(reply.extra[0].Data))
+	return packDNSMsg(reply), true
+}
+
+func freshCookie(cc []byte, client net.IP) []byte {
+	return append(append([]byte{}, cc...), serverCookie(cc, client, uint32(time.Now().Unix()))...)
+}
+
+// addCookie puts a server cookie into the reply to a query with a client
+// cookie. A valid server cookie of the query is sent back as it is until
+// it is due to be replaced.
+func addCookie(query dnsMsg, reply []byte, client net.IP) []byte {
+	if cookieSecret == nil {
+		return reply
+	}
+	cc, sc, ok, malformed := queryCookie(query)
+	if !ok || malformed {
+		return reply
+	}
+	msg, err := parseDNSMsg(reply)
+	if err != nil || ednsOPT(msg) == nil {
+		return reply
+	}
+	cookie := freshCookie(cc, client)
+	if valid, renew := validCookie(cc, sc, client); valid && !renew {
+		cookie = append(append([]byte{}, cc...), sc...)
+	}
+	msg.extra = append([]dnsRR{}, msg.extra...)
+	opt := ednsOPT(msg)
+	opt.Data = setEDNSOption(opt.Data, ednsOptionCookie, cookie)
+	opt.Rdlength = uint16(len(opt.Data))
+	return packDNSMsg(msg)
+}
+
+// cookieStage checks and answers the DNS cookies of queries to the plain
+// DNS listeners. It runs after the filter stage, so that clients the ACL,
+// the rate limits or the quotas turn away get nothing out of it.
+func cookieStage(r *request, next handler) []byte {
+	udp, ok := r.ctx.Value(cookieKey{}).(bool)
+	if !ok || isRewritten(r.ctx) {
+		return next(r)
+	}
+	if reply, rejected := cookieRejected(r.query, r.client, udp); rejected {
+		return reply
+	}
+	reply := next(r)
+	if reply == nil {
+		return nil
+	}
+	return addCookie(r.query, reply, r.client)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"log"
+	"net"
+	"strings"
+)
+
+var (
+	ddrTarget  = flag.String("ddr-name", "", "name of this resolver advertised through DDR, required to enable DDR")
+	ddrDoTPort = flag.Int("ddr-dot-port", 853, "DNS-over-TLS port advertised through DDR, 0 to omit")
+	ddrDoHPort = flag.Int("ddr-doh-port", 443, "DNS-over-HTTPS port advertised through DDR, 0 to omit")
+	ddrDoHPath = flag.String("ddr-doh-path", "/dns-query{?dns}", "DNS-over-HTTPS URI template advertised through DDR")
+	ddrHints   = flag.String("ddr-hints", "", "comma-separated addresses advertised as ipv4hint/ipv6hint")
+)
+
+// RFC 9462 special-use name for Discovery of Designated Resolvers.
+const ddrName = "_dns.resolver.arpa"
+
+// SvcParamKeys from RFC 9460 and RFC 9461.
+const (
+	svcParamALPN     = 1
+	svcParamPort     = 3
+	svcParamIPv4Hint = 4
+	svcParamIPv6Hint = 6
+	svcParamDoHPath  = 7
+)
+
+var ddrRecords []dnsRR
+
+func setupDDR() {
+	if *ddrTarget == "" {
+		return
+	}
+	var v4, v6 []byte
+	if *ddrHints != "" {
+		for _, s := range strings.Split(*ddrHints, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				log.Fatalf("bad -ddr-hints address %q", s)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				v4 = append(v4, ip4...)
+			} else {
+				v6 = append(v6, ip...)
+			}
+		}
+	}
+	// Params must be sorted by key.
+	svcb := func(priority uint16, alpn string, port int, dohpath string) dnsRR {
+		b := binary.BigEndian.AppendUint16(nil, priority)
+		b = packDomainName(b, *ddrTarget)
+		b = appendSvcParam(b, svcParamALPN, append([]byte{byte(len(alpn))}, alpn...))
+		b = appendSvcParam(b, svcParamPort, binary.BigEndian.AppendUint16(nil, uint16(port)))
+		if v4 != nil {
+			b = appendSvcParam(b, svcParamIPv4Hint, v4)
+		}
+		if v6 != nil {
+			b = appendSvcParam(b, svcParamIPv6Hint, v6)
+		}
+		if dohpath != "" {
+			b = appendSvcParam(b, svcParamDoHPath, []byte(dohpath))
+		}
+		return dnsRR{Name: ddrName, Rrtype: dnsTypeSVCB, Class: dnsClassINET, Ttl: localTTL, Rdlength: uint16(len(b)), Data: b}
+	}
+	if *ddrDoTPort > 0 {
+		ddrRecords = append(ddrRecords, svcb(1, "dot", *ddrDoTPort, ""))
+	}
+	if *ddrDoHPort > 0 {
+		ddrRecords = append(ddrRecords, svcb(2, "h2", *ddrDoHPort, *ddrDoHPath))
+	}
+	infof("DDR: advertising %d designated resolvers as %s", len(ddrRecords), *ddrTarget)
+}
+
+func appendSvcParam(b []byte, key uint16, value []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, key)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// ddrAnswer answers queries for _dns.resolver.arpa, which only has a
+// meaning for the resolver the client talks to and so is never forwarded.
+func ddrAnswer(query dnsMsg) []byte {
+	if len(query.question) != 1 || canonicalName(query.question[0].Name) != ddrName {
+		return nil
+	}
+	reply := newReply(query, dnsRcodeSuccess)
+	reply.authoritative = true
+	if query.question[0].Qtype == dnsTypeSVCB {
+		reply.answer = ddrRecords
+	}
+	return packDNSMsg(reply)
+}
@@ -2,14 +2,118 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
 	"log"
 	"net"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const DNSSERVER = "8.8.8.8:53"
 
+var (
+	listenAddr   = flag.String("listen", ":53", "address to listen on")
+	listenFamily = flag.String("listen-family", "dual", "IP versions to serve on wildcard addresses: dual, ipv4 or ipv6")
+	queryTimeout = flag.Duration("timeout", 5*time.Second, "timeout for each upstream exchange")
+)
+
+// stringList is a flag that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+const (
+	dnsTypeA      = 1
+	dnsTypeNS     = 2
+	dnsTypeCNAME  = 5
+	dnsTypeSOA    = 6
+	dnsTypePTR    = 12
+	dnsTypeHINFO  = 13
+	dnsTypeMX     = 15
+	dnsTypeTXT    = 16
+	dnsTypeAAAA   = 28
+	dnsTypeSRV    = 33
+	dnsTypeOPT    = 41
+	dnsTypeDS     = 43
+	dnsTypeRRSIG  = 46
+	dnsTypeNSEC   = 47
+	dnsTypeDNSKEY = 48
+	dnsTypeNSEC3  = 50
+	dnsTypeSVCB   = 64
+	dnsTypeHTTPS  = 65
+	dnsTypeANY    = 255
+
+	dnsClassINET = 1
+
+	dnsRcodeSuccess        = 0
+	dnsRcodeFormatError    = 1
+	dnsRcodeServerFailure  = 2
+	dnsRcodeNameError      = 3
+	dnsRcodeNotImplemented = 4
+	dnsRcodeRefused        = 5
+)
+
+// typeNames maps the names of the record types above to their numbers,
+// for the flags, the zone files and the tools.
+var typeNames = map[string]uint16{
+	"A":      dnsTypeA,
+	"NS":     dnsTypeNS,
+	"CNAME":  dnsTypeCNAME,
+	"SOA":    dnsTypeSOA,
+	"PTR":    dnsTypePTR,
+	"HINFO":  dnsTypeHINFO,
+	"MX":     dnsTypeMX,
+	"TXT":    dnsTypeTXT,
+	"AAAA":   dnsTypeAAAA,
+	"SRV":    dnsTypeSRV,
+	"OPT":    dnsTypeOPT,
+	"DS":     dnsTypeDS,
+	"RRSIG":  dnsTypeRRSIG,
+	"NSEC":   dnsTypeNSEC,
+	"DNSKEY": dnsTypeDNSKEY,
+	"NSEC3":  dnsTypeNSEC3,
+	"SVCB":   dnsTypeSVCB,
+	"HTTPS":  dnsTypeHTTPS,
+	"ANY":    dnsTypeANY,
+}
+
+// parseType parses a record type name in any case, or a number in the
+// generic TYPE65 form (RFC 3597).
+func parseType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	if t, ok := typeNames[s]; ok {
+		return t, true
+	}
+	if !strings.HasPrefix(s, "TYPE") {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s[len("TYPE"):], 10, 16)
+	return uint16(n), err == nil
+}
+
+func typeName(t uint16) string {
+	for name, v := range typeNames {
+		if v == t {
+			return name
+		}
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
 type dnsMsgHdr struct {
 	id                  uint16
 	response            bool
@@ -18,6 +122,8 @@ type dnsMsgHdr struct {
 	truncated           bool
 	recursion_desired   bool
 	recursion_available bool
+	authenticated_data  bool
+	checking_disabled   bool
 	rcode               uint
 	question_num        uint16
 	answer_num          uint16
@@ -55,68 +161,105 @@ func Itob(x uint16) bool {
 	return true
 }
 
-func getDomainName(data []byte, cursor int) (name string, offset int) {
-	n := 0
+var (
+	errMsgTruncated  = errors.New("dns: message truncated")
+	errBadPointer    = errors.New("dns: compression pointer does not point back")
+	errNameTooLong   = errors.New("dns: domain name too long")
+	errBadLabelType  = errors.New("dns: bad label type")
+	errRdataOverflow = errors.New("dns: rdata overruns record")
+)
+
+// Maximum length of a domain name in wire format (RFC 1035 section 2.3.4).
+const maxNameLen = 255
+
+// escapeLabel quotes dots and backslashes inside a label so that the
+// joined name can be split again by packDomainName.
+func escapeLabel(label []byte) string {
+	if !bytes.ContainsAny(label, `.\`) {
+		return string(label)
+	}
+	var b strings.Builder
+	for _, c := range label {
+		if c == '.' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// getDomainName reads the possibly compressed name at cursor and returns
+// it with the offset just past it. Following RFC 1035 section 4.1.4 a
+// pointer must refer to a prior occurrence of a name: each one has to
+// point before the labels read so far, which also rules out loops.
+// Pointers may lead to further pointers, and a name may continue into
+// the middle of an earlier one.
+func getDomainName(data []byte, cursor int) (name string, offset int, err error) {
 	ptr := 0
-	length := len(data[cursor:])
-	labels := make([]string, 63)
+	wirelen := 0
+	start := cursor
+	var labels []string
 
 Loop:
-	for ; ; n++ {
+	for {
 		if cursor >= len(data) {
-			return "", len(data)
+			return "", len(data), errMsgTruncated
 		}
 		labelsize := data[cursor]
 		cursor++
-		if labelsize == 0 {
-			break Loop
-		}
 
 		switch labelsize & 0xC0 {
 		case 0x00:
 			if labelsize == 0x00 {
 				break Loop
 			}
-			label := make([]byte, labelsize)
-			size, err := bytes.NewBuffer(data[cursor:]).Read(label)
-			// cursor++
-			if err != nil {
-				log.Fatal(err)
+			if cursor+int(labelsize) > len(data) {
+				return "", len(data), errMsgTruncated
 			}
-			if size != int(labelsize) {
-				log.Printf("Error in read %d, bytes of %x", size, label)
+			wirelen += int(labelsize) + 1
+			// The terminating root label counts too.
+			if wirelen+1 > maxNameLen {
+				return "", len(data), errNameTooLong
 			}
-			labels[n] = string(label)
-			cursor += size
+			labels = append(labels, escapeLabel(data[cursor:cursor+int(labelsize)]))
+			cursor += int(labelsize)
 		case 0xC0:
-			//ignore the empty data in the  labels
-			n--
+			if cursor >= len(data) {
+				return "", len(data), errMsgTruncated
+			}
 			if ptr == 0 {
 				offset = cursor
 			}
-			if ptr > 10 {
-				return "Too many compression pointers", offset
-			}
 			ptr++
 
-			c1 := int(data[cursor])
-			cursor = (int(labelsize)^0xC0)<<8 | int(c1)
+			target := int(labelsize&^0xC0)<<8 | int(data[cursor])
+			if target >= start {
+				return "", len(data), errBadPointer
+			}
+			cursor, start = target, target
 		default:
-			return "", length
+			return "", len(data), errBadLabelType
 		}
 	}
 
-	name = strings.Join(labels[0:n], ".")
-	log.Printf("name=%s", name)
+	name = strings.Join(labels, ".")
+	debugf("name=%s", name)
 	if ptr != 0 {
-		return name, offset + 1
+		return name, offset + 1, nil
 	}
-	return name, cursor
+	return name, cursor, nil
 }
 
-func parseRR(data []byte, cursor int) (dnsRR, int) {
+func parseRR(data []byte, cursor int) (dnsRR, int, error) {
 	var rr dnsRR
-	rr.Name, cursor = getDomainName(data, cursor)
+	var err error
+	rr.Name, cursor, err = getDomainName(data, cursor)
+	if err != nil {
+		return rr, cursor, err
+	}
+	if cursor+10 > len(data) {
+		return rr, len(data), errMsgTruncated
+	}
 	rr.Rrtype = binary.BigEndian.Uint16(data[cursor:])
 	cursor += 2
 	rr.Class = binary.BigEndian.Uint16(data[cursor:])
@@ -125,27 +268,76 @@ func parseRR(data []byte, cursor int) (dnsRR, int) {
 	cursor += 4
 	rr.Rdlength = binary.BigEndian.Uint16(data[cursor:])
 	cursor += 2
-	Data := make([]byte, rr.Rdlength)
-	err := binary.Read(bytes.NewBuffer(data[cursor:]), binary.BigEndian, &Data)
+	if cursor+int(rr.Rdlength) > len(data) {
+		return rr, len(data), errMsgTruncated
+	}
+	Data := data[cursor : cursor+int(rr.Rdlength)]
+	rr.Data, err = expandRdata(data, cursor, rr.Rrtype, Data)
 	if err != nil {
-		log.Fatal(err)
+		return rr, cursor, err
+	}
+	rr.Rdlength = uint16(len(rr.Data))
+	cursor += len(Data)
+	return rr, cursor, nil
+}
+
+// expandRdata replaces compressed domain names inside the rdata of
+// well-known types with their uncompressed form, so the record stays
+// valid outside of the message it was read from.
+func expandRdata(data []byte, cursor int, rrtype uint16, rdata []byte) ([]byte, error) {
+	var fixed int
+	var names int
+	switch rrtype {
+	case dnsTypeNS, dnsTypeCNAME, dnsTypePTR:
+		names = 1
+	case dnsTypeMX:
+		fixed = 2
+		names = 1
+	case dnsTypeSRV:
+		fixed = 6
+		names = 1
+	case dnsTypeSOA:
+		names = 2
+	default:
+		return append([]byte{}, rdata...), nil
+	}
+	end := cursor + len(rdata)
+	if fixed > len(rdata) {
+		return nil, errRdataOverflow
+	}
+	out := append([]byte{}, rdata[:fixed]...)
+	cursor += fixed
+	for i := 0; i < names; i++ {
+		var name string
+		var err error
+		name, cursor, err = getDomainName(data, cursor)
+		if err != nil {
+			return nil, err
+		}
+		if cursor > end {
+			return nil, errRdataOverflow
+		}
+		out = packDomainName(out, name)
 	}
-	rr.Data = Data
-	cursor += int(rr.Rdlength)
-	return rr, cursor
+	return append(out, data[cursor:end]...), nil
 }
 
-func parseDNSMsg(data []byte) dnsMsg {
+func parseDNSMsg(data []byte) (dnsMsg, error) {
 	var msg dnsMsg
+	if len(data) < 12 {
+		return msg, errMsgTruncated
+	}
 	msg.id = binary.BigEndian.Uint16(data)
 	// var dnsmisc uint16
 	dnsmisc := binary.BigEndian.Uint16(data[2:])
-	msg.response = true
+	msg.response = Itob(dnsmisc >> 15)
 	msg.opcode = uint((dnsmisc >> 11) & 0x000F)
 	msg.authoritative = Itob((dnsmisc & 0x0400) >> 10)
 	msg.truncated = Itob((dnsmisc & 0x0200) >> 9)
 	msg.recursion_desired = Itob((dnsmisc & 0x0100) >> 8)
-	msg.recursion_available = Itob((dnsmisc & 0x00F0) >> 7)
+	msg.recursion_available = Itob((dnsmisc & 0x0080) >> 7)
+	msg.authenticated_data = Itob((dnsmisc & 0x0020) >> 5)
+	msg.checking_disabled = Itob((dnsmisc & 0x0010) >> 4)
 	msg.rcode = uint(dnsmisc & 0x000F)
 
 	msg.question_num = binary.BigEndian.Uint16(data[4:])
@@ -153,109 +345,533 @@ func parseDNSMsg(data []byte) dnsMsg {
 	msg.authority_num = binary.BigEndian.Uint16(data[8:])
 	msg.additional_num = binary.BigEndian.Uint16(data[10:])
 
-	question := make([]dnsQuestion, msg.question_num)
+	// The counts come from the wire, so slices grow with what is really
+	// there instead of being sized from them up front.
 	cursor := 12
+	var err error
 	for i := 0; i < int(msg.question_num); i++ {
-		// var nameLength int
-		question[i].Name, cursor = getDomainName(data, cursor)
-		// cursor += offset
-		question[i].Qtype = binary.BigEndian.Uint16(data[cursor:])
+		var q dnsQuestion
+		q.Name, cursor, err = getDomainName(data, cursor)
+		if err != nil {
+			return msg, err
+		}
+		if cursor+4 > len(data) {
+			return msg, errMsgTruncated
+		}
+		q.Qtype = binary.BigEndian.Uint16(data[cursor:])
 		cursor += 2
-		question[i].Qclass = binary.BigEndian.Uint16(data[cursor:])
+		q.Qclass = binary.BigEndian.Uint16(data[cursor:])
 		cursor += 2
+		msg.question = append(msg.question, q)
 	}
-	msg.question = question
 
-	if msg.answer_num > 0 {
-		log.Printf("answer number: %d cursor: %d", msg.answer_num, cursor)
-		answer := make([]dnsRR, msg.answer_num)
-		for i := 0; i < int(msg.answer_num); i++ {
-			answer[i], cursor = parseRR(data, cursor)
-		}
-		msg.answer = answer
+	sections := []struct {
+		name  string
+		count uint16
+		rrs   *[]dnsRR
+	}{
+		{"answer", msg.answer_num, &msg.answer},
+		{"authority", msg.authority_num, &msg.ns},
+		{"additional", msg.additional_num, &msg.extra},
 	}
-
-	if msg.authority_num > 0 {
-		log.Printf("authority number: %d cursor: %d", msg.authority_num, cursor)
-		ns := make([]dnsRR, msg.authority_num)
-		for i := 0; i < int(msg.authority_num); i++ {
-			ns[i], cursor = parseRR(data, cursor)
+	for _, sec := range sections {
+		if sec.count == 0 {
+			continue
 		}
-		msg.ns = ns
-	}
-
-	if msg.additional_num > 0 {
-		log.Printf("additional  number: %d cursor: %d", msg.additional_num, cursor)
-		extra := make([]dnsRR, msg.additional_num)
-		for i := 0; i < int(msg.authority_num); i++ {
-			extra[i], cursor = parseRR(data, cursor)
+		debugf("%s number: %d cursor: %d", sec.name, sec.count, cursor)
+		for i := 0; i < int(sec.count); i++ {
+			var rr dnsRR
+			rr, cursor, err = parseRR(data, cursor)
+			if err != nil {
+				return msg, err
+			}
+			*sec.rrs = append(*sec.rrs, rr)
 		}
-		msg.extra = extra
 	}
-	return msg
+	return msg, nil
+}
+
+// dnsExchange sends data to the upstream server over TCP and returns the
+// unframed reply.
+func dnsExchange(upstream string, data []byte) ([]byte, error) {
+	return dnsExchangeContext(context.Background(), nil, upstream, data)
 }
 
-func dnsRequest(data []byte) []byte {
-	conn, err := net.Dial("tcp", DNSSERVER)
+// dnsExchangeContext is dnsExchange that gives up when ctx is done, and
+// connects through proxy if it is not nil.
+func dnsExchangeContext(ctx context.Context, proxy *url.URL, upstream string, data []byte) ([]byte, error) {
+	if err := acquireUpstream(ctx); err != nil {
+		return nil, err
+	}
+	defer releaseUpstream()
+	conn, err := dialUpstream(ctx, proxy, upstream)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(*queryTimeout)
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
 
-	query := parseDNSMsg(data)
-	log.Printf("query: %v", query)
 	req := make([]byte, 2)
 	binary.BigEndian.PutUint16(req, uint16(len(data)))
 	req = append(req, data...)
 	_, err = conn.Write(req)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	reply := make([]byte, 1024)
-	_, err = conn.Read(reply)
+	var length uint16
+	err = binary.Read(conn, binary.BigEndian, &length)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	reply := make([]byte, length)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return nil, err
+	}
+	if chaosEnabled() {
+		return chaosReply(reply)
 	}
+	return reply, nil
+}
 
-	var length uint16
-	s := bytes.NewBuffer(reply[:2])
-	err = binary.Read(s, binary.BigEndian, &length)
+// udpExchange sends data to a plain DNS server over UDP. A truncated
+// reply is retried over TCP with the same server so that large answers
+// reach the client whole. Replies that do not match the query are
+// ignored. Each query goes out from a random source port and, with
+// -qname-0x20, with its name in random capitalization, so that a spoofed
+// reply has to guess both on top of the ID.
+func udpExchange(server string, data []byte) ([]byte, error) {
+	conn, err := dialRandomPort(server)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(*queryTimeout))
+	out, sent := data, ""
+	if *qname0x20 {
+		out, sent = randomizeCase(data)
+	}
+	if _, err = conn.Write(out); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 65535)
+	var n int
+	for {
+		if n, err = conn.Read(reply); err != nil {
+			return nil, err
+		}
+		// Keep waiting past spoofed or stray datagrams.
+		if matchesQuery(out, reply[:n]) && repliesInCase(reply[:n], sent) {
+			break
+		}
+		warnf("Dropping reply from %s that does not match the query", server)
+	}
+	if n > 2 && reply[2]&0x02 != 0 {
+		debugf("Truncated reply from %s, retrying over TCP", server)
+		return dnsExchange(server, data)
+	}
+	if sent != "" {
+		return withClientCase(data, reply[:n]), nil
+	}
+	return reply[:n], nil
+}
 
-	msg := parseDNSMsg(reply[2 : length+2])
-	log.Printf("reply: %v", msg)
-	return reply[2 : length+2]
+// dnsRequest answers the query in data. It returns nil when the query is
+// too broken to answer. Upstream exchanges are given up when ctx is done,
+// once no other client waits for the same answer.
+func dnsRequest(ctx context.Context, data []byte, client net.IP, v *view) []byte {
+	ctx, sp := startSpan(ctx, "dns.query", spanServer)
+	defer sp.finish()
+	sp.set("client.address", client.String())
+	_, psp := startSpan(ctx, "parse", spanInternal)
+	query, err := parseDNSMsg(data)
+	psp.fail(err)
+	psp.finish()
+	if err != nil {
+		debugf("Bad query from %s: %v", client, err)
+		if !clientAllowed(client) {
+			return nil
+		}
+		return formatError(data)
+	}
+	debugf("query: %v", query)
+	r := &request{ctx: ctx, data: data, query: query, client: client, view: v}
+	if g := groupFor(client); g != nil {
+		r.group, r.view = g, g.viewOf(v)
+	}
+	if len(query.question) == 1 {
+		sp.set("dns.question.name", query.question[0].Name)
+		sp.set("dns.question.type", int(query.question[0].Qtype))
+	}
+	reply := runChain(r, 0)
+	sp.setReply(reply)
+	return reply
 }
 
-func dnsListen(conn net.UDPConn) {
-	buf := make([]byte, 1024)
-	n, addr, err := conn.ReadFrom(buf)
-	log.Print("Addr", addr)
+// filterStage refuses the queries the ACL, the rate limits, the quotas
+// and the query type policy do not let through, and malformed ones.
+func filterStage(r *request, next handler) []byte {
+	if reply, rejected := aclRejected(r.query, r.client); rejected {
+		return reply
+	}
+	// A query made in place of a rewritten one was already counted.
+	if !isRewritten(r.ctx) {
+		if reply, limited := rateLimited(r.query, r.client); limited {
+			return reply
+		}
+		if reply, over := overQuota(r.query, r.client); over {
+			return reply
+		}
+	}
+	if reply, bad := badQuery(r.query, r.client); bad {
+		return reply
+	}
+	if reply, refused := typeRefused(r.query); refused {
+		return reply
+	}
+	return next(r)
+}
 
-	if err != nil {
-		log.Fatal(err)
+func rewriteStage(r *request, next handler) []byte {
+	if reply, rewritten := rewriteAnswer(r.ctx, r.query, r.data, r.client, r.view); rewritten {
+		return reply
+	}
+	if reply, rewritten := safeSearchAnswer(r); rewritten {
+		return reply
+	}
+	return next(r)
+}
+
+// localStage answers from local data: the DDR records, the sinkhole and
+// blocklists, mDNS, the local records, hosts files and zones, and the
+// locally served and special-use domains.
+func localStage(r *request, next handler) []byte {
+	query, client, v := r.query, r.client, r.view
+	if reply := ddrAnswer(query); reply != nil {
+		return reply
+	}
+	if reply := sinkholeAnswer(query); reply != nil {
+		return reply
+	}
+	if reply := blockAnswer(query, r.group); reply != nil {
+		return reply
+	}
+	if isMDNSQuery(query) {
+		return mdnsRequest(query)
+	}
+	if reply := reverseForward(query, r.data); reply != nil {
+		return reply
+	}
+	if reply := staticAnswer(query, client); reply != nil {
+		return reply
+	}
+	if reply := localAnswer(query, client); reply != nil {
+		return reply
+	}
+	if reply := dnssdAnswer(query, v.zones); reply != nil {
+		return reply
 	}
-	log.Printf("Data come in from: %s", addr)
+	if reply := zoneAnswer(query, v.zones); reply != nil {
+		return reply
+	}
+	if reply := localZoneAnswer(query); reply != nil {
+		return reply
+	}
+	if reply := specialAnswer(query, v.special); reply != nil {
+		return reply
+	}
+	if reply := anyAnswer(query, v); reply != nil {
+		return reply
+	}
+	return next(r)
+}
 
-	reply := dnsRequest(buf[0:n])
-	_, err = conn.WriteTo(reply, addr)
+// forwardStage answers from the cache or else the upstreams, and ends
+// the chain. The upstreams chosen by a policy come first, then those of
+// the view; the global -route rules only apply to views using the
+// global upstreams.
+func forwardStage(r *request, next handler) []byte {
+	ctx, query, data, v := r.ctx, r.query, r.data, r.view
+	g := v.upstreams
+	if r.upstreams != nil {
+		g = r.upstreams
+	} else if !v.ownUpstreams && len(query.question) == 1 {
+		if rg := routeFor(query.question[0].Name); rg != nil {
+			g = rg
+		}
+	}
+	var reply []byte
+	_, csp := startSpan(ctx, "cache.lookup", spanInternal)
+	msg, cached := cache.get(v, query)
+	csp.set("cache.hit", cached)
+	csp.finish()
+	stale := false
+	if cached {
+		stats.cacheHits.Add(1)
+		debugf("cache hit: %v", msg)
+		if cache.prefetchDue(v, query) {
+			debugf("Prefetching %v", query.question)
+			go forward(context.Background(), v, g, query, data)
+		}
+	} else {
+		stats.cacheMisses.Add(1)
+		var final []byte
+		reply, msg, final, stale = forwardOrStale(ctx, v, g, query, data)
+		if final != nil {
+			return final
+		}
+	}
+	fitted, changed := fitEDNS(query, msg)
+	fitted, stripped := fitDNSSEC(query, fitted)
+	fitted, filtered := filterTypes(v, fitted)
+	if changed || stripped || filtered || cached || stale {
+		msg = fitted
+		reply = packDNSMsg(msg)
+	}
+	if blocked := cnameBlockAnswer(query, msg, r.group); blocked != nil {
+		return blocked
+	}
+	if *dns64Enabled && needsDNS64(v, query, msg) {
+		if prefix := nat64PrefixFor(g); prefix != nil {
+			reply = dns64Synthesize(ctx, v, g, prefix, query, reply, msg)
+		}
+	}
+	return reply
+}
+
+// resolveUpstream resolves query through the upstreams g and caches the
+// answer. A non-nil final reply is to be sent as it is, being an error
+// answer or a reply too broken to process further.
+func resolveUpstream(ctx context.Context, v *view, g upstreamGroup, query dnsMsg, data []byte) (reply []byte, msg dnsMsg, final []byte) {
+	out, sent := upstreamQuery(query, data), ""
+	if *qname0x20 {
+		out, sent = randomizeCase(out)
+	}
+	_, usp := startSpan(ctx, "upstream.exchange", spanClient)
+	usp.set("upstreams", g.String())
+	reply, err := exchangeOrFallback(ctx, g, out)
+	usp.fail(err)
+	usp.finish()
+	if ctx.Err() != nil {
+		debugf("Query for %v abandoned by its clients", query.question)
+		return nil, msg, packDNSMsg(newReply(query, dnsRcodeServerFailure))
+	}
 	if err != nil {
-		log.Fatal(err)
+		// Fail fast so the stub resolver can try its next server.
+		stats.upstreamFailures.Add(1)
+		errorf("All upstreams failed: %v", err)
+		return nil, msg, packDNSMsg(newReply(query, dnsRcodeServerFailure))
+	}
+	msg, err = parseDNSMsg(reply)
+	if err != nil {
+		warnf("Bad reply from upstream: %v", err)
+		return nil, msg, reply
+	}
+	if sent != "" {
+		if !echoesCase(msg, sent) {
+			warnf("Reply for %s does not echo its capitalization, dropping it", sent)
+			return nil, msg, packDNSMsg(newReply(query, dnsRcodeServerFailure))
+		}
+		msg = restoreCase(query, msg)
+		reply = packDNSMsg(msg)
+	}
+	debugf("reply: %v", msg)
+	if *dnssecValidate && !query.checking_disabled {
+		if msg, err = validateReply(ctx, g, query, msg); err != nil {
+			warnf("DNSSEC: bogus answer for %v: %v", query.question, err)
+			if !*dnssecPermissive {
+				return nil, msg, packDNSMsg(newReply(query, dnsRcodeServerFailure))
+			}
+		}
+		reply = packDNSMsg(msg)
+	}
+	if clamped, ok := clampTTLs(msg); ok {
+		msg = clamped
+		reply = packDNSMsg(msg)
+	}
+	if !*dnssecValidate || !query.checking_disabled {
+		cache.put(v, query, msg)
+	}
+	return reply, msg, nil
+}
+
+// addrIP returns the IP of a UDP or TCP client address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// dnsListen reads queries from conn and answers each one in its own
+// goroutine, so a slow upstream exchange does not hold up other clients.
+// Listeners not bound to a view pass a nil v.
+func dnsListen(conn *net.UDPConn, v *view) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if stopping.Load() {
+				return
+			}
+			log.Fatal(err)
+		}
+		debugf("Data come in from: %s", clientLabel(addr))
+		if overloaded(addr) {
+			continue
+		}
+		if !beginQuery() {
+			return
+		}
+		go dnsServe(conn, append([]byte{}, buf[:n]...), addr, v)
+	}
+}
+
+func dnsServe(conn *net.UDPConn, data []byte, addr net.Addr, v *view) {
+	client := addrIP(addr)
+	if v == nil {
+		v = viewFor(client)
+	}
+	start := time.Now()
+	tap(dnstapClientQuery, dnstapUDP, addr, start, data, nil)
+	capturePacket(addr, conn.LocalAddr(), data, true)
+	reply := dnsRequest(withCookies(context.Background(), true), data, client, v)
+	defer endQuery(reply != nil, start)
+	if reply == nil {
+		return
+	}
+	if query, err := parseDNSMsg(data); err == nil {
+		reply = truncateUDP(query, reply)
+	}
+	tap(dnstapClientResponse, dnstapUDP, addr, start, data, reply)
+	capturePacket(addr, conn.LocalAddr(), reply, false)
+	if _, err := conn.WriteTo(reply, addr); err != nil {
+		warnf("Reply to %s: %v", addr, err)
 	} else {
-		log.Print("=====EOF=====")
+		debugf("=====EOF=====")
 	}
 }
 
-func main() {
-	udpAddr, err := net.ResolveUDPAddr("up4", ":53")
-	conn, err := net.ListenUDP("udp", udpAddr)
+// listenNetwork returns the network name for listening on proto, "udp"
+// or "tcp", restricted to the IP version of -listen-family. A dual-stack
+// socket on [::] also takes IPv4 clients.
+func listenNetwork(proto string) string {
+	switch *listenFamily {
+	case "dual":
+		return proto
+	case "ipv4":
+		return proto + "4"
+	case "ipv6":
+		return proto + "6"
+	}
+	log.Fatalf("bad -listen-family %q, want dual, ipv4 or ipv6", *listenFamily)
+	return ""
+}
+
+func listenUDP(addr string) *net.UDPConn {
+	network := listenNetwork("udp")
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	for {
-		dnsListen(*conn)
+	checkPrivilegedPort(addr)
+	conn, err := net.ListenUDP(network, udpAddr)
+	if err != nil {
+		log.Fatal(bindError(addr, err))
 	}
-}
\ No newline at end of file
+	return trackUDP(conn)
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "stamp":
+			stampMain(os.Args[2:])
+			return
+		case "replay":
+			replayMain(os.Args[2:])
+			return
+		case "bench":
+			benchMain(os.Args[2:])
+			return
+		case "service":
+			serviceMain(os.Args[2:])
+			return
+		}
+	}
+	flag.Parse()
+	serve()
+}
+
+// serve sets everything up from the flags and answers queries until
+// shutdown.
+func serve() {
+	setupConfig()
+	setupLogging()
+	setupLimits()
+	setupACL()
+	setupRateLimit()
+	setupCookies()
+	setupQuotas()
+	setupChaos()
+	setupOutbound()
+	setupBootstrap()
+	setupDialing()
+	setupUpstreams()
+	setupFallback()
+	setupDNSSEC()
+	setupRoutes()
+	setupCache()
+	setupDNS64()
+	setupLANRanges()
+	setupPTRTemplates()
+	setupLocalRecords()
+	setupHosts()
+	setupLeases()
+	setupZones()
+	setupDDR()
+	setupSpecialTLDs()
+	setupLocalZones()
+	setupSinkhole()
+	setupBlocklists()
+	setupReverseForward()
+	setupFilters()
+	setupRewrites()
+	setupPolicies()
+	setupMiddleware()
+	setupViews()
+	setupGroups()
+	setupSchedules()
+	setupHealthChecks()
+	setupDnstap()
+	setupCapture()
+	setupStats()
+	setupStatsd()
+	setupTracing()
+	for _, v := range views {
+		if v.listen == "" {
+			continue
+		}
+		go dnsListen(listenUDP(v.listen), v)
+		go dnsListenTCP(listenTCP(v.listen), v)
+	}
+	go dnsListenTCP(listenTCP(*listenAddr), nil)
+	go dnsListen(listenUDP(*listenAddr), nil)
+	startDoH()
+	startDoT()
+	startAdmin()
+	dropPrivileges()
+	waitForShutdown()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	dns64Enabled = flag.Bool("dns64", false, "synthesize AAAA records from A records for IPv6-only clients (RFC 6147)")
+	dns64Prefix  = flag.String("dns64-prefix", "64:ff9b::/96", "NAT64 prefix used for DNS64 synthesis, or auto to discover it (RFC 7050)")
+	dns64Recheck = flag.Duration("dns64-recheck", time.Hour, "how often to re-validate an auto-discovered NAT64 prefix")
+)
+
+// nat64Prefix is the static -dns64-prefix.
+var nat64Prefix *net.IPNet
+
+// With -dns64-prefix auto the prefix is discovered through each set of
+// upstreams separately, as different views may send their AAAA queries
+// to different DNS64 resolvers.
+var discovered = struct {
+	sync.Mutex
+	m map[string]*nat64Discovery
+}{m: make(map[string]*nat64Discovery)}
+
+type nat64Discovery struct {
+	prefix  *net.IPNet
+	next    time.Time // when to check the prefix again
+	running bool
+}
+
+// Well-known IPv4 addresses of ipv4only.arpa (RFC 7050 section 2.2).
+var ipv4onlyAddrs = []net.IP{net.IPv4(192, 0, 0, 170), net.IPv4(192, 0, 0, 171)}
+
+func setupDNS64() {
+	if !*dns64Enabled {
+		return
+	}
+	if *dns64Prefix == "auto" {
+		// Start with the global upstreams; the others are discovered on
+		// their first AAAA query.
+		nat64PrefixFor(upstreams)
+		return
+	}
+	_, prefix, err := net.ParseCIDR(*dns64Prefix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := checkNAT64Prefix(prefix); err != nil {
+		log.Fatal(err)
+	}
+	nat64Prefix = prefix
+	infof("DNS64 enabled with prefix %s", prefix)
+}
+
+// nat64PrefixFor returns the NAT64 prefix for the queries sent to g, or
+// nil while it is not known. An auto-discovered prefix is re-validated in
+// the background every -dns64-recheck; a failed check keeps the previous
+// prefix.
+func nat64PrefixFor(g upstreamGroup) *net.IPNet {
+	if *dns64Prefix != "auto" {
+		return nat64Prefix
+	}
+	key := g.String()
+	discovered.Lock()
+	defer discovered.Unlock()
+	d := discovered.m[key]
+	if d == nil {
+		d = &nat64Discovery{}
+		discovered.m[key] = d
+	}
+	if !d.running && !time.Now().Before(d.next) {
+		d.running = true
+		go d.discover(g)
+	}
+	return d.prefix
+}
+
+func (d *nat64Discovery) discover(g upstreamGroup) {
+	prefix, err := discoverNAT64Prefix(g)
+	discovered.Lock()
+	defer discovered.Unlock()
+	d.running = false
+	switch {
+	case err != nil:
+		warnf("DNS64: prefix discovery through %s failed: %v", g, err)
+	case d.prefix == nil || d.prefix.String() != prefix.String():
+		infof("DNS64: discovered NAT64 prefix %s through %s", prefix, g)
+		d.prefix = prefix
+	}
+	wait := *dns64Recheck
+	if d.prefix == nil {
+		wait = time.Minute
+	}
+	d.next = time.Now().Add(wait)
+}
+
+// discoverNAT64Prefix asks the upstreams g, which are expected to perform
+// DNS64 themselves, for the AAAA records of ipv4only.arpa and finds where
+// the well-known IPv4 addresses were embedded.
+func discoverNAT64Prefix(g upstreamGroup) (*net.IPNet, error) {
+	var q dnsMsg
+	q.id = uint16(rand.Uint32())
+	q.recursion_desired = true
+	q.question = []dnsQuestion{{Name: "ipv4only.arpa", Qtype: dnsTypeAAAA, Qclass: dnsClassINET}}
+	reply, err := g.exchange(packDNSMsg(q))
+	if err != nil {
+		return nil, err
+	}
+	msg, err := parseDNSMsg(reply)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range msg.answer {
+		if rr.Rrtype != dnsTypeAAAA || len(rr.Data) != net.IPv6len {
+			continue
+		}
+		ip := net.IP(rr.Data)
+		for _, ones := range []int{96, 64, 56, 48, 40, 32} {
+			v4 := extractIPv4(ip, ones)
+			for _, wk := range ipv4onlyAddrs {
+				if v4.Equal(wk) {
+					mask := net.CIDRMask(ones, 128)
+					return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+				}
+			}
+		}
+	}
+	return nil, errors.New("no synthesized AAAA records for ipv4only.arpa")
+}
+
+func checkNAT64Prefix(prefix *net.IPNet) error {
+	ones, bits := prefix.Mask.Size()
+	if bits != 128 || prefix.IP.To4() != nil {
+		return fmt.Errorf("bad NAT64 prefix %s, want an IPv6 prefix", prefix)
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+		return nil
+	}
+	return fmt.Errorf("bad NAT64 prefix length in %s, want 32, 40, 48, 56, 64 or 96", prefix)
+}
+
+// needsDNS64 reports whether reply is an empty successful answer to an
+// AAAA query in a view that does not filter AAAA records out.
+func needsDNS64(v *view, query, reply dnsMsg) bool {
+	if len(query.question) != 1 || query.question[0].Qtype != dnsTypeAAAA || v.filter[dnsTypeAAAA] {
+		return false
+	}
+	if reply.rcode != dnsRcodeSuccess {
+		return false
+	}
+	for _, rr := range reply.answer {
+		if rr.Rrtype == dnsTypeAAAA {
+			return false
+		}
+	}
+	return true
+}
+
+// embedIPv4 places v4 inside prefix as described in RFC 6052 section 2.2.
+func embedIPv4(prefix *net.IPNet, v4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	ones, _ := prefix.Mask.Size()
+	pos := ones / 8
+	for _, b := range v4.To4() {
+		if pos == 8 {
+			// bits 64 to 71 (the "u" octet) must be zero
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// extractIPv4 is the inverse of embedIPv4 for a prefix of length ones.
+func extractIPv4(ip net.IP, ones int) net.IP {
+	v4 := make(net.IP, 0, net.IPv4len)
+	for pos := ones / 8; len(v4) < net.IPv4len && pos < net.IPv6len; pos++ {
+		if pos == 8 {
+			continue
+		}
+		v4 = append(v4, ip[pos])
+	}
+	return v4
+}
+
+// IPv4 addresses that are never synthesized into AAAA records: those
+// that cannot be reached through any NAT64 (RFC 6147 section 5.1.4).
+var dns64Excluded = mustParseCIDRs("0.0.0.0/8,127.0.0.0/8,169.254.0.0/16,224.0.0.0/4,240.0.0.0/4")
+
+// Addresses that are not global, which the well-known prefix must not
+// carry (RFC 6052 section 3.1).
+var dns64NonGlobal = mustParseCIDRs("10.0.0.0/8,100.64.0.0/10,172.16.0.0/12,192.0.0.0/24,192.0.2.0/24,192.168.0.0/16,198.18.0.0/15,198.51.100.0/24,203.0.113.0/24")
+
+var wellKnownNAT64 = &net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+
+func mustParseCIDRs(cidrs string) []*net.IPNet {
+	nets, err := parseCIDRs([]string{cidrs})
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// dns64Excludes reports whether v4 must not be synthesized under prefix.
+func dns64Excludes(prefix *net.IPNet, v4 net.IP) bool {
+	excluded := dns64Excluded
+	if prefix.String() == wellKnownNAT64.String() {
+		excluded = append(excluded[:len(excluded):len(excluded)], dns64NonGlobal...)
+	}
+	for _, n := range excluded {
+		if n.Contains(v4) {
+			return true
+		}
+	}
+	return false
+}
+
+// dns64Synthesize looks up the A records of the name, through the cache
+// and the in-flight queries like any other query, and turns them into
+// AAAA records under prefix. On any failure the original reply
+// is returned unchanged, as it is for queries with both the DO and CD
+// bits, whose clients validate the answers themselves (RFC 6147 section
+// 5.5).
+func dns64Synthesize(ctx context.Context, v *view, g upstreamGroup, prefix *net.IPNet, query dnsMsg, reply []byte, msg dnsMsg) []byte {
+	if wantsDNSSEC(query) && query.checking_disabled {
+		return reply
+	}
+	aquery := query
+	aquery.question = []dnsQuestion{query.question[0]}
+	aquery.question[0].Qtype = dnsTypeA
+	amsg, ok := cache.get(v, aquery)
+	if !ok {
+		var final []byte
+		if _, amsg, final = forward(ctx, v, g, aquery, packDNSMsg(aquery)); final != nil {
+			debugf("DNS64: A query for %s failed", query.question[0].Name)
+			return reply
+		}
+	}
+	if amsg.rcode != dnsRcodeSuccess {
+		return reply
+	}
+
+	var answer []dnsRR
+	synthesized := 0
+	for _, rr := range amsg.answer {
+		switch rr.Rrtype {
+		case dnsTypeCNAME:
+			answer = append(answer, rr)
+		case dnsTypeA:
+			if len(rr.Data) != net.IPv4len || dns64Excludes(prefix, net.IP(rr.Data)) {
+				continue
+			}
+			rr.Rrtype = dnsTypeAAAA
+			rr.Data = embedIPv4(prefix, net.IP(rr.Data))
+			rr.Rdlength = uint16(len(rr.Data))
+			answer = append(answer, rr)
+			synthesized++
+		}
+	}
+	if synthesized == 0 {
+		return reply
+	}
+	msg.answer = answer
+	msg.ns = nil
+	// The synthesized records were not validated (RFC 6147 section 5.5).
+	msg.authenticated_data = false
+	debugf("DNS64: synthesized %d records for %s", synthesized, query.question[0].Name)
+	return packDNSMsg(msg)
+}
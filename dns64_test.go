@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// TestDNS64Filtered checks that AAAA records are not synthesized in a
+// view that filters them out.
+func TestDNS64Filtered(t *testing.T) {
+	var query dnsMsg
+	query.question = []dnsQuestion{{Name: "example.com", Qtype: dnsTypeAAAA, Qclass: dnsClassINET}}
+	reply := newReply(query, dnsRcodeSuccess)
+	reply.answer = addressRRs("example.com", dnsTypeAAAA, []net.IP{net.ParseIP("2001:db8::1")})
+
+	open := &view{}
+	filtered := &view{filter: map[uint16]bool{dnsTypeAAAA: true}}
+	if needsDNS64(open, query, reply) {
+		t.Error("synthesis for a reply with AAAA records")
+	}
+	stripped, _ := filterTypes(filtered, reply)
+	if len(stripped.answer) != 0 {
+		t.Fatalf("%d records left after filtering AAAA", len(stripped.answer))
+	}
+	if !needsDNS64(open, query, stripped) {
+		t.Error("no synthesis for an empty reply")
+	}
+	if needsDNS64(filtered, query, stripped) {
+		t.Error("synthesis in a view filtering AAAA")
+	}
+}
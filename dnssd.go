@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+var dnssdDomains stringList
+
+func init() {
+	flag.Var(&dnssdDomains, "dnssd-domain", "bridge DNS-SD browsing under this domain to mDNS .local (repeatable)")
+}
+
+// dnssdDomain returns the configured DNS-SD domain name belongs to.
+func dnssdDomain(name string) (string, bool) {
+	name = canonicalName(name)
+	for _, d := range dnssdDomains {
+		d = canonicalName(d)
+		if strings.HasSuffix(name, "."+d) {
+			return d, true
+		}
+	}
+	return "", false
+}
+
+// isServiceName reports whether name looks like a DNS-SD service type,
+// instance or browsing domain, i.e. has a _tcp/_udp or _dns-sd label.
+func isServiceName(name string) bool {
+	for _, l := range strings.Split(canonicalName(name), ".") {
+		if l == "_tcp" || l == "_udp" || l == "_dns-sd" {
+			return true
+		}
+	}
+	return false
+}
+
+func replaceDomain(name, from, to string) string {
+	name = canonicalName(name)
+	if base, ok := strings.CutSuffix(name, "."+from); ok {
+		return base + "." + to
+	}
+	return name
+}
+
+// rewriteRR moves a record, and the names in its rdata, from one domain
+// to another.
+func rewriteRR(rr dnsRR, from, to string) dnsRR {
+	rr.Name = replaceDomain(rr.Name, from, to)
+	var fixed int
+	switch rr.Rrtype {
+	case dnsTypePTR, dnsTypeCNAME:
+	case dnsTypeSRV:
+		fixed = 6
+	default:
+		return rr
+	}
+	if len(rr.Data) <= fixed {
+		return rr
+	}
+	target, _, err := getDomainName(rr.Data, fixed)
+	if err != nil {
+		return rr
+	}
+	rr.Data = packDomainName(append([]byte{}, rr.Data[:fixed]...), replaceDomain(target, from, to))
+	rr.Rdlength = uint16(len(rr.Data))
+	return rr
+}
+
+// dnssdAnswer answers PTR, SRV and TXT service discovery queries under a
+// configured domain by asking the same question about .local over mDNS,
+// so that services can be browsed from other networks. Local zone data
+// for the domain is used when mDNS has nothing.
+func dnssdAnswer(query dnsMsg, zs []*zone) []byte {
+	if len(query.question) != 1 {
+		return nil
+	}
+	q := query.question[0]
+	domain, ok := dnssdDomain(q.Name)
+	if !ok || !isServiceName(q.Name) {
+		return nil
+	}
+	switch q.Qtype {
+	case dnsTypePTR, dnsTypeSRV, dnsTypeTXT, dnsTypeA, dnsTypeAAAA:
+	default:
+		return nil
+	}
+
+	mq := q
+	mq.Name = replaceDomain(q.Name, domain, "local")
+	answer, extra, _, err := mdnsQuery(mq, q.Qtype == dnsTypePTR)
+	if err != nil {
+		warnf("DNS-SD: %v", err)
+	}
+	if len(answer) == 0 {
+		return zoneAnswer(query, zs)
+	}
+	reply := newReply(query, dnsRcodeSuccess)
+	for _, rr := range answer {
+		reply.answer = append(reply.answer, rewriteRR(rr, "local", domain))
+	}
+	for _, rr := range extra {
+		switch rr.Rrtype {
+		case dnsTypeSRV, dnsTypeTXT, dnsTypeA, dnsTypeAAAA:
+			reply.extra = append(reply.extra, rewriteRR(rr, "local", domain))
+		}
+	}
+	return packDNSMsg(reply)
+}
@@ -0,0 +1,1187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	dnssecValidate   = flag.Bool("dnssec", false, "validate DNSSEC signatures on upstream answers, answering SERVFAIL for bogus ones")
+	dnssecPermissive = flag.Bool("dnssec-permissive", false, "with -dnssec, only log bogus answers instead of failing them")
+	trustAnchorFlags stringList
+)
+
+func init() {
+	flag.Var(&trustAnchorFlags, "dnssec-trust-anchor", `root trust anchor as a DS record "keytag algorithm digesttype digest" (repeatable, default the IANA root KSKs)`)
+}
+
+// The DS records of the root zone key signing keys published by IANA.
+var rootAnchors = []string{
+	"20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	"38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+var trustAnchors []dnsRR
+
+// The DO bit in the TTL field of an OPT record asks for DNSSEC records.
+const ednsDO = 0x8000
+
+type dnssecStatus int
+
+const (
+	dnssecSecure dnssecStatus = iota
+	dnssecInsecure
+	dnssecBogus
+)
+
+func setupDNSSEC() {
+	if !*dnssecValidate {
+		return
+	}
+	specs := []string(trustAnchorFlags)
+	if len(specs) == 0 {
+		specs = rootAnchors
+	}
+	for _, spec := range specs {
+		ds, err := parseDS(spec)
+		if err != nil {
+			log.Fatalf("bad -dnssec-trust-anchor %q: %v", spec, err)
+		}
+		trustAnchors = append(trustAnchors, ds)
+	}
+	mode := "enforcing"
+	if *dnssecPermissive {
+		mode = "permissive"
+	}
+	infof("DNSSEC validation enabled (%s) with %d trust anchors", mode, len(trustAnchors))
+}
+
+// parseDS reads the rdata of a root DS record in presentation format.
+func parseDS(spec string) (dnsRR, error) {
+	f := strings.Fields(spec)
+	if len(f) != 4 {
+		return dnsRR{}, errors.New("want keytag algorithm digesttype digest")
+	}
+	var nums [3]uint64
+	for i, bits := range []int{16, 8, 8} {
+		n, err := strconv.ParseUint(f[i], 10, bits)
+		if err != nil {
+			return dnsRR{}, err
+		}
+		nums[i] = n
+	}
+	digest, err := hex.DecodeString(f[3])
+	if err != nil {
+		return dnsRR{}, err
+	}
+	b := binary.BigEndian.AppendUint16(nil, uint16(nums[0]))
+	b = append(b, byte(nums[1]), byte(nums[2]))
+	b = append(b, digest...)
+	return dnsRR{Name: "", Rrtype: dnsTypeDS, Class: dnsClassINET, Rdlength: uint16(len(b)), Data: b}, nil
+}
+
+// wantsDNSSEC reports whether the client set the DO bit.
+func wantsDNSSEC(query dnsMsg) bool {
+	opt := ednsOPT(query)
+	return opt != nil && opt.Ttl&ednsDO != 0
+}
+
+// fitDNSSEC removes the DNSSEC records a validating proxy asked for from
+// replies to clients that did not ask for them.
+func fitDNSSEC(query, reply dnsMsg) (dnsMsg, bool) {
+	if !*dnssecValidate || wantsDNSSEC(query) {
+		return reply, false
+	}
+	strip := func(rrs []dnsRR) []dnsRR {
+		out := make([]dnsRR, 0, len(rrs))
+		for _, rr := range rrs {
+			switch rr.Rrtype {
+			case dnsTypeRRSIG, dnsTypeNSEC, dnsTypeNSEC3:
+				if len(query.question) != 1 || query.question[0].Qtype != rr.Rrtype {
+					continue
+				}
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+	n := len(reply.answer) + len(reply.ns)
+	reply.answer, reply.ns = strip(reply.answer), strip(reply.ns)
+	return reply, len(reply.answer)+len(reply.ns) != n
+}
+
+// rrset is the records of one name and type with the signatures over them.
+type rrset struct {
+	name   string
+	rrtype uint16
+	rrs    []dnsRR
+	sigs   []dnsRR
+}
+
+// rrsets groups records into RRsets, attaching each RRSIG to the RRset it
+// covers.
+func rrsets(rrs []dnsRR) []*rrset {
+	var sets []*rrset
+	find := func(name string, rrtype uint16) *rrset {
+		for _, s := range sets {
+			if s.rrtype == rrtype && s.name == name {
+				return s
+			}
+		}
+		s := &rrset{name: name, rrtype: rrtype}
+		sets = append(sets, s)
+		return s
+	}
+	for _, rr := range rrs {
+		if rr.Rrtype != dnsTypeRRSIG && rr.Rrtype != dnsTypeOPT {
+			s := find(canonicalName(rr.Name), rr.Rrtype)
+			s.rrs = append(s.rrs, rr)
+		}
+	}
+	for _, rr := range rrs {
+		if rr.Rrtype == dnsTypeRRSIG && len(rr.Data) >= 2 {
+			s := find(canonicalName(rr.Name), binary.BigEndian.Uint16(rr.Data))
+			s.sigs = append(s.sigs, rr)
+		}
+	}
+	// Drop signatures that cover nothing in this section.
+	out := sets[:0]
+	for _, s := range sets {
+		if len(s.rrs) > 0 {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func findRRset(rrs []dnsRR, name string, rrtype uint16) *rrset {
+	for _, s := range rrsets(rrs) {
+		if s.name == name && s.rrtype == rrtype {
+			return s
+		}
+	}
+	return nil
+}
+
+type rrsig struct {
+	covered    uint16
+	alg        uint8
+	labels     uint8
+	origTTL    uint32
+	expiration uint32
+	inception  uint32
+	keyTag     uint16
+	signer     string
+	signature  []byte
+	// The rdata up to the signature, in canonical form.
+	header []byte
+}
+
+func parseRRSIG(rr dnsRR) (rrsig, error) {
+	d := rr.Data
+	if len(d) < 19 {
+		return rrsig{}, errMsgTruncated
+	}
+	signer, off, err := getDomainName(d, 18)
+	if err != nil {
+		return rrsig{}, err
+	}
+	signer = canonicalName(signer)
+	return rrsig{
+		covered:    binary.BigEndian.Uint16(d),
+		alg:        d[2],
+		labels:     d[3],
+		origTTL:    binary.BigEndian.Uint32(d[4:]),
+		expiration: binary.BigEndian.Uint32(d[8:]),
+		inception:  binary.BigEndian.Uint32(d[12:]),
+		keyTag:     binary.BigEndian.Uint16(d[16:]),
+		signer:     signer,
+		signature:  d[off:],
+		header:     packDomainName(append([]byte{}, d[:18]...), signer),
+	}, nil
+}
+
+// keyTag computes the tag of a DNSKEY as in RFC 4034 appendix B.
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac)
+}
+
+// isZoneKey reports whether a DNSKEY may sign zone data.
+func isZoneKey(key dnsRR) bool {
+	return len(key.Data) > 4 && binary.BigEndian.Uint16(key.Data)&0x0100 != 0 && key.Data[2] == 3
+}
+
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case 5, 7, 8, 10, 13, 14, 15:
+		return true
+	}
+	return false
+}
+
+// lowerName lowercases the uncompressed name at off in b and returns the
+// offset after it.
+func lowerName(b []byte, off int) int {
+	for off < len(b) && b[off] != 0 {
+		n := int(b[off])
+		off++
+		for i := off; i < off+n && i < len(b); i++ {
+			if b[i] >= 'A' && b[i] <= 'Z' {
+				b[i] += 'a' - 'A'
+			}
+		}
+		off += n
+	}
+	return off + 1
+}
+
+// canonicalRdata returns rdata with the embedded names lowercased
+// (RFC 4034 section 6.2).
+func canonicalRdata(rr dnsRR) []byte {
+	d := append([]byte{}, rr.Data...)
+	switch rr.Rrtype {
+	case dnsTypeNS, dnsTypeCNAME, dnsTypePTR:
+		lowerName(d, 0)
+	case dnsTypeMX:
+		lowerName(d, 2)
+	case dnsTypeSRV:
+		lowerName(d, 6)
+	case dnsTypeSOA:
+		lowerName(d, lowerName(d, 0))
+	}
+	return d
+}
+
+func splitLabels(name string) []string {
+	if name = canonicalName(name); name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// signedData builds the data an RRSIG signs over rrs.
+func (s rrsig) signedData(rrs []dnsRR) []byte {
+	labels := splitLabels(rrs[0].Name)
+	if len(labels) > 0 && labels[0] == "*" {
+		labels = labels[1:]
+	}
+	owner := strings.Join(labels, ".")
+	if int(s.labels) < len(labels) {
+		// The answer was synthesized from a wildcard.
+		owner = strings.Join(append([]string{"*"}, labels[len(labels)-int(s.labels):]...), ".")
+	}
+	wire := packDomainName(nil, owner)
+	var rdatas [][]byte
+	for _, rr := range rrs {
+		rdatas = append(rdatas, canonicalRdata(rr))
+	}
+	sort.Slice(rdatas, func(i, j int) bool {
+		return bytes.Compare(rdatas[i], rdatas[j]) < 0
+	})
+	b := append([]byte{}, s.header...)
+	for i, rd := range rdatas {
+		if i > 0 && bytes.Equal(rd, rdatas[i-1]) {
+			continue
+		}
+		b = append(b, wire...)
+		b = binary.BigEndian.AppendUint16(b, rrs[0].Rrtype)
+		b = binary.BigEndian.AppendUint16(b, dnsClassINET)
+		b = binary.BigEndian.AppendUint32(b, s.origTTL)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(rd)))
+		b = append(b, rd...)
+	}
+	return b
+}
+
+var errSignatureTime = errors.New("signature expired or not yet valid")
+
+// verify checks the signature over rrs with key.
+func (s rrsig) verify(key dnsRR, rrs []dnsRR) error {
+	now := uint32(time.Now().Unix())
+	if int32(now-s.inception) < 0 || int32(s.expiration-now) < 0 {
+		return errSignatureTime
+	}
+	if len(key.Data) < 4 {
+		return errMsgTruncated
+	}
+	data := s.signedData(rrs)
+	pub := key.Data[4:]
+	var hash crypto.Hash
+	switch s.alg {
+	case 5, 7:
+		hash = crypto.SHA1
+	case 8, 13:
+		hash = crypto.SHA256
+	case 14:
+		hash = crypto.SHA384
+	case 10:
+		hash = crypto.SHA512
+	case 15:
+		if len(pub) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(pub), data, s.signature) {
+			return errors.New("bad Ed25519 signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %d", s.alg)
+	}
+	h := hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+	switch s.alg {
+	case 13, 14:
+		curve, size := elliptic.P256(), 32
+		if s.alg == 14 {
+			curve, size = elliptic.P384(), 48
+		}
+		if len(pub) != 2*size || len(s.signature) != 2*size {
+			return errors.New("bad ECDSA key or signature size")
+		}
+		pk, err := ecdsa.ParseUncompressedPublicKey(curve, append([]byte{4}, pub...))
+		if err != nil {
+			return err
+		}
+		r := new(big.Int).SetBytes(s.signature[:size])
+		ss := new(big.Int).SetBytes(s.signature[size:])
+		if !ecdsa.Verify(pk, digest, r, ss) {
+			return errors.New("bad ECDSA signature")
+		}
+		return nil
+	}
+	pk, err := rsaKey(pub)
+	if err != nil {
+		return err
+	}
+	return rsa.VerifyPKCS1v15(pk, hash, digest, s.signature)
+}
+
+// rsaKey decodes an RSA public key in RFC 3110 format.
+func rsaKey(b []byte) (*rsa.PublicKey, error) {
+	if len(b) < 3 {
+		return nil, errMsgTruncated
+	}
+	elen := int(b[0])
+	b = b[1:]
+	if elen == 0 {
+		elen = int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if elen == 0 || elen > 4 || len(b) <= elen {
+		return nil, errors.New("bad RSA key")
+	}
+	e := new(big.Int).SetBytes(b[:elen])
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(b[elen:]), E: int(e.Int64())}, nil
+}
+
+// dsMatches reports whether ds is the digest of key.
+func dsMatches(ds, key dnsRR) bool {
+	d := ds.Data
+	if len(d) < 5 || len(key.Data) < 4 {
+		return false
+	}
+	if binary.BigEndian.Uint16(d) != keyTag(key.Data) || d[2] != key.Data[3] {
+		return false
+	}
+	data := append(packDomainName(nil, canonicalName(key.Name)), key.Data...)
+	var sum []byte
+	switch d[3] {
+	case 1:
+		s := sha1.Sum(data)
+		sum = s[:]
+	case 2:
+		s := sha256.Sum256(data)
+		sum = s[:]
+	case 4:
+		s := sha512.Sum384(data)
+		sum = s[:]
+	default:
+		return false
+	}
+	return bytes.Equal(sum, d[4:])
+}
+
+// usableDS reports whether any DS record uses algorithms we implement.
+// Zones signed only with others are treated as unsigned (RFC 4035
+// section 5.2).
+func usableDS(ds []dnsRR) bool {
+	for _, rr := range ds {
+		if len(rr.Data) > 4 && supportedAlgorithm(rr.Data[2]) && (rr.Data[3] == 1 || rr.Data[3] == 2 || rr.Data[3] == 4) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasType looks up t in an NSEC or NSEC3 type bitmap.
+func hasType(bitmap []byte, t uint16) bool {
+	for len(bitmap) >= 2 {
+		window, n := bitmap[0], int(bitmap[1])
+		bitmap = bitmap[2:]
+		if n > len(bitmap) {
+			return false
+		}
+		if uint16(window) == t>>8 {
+			i := int(t&0xFF) / 8
+			return i < n && bitmap[i]&(0x80>>(t%8)) != 0
+		}
+		bitmap = bitmap[n:]
+	}
+	return false
+}
+
+// canonicalCompare orders names as in RFC 4034 section 6.1.
+func canonicalCompare(a, b string) int {
+	la, lb := splitLabels(a), splitLabels(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// covers reports whether x falls strictly between owner and next in a
+// circular ordering.
+func covers(owner, next, x string, cmp func(a, b string) int) bool {
+	if cmp(owner, next) < 0 {
+		return cmp(owner, x) < 0 && cmp(x, next) < 0
+	}
+	return cmp(owner, x) < 0 || cmp(x, next) < 0
+}
+
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+func nsec3Hash(name string, salt []byte, iterations uint16) string {
+	h := sha1.Sum(append(packDomainName(nil, canonicalName(name)), salt...))
+	for i := 0; i < int(iterations); i++ {
+		h = sha1.Sum(append(h[:], salt...))
+	}
+	return strings.ToLower(base32Hex.EncodeToString(h[:]))
+}
+
+// dnssecEntry is a cached answer or set of zone keys.
+type dnssecEntry struct {
+	msg     dnsMsg
+	keys    []dnsRR
+	status  dnssecStatus
+	expires time.Time
+}
+
+// Answers fetched for validation and validated zone keys, shared by all
+// queries. Entries live for their TTL, at most an hour.
+var dnssecCache = struct {
+	sync.Mutex
+	m map[string]dnssecEntry
+}{m: make(map[string]dnssecEntry)}
+
+const maxDNSSECCache = 10000
+
+func dnssecCacheGet(key string) (dnssecEntry, bool) {
+	dnssecCache.Lock()
+	defer dnssecCache.Unlock()
+	e, ok := dnssecCache.m[key]
+	if ok && time.Now().After(e.expires) {
+		delete(dnssecCache.m, key)
+		return e, false
+	}
+	return e, ok
+}
+
+func dnssecCachePut(key string, e dnssecEntry, ttl uint32) {
+	e.expires = time.Now().Add(time.Duration(min(ttl, 3600)) * time.Second)
+	dnssecCache.Lock()
+	defer dnssecCache.Unlock()
+	if len(dnssecCache.m) >= maxDNSSECCache {
+		clear(dnssecCache.m)
+	}
+	dnssecCache.m[key] = e
+}
+
+// validator validates one reply, fetching the keys and delegation
+// records it needs from upstreams.
+type validator struct {
+	// The context of the query being validated.
+	ctx       context.Context
+	upstreams upstreamGroup
+	// Zones whose keys are being loaded, to stop signature loops.
+	busy map[string]bool
+}
+
+func (v *validator) fetch(name string, qtype uint16) (dnsMsg, error) {
+	key := name + "/" + strconv.Itoa(int(qtype))
+	if e, ok := dnssecCacheGet(key); ok {
+		return e.msg, nil
+	}
+	var q dnsMsg
+	q.id = uint16(rand.Uint32())
+	q.recursion_desired = true
+	q.checking_disabled = true
+	q.question = []dnsQuestion{{Name: name, Qtype: qtype, Qclass: dnsClassINET}}
+	opt := newOPT()
+	opt.Ttl = ednsDO
+	q.extra = []dnsRR{opt}
+	reply, err := v.upstreams.exchangeContext(v.ctx, packDNSMsg(q))
+	if err != nil {
+		return dnsMsg{}, err
+	}
+	msg, err := parseDNSMsg(reply)
+	if err != nil {
+		return dnsMsg{}, err
+	}
+	if msg.rcode != dnsRcodeSuccess && msg.rcode != dnsRcodeNameError {
+		return dnsMsg{}, fmt.Errorf("%s query for %q failed with rcode %d", typeName(qtype), name, msg.rcode)
+	}
+	ttl, ok := minTTL(msg)
+	if !ok {
+		ttl = 60
+	}
+	dnssecCachePut(key, dnssecEntry{msg: msg}, ttl)
+	return msg, nil
+}
+
+func zoneLabel(zone string) string {
+	if zone == "" {
+		return "."
+	}
+	return zone
+}
+
+// verifyRRset checks the signatures over set. Signatures by zones that
+// are provably unsigned make the set insecure.
+func (v *validator) verifyRRset(set *rrset) (dnssecStatus, error) {
+	err := fmt.Errorf("no signatures over %s %s", set.name, typeName(set.rrtype))
+	for _, rr := range set.sigs {
+		sig, perr := parseRRSIG(rr)
+		if perr != nil {
+			err = perr
+			continue
+		}
+		if !inZone(set.name, sig.signer) || set.rrtype == dnsTypeDS && sig.signer == set.name {
+			err = fmt.Errorf("%s %s signed by unrelated zone %s", set.name, typeName(set.rrtype), zoneLabel(sig.signer))
+			continue
+		}
+		keys, st, kerr := v.zoneKeys(sig.signer)
+		if st == dnssecInsecure {
+			return dnssecInsecure, nil
+		}
+		if kerr != nil {
+			err = kerr
+			continue
+		}
+		for _, key := range keys {
+			if len(key.Data) < 4 || keyTag(key.Data) != sig.keyTag || key.Data[3] != sig.alg {
+				continue
+			}
+			if verr := sig.verify(key, set.rrs); verr != nil {
+				err = fmt.Errorf("%s %s: %v", set.name, typeName(set.rrtype), verr)
+				continue
+			}
+			return dnssecSecure, nil
+		}
+	}
+	return dnssecBogus, err
+}
+
+// zoneKeys returns the validated DNSKEYs of zone, following the chain of
+// DS records from the trust anchors.
+func (v *validator) zoneKeys(zone string) ([]dnsRR, dnssecStatus, error) {
+	if e, ok := dnssecCacheGet("keys/" + zone); ok {
+		return e.keys, e.status, nil
+	}
+	if v.busy[zone] {
+		return nil, dnssecBogus, fmt.Errorf("signature loop at %s", zoneLabel(zone))
+	}
+	v.busy[zone] = true
+	defer delete(v.busy, zone)
+	keys, st, ttl, err := v.loadZoneKeys(zone)
+	if err == nil {
+		dnssecCachePut("keys/"+zone, dnssecEntry{keys: keys, status: st}, ttl)
+	}
+	return keys, st, err
+}
+
+func (v *validator) loadZoneKeys(zone string) ([]dnsRR, dnssecStatus, uint32, error) {
+	ds := trustAnchors
+	if zone != "" {
+		msg, err := v.fetch(zone, dnsTypeDS)
+		if err != nil {
+			return nil, dnssecBogus, 0, err
+		}
+		set := findRRset(msg.answer, zone, dnsTypeDS)
+		if set == nil {
+			st, cut, err := v.denial(zone, msg)
+			if st == dnssecInsecure || st == dnssecSecure && cut {
+				ttl, _ := minTTL(msg)
+				return nil, dnssecInsecure, ttl, nil
+			}
+			if err == nil {
+				err = fmt.Errorf("no DS records for %s", zone)
+			}
+			return nil, dnssecBogus, 0, err
+		}
+		if st, err := v.verifyRRset(set); st != dnssecSecure {
+			ttl, _ := minTTL(msg)
+			return nil, st, ttl, err
+		}
+		ds = set.rrs
+	}
+	if !usableDS(ds) {
+		return nil, dnssecInsecure, 3600, nil
+	}
+	msg, err := v.fetch(zone, dnsTypeDNSKEY)
+	if err != nil {
+		return nil, dnssecBogus, 0, err
+	}
+	set := findRRset(msg.answer, zone, dnsTypeDNSKEY)
+	if set == nil {
+		return nil, dnssecBogus, 0, fmt.Errorf("no DNSKEY records for %s", zoneLabel(zone))
+	}
+	// Only the zone keys are kept: the others cannot sign anything, and
+	// a short record must not reach the code that reads the algorithm.
+	var keys []dnsRR
+	for _, key := range set.rrs {
+		if isZoneKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	err = fmt.Errorf("DNSKEY records of %s do not match its DS records", zoneLabel(zone))
+	for _, key := range keys {
+		matched := false
+		for _, d := range ds {
+			matched = matched || dsMatches(d, key)
+		}
+		if !matched {
+			continue
+		}
+		for _, rr := range set.sigs {
+			sig, perr := parseRRSIG(rr)
+			if perr != nil || sig.signer != zone || sig.keyTag != keyTag(key.Data) || sig.alg != key.Data[3] {
+				continue
+			}
+			if err = sig.verify(key, set.rrs); err == nil {
+				ttl, _ := minTTL(msg)
+				return keys, dnssecSecure, ttl, nil
+			}
+			err = fmt.Errorf("DNSKEY of %s: %v", zoneLabel(zone), err)
+		}
+	}
+	return nil, dnssecBogus, 0, err
+}
+
+// denial examines a reply without DS records for name. The status says
+// whether the denial is authentic and proven; cut reports whether it
+// proves an unsigned delegation at name rather than a name that is no
+// zone cut.
+func (v *validator) denial(name string, msg dnsMsg) (dnssecStatus, bool, error) {
+	var proof []dnsRR
+	for _, set := range rrsets(msg.ns) {
+		if len(set.sigs) == 0 {
+			continue
+		}
+		if st, err := v.verifyRRset(set); st != dnssecSecure {
+			return st, false, err
+		}
+		proof = append(proof, set.rrs...)
+	}
+	if len(proof) == 0 {
+		// An unsigned denial is only acceptable from an unsigned zone.
+		parent := ""
+		if _, p, ok := strings.Cut(name, "."); ok {
+			parent = p
+		}
+		if soa := firstOfType(msg.ns, dnsTypeSOA); soa != nil {
+			parent = canonicalName(soa.Name)
+		}
+		if parent != name {
+			if _, st, _ := v.zoneKeys(parent); st == dnssecInsecure {
+				return dnssecInsecure, false, nil
+			}
+		}
+		return dnssecBogus, false, fmt.Errorf("unsigned denial of DS for %s", name)
+	}
+	cut := func(bitmap []byte) bool {
+		return hasType(bitmap, dnsTypeNS) && !hasType(bitmap, dnsTypeDS) && !hasType(bitmap, dnsTypeSOA)
+	}
+	p := newDenialProof(proof)
+	if n := p.nsecMatch(name); n != nil {
+		return dnssecSecure, cut(n.bitmap), nil
+	}
+	if p.nsecCover(name) != nil {
+		// A name that does not exist is no zone cut.
+		return dnssecSecure, false, nil
+	}
+	if len(p.nsec3) > 0 {
+		if p.costly {
+			return dnssecInsecure, false, nil
+		}
+		if n := p.nsec3Match(name); n != nil {
+			return dnssecSecure, cut(n.bitmap), nil
+		}
+		if _, cover, ok := p.closestEncloser(name); ok {
+			// Opt-out spans may hide unsigned delegations.
+			return dnssecSecure, cover.optOut, nil
+		}
+	}
+	return dnssecBogus, false, fmt.Errorf("no NSEC or NSEC3 proof for missing DS of %s", name)
+}
+
+func firstOfType(rrs []dnsRR, rrtype uint16) *dnsRR {
+	for i, rr := range rrs {
+		if rr.Rrtype == rrtype {
+			return &rrs[i]
+		}
+	}
+	return nil
+}
+
+// nameStatus finds out whether unsigned data for name is expected, by
+// walking the delegations from the root down looking for an unsigned
+// one.
+func (v *validator) nameStatus(name string) (dnssecStatus, error) {
+	if _, st, err := v.zoneKeys(""); st != dnssecSecure {
+		return st, err
+	}
+	labels := splitLabels(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		zone := strings.Join(labels[i:], ".")
+		msg, err := v.fetch(zone, dnsTypeDS)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		if findRRset(msg.answer, zone, dnsTypeDS) != nil {
+			if _, st, err := v.zoneKeys(zone); st != dnssecSecure {
+				return st, err
+			}
+			continue
+		}
+		st, cut, err := v.denial(zone, msg)
+		if st != dnssecSecure {
+			return st, err
+		}
+		if cut {
+			return dnssecInsecure, nil
+		}
+		if msg.rcode == dnsRcodeNameError {
+			// Nothing below name exists in this signed zone.
+			return dnssecSecure, nil
+		}
+	}
+	return dnssecSecure, nil
+}
+
+// nsecRecord is a validated NSEC record.
+type nsecRecord struct {
+	owner, next string
+	bitmap      []byte
+}
+
+// nsec3Record is a validated NSEC3 record, its owner and next hashes in
+// lowercase base32hex.
+type nsec3Record struct {
+	owner, next, zone string
+	optOut            bool
+	iterations        uint16
+	salt              []byte
+	bitmap            []byte
+}
+
+func (n *nsec3Record) hash(name string) string {
+	return nsec3Hash(name, n.salt, n.iterations)
+}
+
+// NSEC3 records with more iterations than this are too costly to check,
+// and their zones are taken as unsigned, as RFC 9276 section 3.2 allows.
+const maxNSEC3Iterations = 150
+
+// denialProof is the validated NSEC and NSEC3 records of a reply, which
+// prove names or types missing.
+type denialProof struct {
+	nsec  []nsecRecord
+	nsec3 []nsec3Record
+	// costly is set when an NSEC3 record has too many iterations.
+	costly bool
+}
+
+func newDenialProof(rrs []dnsRR) denialProof {
+	var p denialProof
+	for _, rr := range rrs {
+		switch rr.Rrtype {
+		case dnsTypeNSEC:
+			next, off, err := getDomainName(rr.Data, 0)
+			if err != nil {
+				continue
+			}
+			p.nsec = append(p.nsec, nsecRecord{owner: canonicalName(rr.Name), next: canonicalName(next), bitmap: rr.Data[off:]})
+		case dnsTypeNSEC3:
+			d := rr.Data
+			if len(d) < 5 || d[0] != 1 || len(d) < 5+int(d[4])+1 {
+				continue
+			}
+			salt := d[5 : 5+int(d[4])]
+			off := 5 + len(salt)
+			hlen := int(d[off])
+			if len(d) < off+1+hlen {
+				continue
+			}
+			owner, zone, _ := strings.Cut(canonicalName(rr.Name), ".")
+			n := nsec3Record{
+				owner:      owner,
+				next:       strings.ToLower(base32Hex.EncodeToString(d[off+1 : off+1+hlen])),
+				zone:       zone,
+				optOut:     d[1]&0x01 != 0,
+				iterations: binary.BigEndian.Uint16(d[2:]),
+				salt:       salt,
+				bitmap:     d[off+1+hlen:],
+			}
+			p.costly = p.costly || n.iterations > maxNSEC3Iterations
+			p.nsec3 = append(p.nsec3, n)
+		}
+	}
+	return p
+}
+
+// delegation reports whether an NSEC or NSEC3 bitmap is of a zone cut as
+// seen from the parent zone, which proves nothing about the child.
+func delegation(bitmap []byte) bool {
+	return hasType(bitmap, dnsTypeNS) && !hasType(bitmap, dnsTypeSOA)
+}
+
+func wildcardOf(name string) string {
+	if name == "" {
+		return "*"
+	}
+	return "*." + name
+}
+
+// commonAncestor returns the longest name that a and b are both at or
+// under.
+func commonAncestor(a, b string) string {
+	la, lb := splitLabels(a), splitLabels(b)
+	i := 0
+	for i < len(la) && i < len(lb) && la[len(la)-1-i] == lb[len(lb)-1-i] {
+		i++
+	}
+	return strings.Join(la[len(la)-i:], ".")
+}
+
+func (p denialProof) nsecMatch(name string) *nsecRecord {
+	for i, n := range p.nsec {
+		if n.owner == name {
+			return &p.nsec[i]
+		}
+	}
+	return nil
+}
+
+// nsecCover returns the NSEC record proving that name does not exist.
+// Records of delegations above name do not count, as the names under a
+// zone cut are not in the zone.
+func (p denialProof) nsecCover(name string) *nsecRecord {
+	for i, n := range p.nsec {
+		if n.owner != name && inZone(name, n.owner) && delegation(n.bitmap) {
+			continue
+		}
+		if covers(n.owner, n.next, name, canonicalCompare) {
+			return &p.nsec[i]
+		}
+	}
+	return nil
+}
+
+// nsecEncloser returns the closest encloser of a name that the NSEC
+// record n proves missing: the longest ancestor it shares with the owner
+// or the next name of n.
+func nsecEncloser(name string, n *nsecRecord) string {
+	ce := commonAncestor(name, n.owner)
+	if c := commonAncestor(name, n.next); len(c) > len(ce) {
+		ce = c
+	}
+	return ce
+}
+
+func (p denialProof) nsec3Match(name string) *nsec3Record {
+	for i := range p.nsec3 {
+		n := &p.nsec3[i]
+		if inZone(name, n.zone) && n.owner == n.hash(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func (p denialProof) nsec3Cover(name string) *nsec3Record {
+	for i := range p.nsec3 {
+		n := &p.nsec3[i]
+		if inZone(name, n.zone) && covers(n.owner, n.next, n.hash(name), strings.Compare) {
+			return n
+		}
+	}
+	return nil
+}
+
+// closestEncloser checks the NSEC3 closest encloser proof for name of RFC
+// 5155 section 8.3: a record matching its closest existing ancestor and
+// one covering the next closer name below that. It returns the closest
+// encloser and the record covering the next closer name.
+func (p denialProof) closestEncloser(name string) (string, *nsec3Record, bool) {
+	labels := splitLabels(name)
+	for i := 1; i <= len(labels); i++ {
+		ce := strings.Join(labels[i:], ".")
+		m := p.nsec3Match(ce)
+		if m == nil {
+			continue
+		}
+		if delegation(m.bitmap) {
+			return "", nil, false
+		}
+		cover := p.nsec3Cover(strings.Join(labels[i-1:], "."))
+		return ce, cover, cover != nil
+	}
+	return "", nil, false
+}
+
+// noType checks the bitmap of the NSEC or NSEC3 record matching name for
+// a NODATA answer to a query of type qtype.
+func noType(name string, qtype uint16, bitmap []byte) (dnssecStatus, error) {
+	switch {
+	case hasType(bitmap, qtype) || hasType(bitmap, dnsTypeCNAME):
+		return dnssecBogus, fmt.Errorf("denial of %s %s lists the type", name, typeName(qtype))
+	case qtype == dnsTypeDS && hasType(bitmap, dnsTypeSOA):
+		return dnssecBogus, fmt.Errorf("denial of DS for %s comes from the child zone", name)
+	case qtype != dnsTypeDS && delegation(bitmap):
+		return dnssecBogus, fmt.Errorf("denial of %s %s comes from the parent side of a delegation", name, typeName(qtype))
+	}
+	return dnssecSecure, nil
+}
+
+// proveNXDOMAIN checks the proof that name does not exist, which also has
+// to rule out a wildcard at its closest encloser.
+func (p denialProof) proveNXDOMAIN(name string) (dnssecStatus, error) {
+	if n := p.nsecCover(name); n != nil {
+		ce := nsecEncloser(name, n)
+		if p.nsecCover(wildcardOf(ce)) == nil {
+			return dnssecBogus, fmt.Errorf("no NSEC proof that %s does not exist", wildcardOf(ce))
+		}
+		return dnssecSecure, nil
+	}
+	if len(p.nsec3) > 0 {
+		if p.costly {
+			return dnssecInsecure, nil
+		}
+		ce, cover, ok := p.closestEncloser(name)
+		if !ok {
+			return dnssecBogus, fmt.Errorf("no NSEC3 closest encloser proof for %s", name)
+		}
+		if p.nsec3Cover(wildcardOf(ce)) == nil {
+			return dnssecBogus, fmt.Errorf("no NSEC3 proof that %s does not exist", wildcardOf(ce))
+		}
+		if cover.optOut {
+			return dnssecInsecure, nil
+		}
+		return dnssecSecure, nil
+	}
+	return dnssecBogus, fmt.Errorf("no NSEC or NSEC3 proof that %s does not exist", name)
+}
+
+// proveNODATA checks the proof that name has no records of type qtype,
+// either itself or through a wildcard.
+func (p denialProof) proveNODATA(name string, qtype uint16) (dnssecStatus, error) {
+	if n := p.nsecMatch(name); n != nil {
+		return noType(name, qtype, n.bitmap)
+	}
+	for _, n := range p.nsec {
+		if n.next != name && inZone(n.next, name) && covers(n.owner, n.next, name, canonicalCompare) {
+			// name is an empty non-terminal.
+			return dnssecSecure, nil
+		}
+	}
+	if n := p.nsecCover(name); n != nil {
+		if w := p.nsecMatch(wildcardOf(nsecEncloser(name, n))); w != nil {
+			return noType(name, qtype, w.bitmap)
+		}
+	}
+	if len(p.nsec3) > 0 {
+		if p.costly {
+			return dnssecInsecure, nil
+		}
+		if n := p.nsec3Match(name); n != nil {
+			return noType(name, qtype, n.bitmap)
+		}
+		if ce, cover, ok := p.closestEncloser(name); ok {
+			if qtype == dnsTypeDS && cover.optOut {
+				// An unsigned delegation in an opt-out span.
+				return dnssecInsecure, nil
+			}
+			if w := p.nsec3Match(wildcardOf(ce)); w != nil {
+				return noType(name, qtype, w.bitmap)
+			}
+		}
+	}
+	return dnssecBogus, fmt.Errorf("no NSEC or NSEC3 proof that %s has no %s records", name, typeName(qtype))
+}
+
+// proveWildcard checks the proof that name, answered from the wildcard
+// under its ancestor of the given number of labels, does not exist
+// itself.
+func (p denialProof) proveWildcard(name string, labels int) (dnssecStatus, error) {
+	if p.nsecCover(name) != nil {
+		return dnssecSecure, nil
+	}
+	if len(p.nsec3) > 0 {
+		if p.costly {
+			return dnssecInsecure, nil
+		}
+		l := splitLabels(name)
+		if n := p.nsec3Cover(strings.Join(l[len(l)-labels-1:], ".")); n != nil {
+			if n.optOut {
+				return dnssecInsecure, nil
+			}
+			return dnssecSecure, nil
+		}
+	}
+	return dnssecBogus, fmt.Errorf("no proof that %s does not exist for its wildcard answer", name)
+}
+
+// wildcardLabels reports whether the signatures over set show that it was
+// synthesized from a wildcard, and the labels of the wildcard's parent.
+func wildcardLabels(set *rrset) (int, bool) {
+	labels := splitLabels(set.name)
+	if len(labels) > 0 && labels[0] == "*" {
+		labels = labels[1:]
+	}
+	n := len(labels)
+	for _, rr := range set.sigs {
+		if sig, err := parseRRSIG(rr); err == nil && int(sig.labels) < n {
+			n = int(sig.labels)
+		}
+	}
+	return n, n < len(labels)
+}
+
+// deniedName follows the CNAME records in answer from the question name
+// and returns the name at the end of the chain when the answer has no
+// records of the type asked for there.
+func deniedName(q dnsQuestion, answer []dnsRR) (string, bool) {
+	name := canonicalName(q.Name)
+	for range 16 {
+		target := ""
+		for _, rr := range answer {
+			if canonicalName(rr.Name) != name {
+				continue
+			}
+			switch {
+			case rr.Rrtype == q.Qtype || q.Qtype == dnsTypeANY && rr.Rrtype != dnsTypeRRSIG:
+				return "", false
+			case rr.Rrtype == dnsTypeCNAME:
+				if t, _, err := getDomainName(rr.Data, 0); err == nil {
+					target = canonicalName(t)
+				}
+			}
+		}
+		if target == "" {
+			return name, true
+		}
+		name = target
+	}
+	return "", false
+}
+
+// validateReply checks the DNSSEC signatures in an upstream reply and
+// sets its AD bit when all of it is secure. An error means the reply is
+// bogus. Denials, and answers synthesized from wildcards, must come with
+// signed NSEC or NSEC3 records that prove the missing names or types.
+// The records needed for validation are fetched under ctx.
+func validateReply(ctx context.Context, g upstreamGroup, query, msg dnsMsg) (dnsMsg, error) {
+	msg.authenticated_data = false
+	if len(query.question) != 1 || msg.rcode != dnsRcodeSuccess && msg.rcode != dnsRcodeNameError {
+		return msg, nil
+	}
+	v := &validator{ctx: ctx, upstreams: g, busy: make(map[string]bool)}
+	secure := true
+	var proof []dnsRR
+	for _, set := range rrsets(msg.ns) {
+		if len(set.sigs) == 0 {
+			continue
+		}
+		st, err := v.verifyRRset(set)
+		if st == dnssecBogus {
+			return msg, err
+		}
+		if st == dnssecSecure {
+			proof = append(proof, set.rrs...)
+		}
+		secure = secure && st == dnssecSecure
+	}
+	p := newDenialProof(proof)
+	for _, set := range rrsets(msg.answer) {
+		var st dnssecStatus
+		var err error
+		if len(set.sigs) == 0 {
+			st, err = v.nameStatus(set.name)
+			if st == dnssecSecure {
+				st, err = dnssecBogus, fmt.Errorf("unsigned %s %s in a signed zone", set.name, typeName(set.rrtype))
+			}
+		} else {
+			st, err = v.verifyRRset(set)
+			if labels, ok := wildcardLabels(set); ok && st == dnssecSecure {
+				st, err = p.proveWildcard(set.name, labels)
+			}
+		}
+		if st == dnssecBogus {
+			return msg, err
+		}
+		secure = secure && st == dnssecSecure
+	}
+	q := query.question[0]
+	if name, ok := deniedName(q, msg.answer); ok {
+		var st dnssecStatus
+		var err error
+		switch {
+		case len(proof) == 0:
+			st, err = v.nameStatus(name)
+			if st == dnssecSecure {
+				st, err = dnssecBogus, fmt.Errorf("unsigned denial for %s in a signed zone", name)
+			}
+		case msg.rcode == dnsRcodeNameError:
+			st, err = p.proveNXDOMAIN(name)
+		default:
+			st, err = p.proveNODATA(name, q.Qtype)
+		}
+		if st == dnssecBogus {
+			return msg, err
+		}
+		secure = secure && st == dnssecSecure
+	}
+	msg.authenticated_data = secure
+	return msg, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signRRset signs rrs, owned by zone, with the Ed25519 key tagged tag.
+func signRRset(t *testing.T, priv ed25519.PrivateKey, zone string, tag uint16, rrs []dnsRR) dnsRR {
+	t.Helper()
+	now := uint32(time.Now().Unix())
+	d := binary.BigEndian.AppendUint16(nil, rrs[0].Rrtype)
+	d = append(d, 15, byte(len(splitLabels(rrs[0].Name))))
+	d = binary.BigEndian.AppendUint32(d, 3600)
+	d = binary.BigEndian.AppendUint32(d, now+3600)
+	d = binary.BigEndian.AppendUint32(d, now-3600)
+	d = binary.BigEndian.AppendUint16(d, tag)
+	d = packDomainName(d, zone)
+	rr := dnsRR{Name: rrs[0].Name, Rrtype: dnsTypeRRSIG, Class: dnsClassINET, Ttl: 3600, Data: d}
+	sig, err := parseRRSIG(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr.Data = append(d, ed25519.Sign(priv, sig.signedData(rrs))...)
+	rr.Rdlength = uint16(len(rr.Data))
+	return rr
+}
+
+// TestShortDNSKEY checks that a record too short to be a key, published
+// in a correctly signed DNSKEY RRset, is left out of the zone keys.
+func TestShortDNSKEY(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := dnsRR{Name: "", Rrtype: dnsTypeDNSKEY, Class: dnsClassINET, Ttl: 3600, Data: append([]byte{1, 1, 3, 15}, pub...)}
+	short := dnsRR{Name: "", Rrtype: dnsTypeDNSKEY, Class: dnsClassINET, Ttl: 3600, Data: []byte{1, 1}}
+	keys := []dnsRR{key, short}
+	for i := range keys {
+		keys[i].Rdlength = uint16(len(keys[i].Data))
+	}
+
+	digest := sha256.Sum256(append(packDomainName(nil, ""), key.Data...))
+	ds := dnsRR{Rrtype: dnsTypeDS, Class: dnsClassINET, Data: append(binary.BigEndian.AppendUint16(nil, keyTag(key.Data)), append([]byte{15, 2}, digest[:]...)...)}
+	saved := trustAnchors
+	trustAnchors = []dnsRR{ds}
+	t.Cleanup(func() { trustAnchors = saved })
+
+	var msg dnsMsg
+	msg.response = true
+	msg.answer = append(keys, signRRset(t, priv, "", keyTag(key.Data), keys))
+	dnssecCache.Lock()
+	clear(dnssecCache.m)
+	dnssecCache.Unlock()
+	dnssecCachePut("/"+strconv.Itoa(dnsTypeDNSKEY), dnssecEntry{msg: msg}, 3600)
+
+	v := &validator{ctx: context.Background(), busy: make(map[string]bool)}
+	got, st, err := v.zoneKeys("")
+	if st != dnssecSecure || err != nil || len(got) != 1 {
+		t.Fatalf("zone keys: %d keys, status %v, %v", len(got), st, err)
+	}
+
+	// A signature naming the tag of the short record must fail, not
+	// panic.
+	a := dnsRR{Name: "example", Rrtype: dnsTypeA, Class: dnsClassINET, Ttl: 3600, Data: []byte{192, 0, 2, 1}, Rdlength: 4}
+	set := &rrset{name: "example", rrtype: dnsTypeA, rrs: []dnsRR{a}, sigs: []dnsRR{signRRset(t, priv, "", keyTag(short.Data), []dnsRR{a})}}
+	if st, err := v.verifyRRset(set); st != dnssecBogus {
+		t.Errorf("signature by the short key: status %v, %v", st, err)
+	}
+	if err := (rrsig{alg: 15, expiration: ^uint32(0) >> 1}).verify(short, []dnsRR{a}); err == nil {
+		t.Error("verify with a 2-byte key succeeded")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	dnstapSocket   = flag.String("dnstap-socket", "", "send dnstap client query and response events to the Frame Streams reader on this unix socket")
+	dnstapFile     = flag.String("dnstap-file", "", "write dnstap client query and response events to this Frame Streams file")
+	dnstapIdentity = flag.String("dnstap-identity", "", "server identity in dnstap events, by default the hostname")
+)
+
+// Values from dnstap.proto.
+const (
+	dnstapTypeMessage = 1
+
+	dnstapClientQuery    = 5
+	dnstapClientResponse = 6
+
+	dnstapFamilyINET  = 1
+	dnstapFamilyINET6 = 2
+
+	dnstapUDP = 1
+	dnstapTCP = 2
+	dnstapDOT = 3
+	dnstapDOH = 4
+)
+
+// Frame Streams control frames.
+const (
+	fstrmAccept = 0x01
+	fstrmStart  = 0x02
+	fstrmStop   = 0x03
+	fstrmReady  = 0x04
+	fstrmFinish = 0x05
+
+	fstrmContentType = 0x01
+)
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+var (
+	dnstapEvents  chan []byte
+	dnstapStopped chan struct{}
+)
+
+func setupDnstap() {
+	if *dnstapSocket == "" && *dnstapFile == "" {
+		return
+	}
+	if *dnstapSocket != "" && *dnstapFile != "" {
+		log.Fatal("use only one of -dnstap-socket and -dnstap-file")
+	}
+	if *dnstapIdentity == "" {
+		*dnstapIdentity, _ = os.Hostname()
+	}
+	dnstapEvents = make(chan []byte, 1000)
+	dnstapStopped = make(chan struct{})
+	if *dnstapFile != "" {
+		f, err := os.Create(*dnstapFile)
+		if err != nil {
+			log.Fatalf("dnstap: %v", err)
+		}
+		go func() {
+			dnstapWrite(f)
+			f.Close()
+			close(dnstapStopped)
+		}()
+		infof("Writing dnstap events to %s", *dnstapFile)
+		return
+	}
+	go dnstapConnect()
+	infof("Sending dnstap events to %s", *dnstapSocket)
+}
+
+// dnstapConnect keeps a connection to the -dnstap-socket reader,
+// reconnecting after errors. Events are dropped while it is down.
+func dnstapConnect() {
+	defer close(dnstapStopped)
+	for backoff := time.Second; ; backoff = min(2*backoff, time.Minute) {
+		conn, err := net.Dial("unix", *dnstapSocket)
+		if err == nil {
+			if err = fstrmHandshake(conn); err == nil {
+				backoff = time.Second
+				if dnstapWrite(conn) {
+					conn.Close()
+					return
+				}
+			}
+			conn.Close()
+		}
+		if err != nil {
+			warnf("dnstap: %v, retrying in %v", err, backoff)
+		}
+		deadline := time.After(backoff)
+	drain:
+		for {
+			select {
+			case _, ok := <-dnstapEvents:
+				if !ok {
+					return
+				}
+			case <-deadline:
+				break drain
+			}
+		}
+	}
+}
+
+// fstrmControl returns a control frame, with the dnstap content type for
+// the frames that carry one.
+func fstrmControl(typ uint32) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, typ)
+	if typ != fstrmStop && typ != fstrmFinish {
+		payload = binary.BigEndian.AppendUint32(payload, fstrmContentType)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(dnstapContentType)))
+		payload = append(payload, dnstapContentType...)
+	}
+	frame := binary.BigEndian.AppendUint32(nil, 0)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// fstrmHandshake offers the dnstap content type to a bidirectional
+// reader and waits for it to accept.
+func fstrmHandshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(*queryTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(fstrmControl(fstrmReady)); err != nil {
+		return err
+	}
+	var hdr [12]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(hdr[:]) != 0 || binary.BigEndian.Uint32(hdr[8:]) != fstrmAccept {
+		return errors.New("reader did not accept the dnstap stream")
+	}
+	// Skip the content types the reader lists.
+	if _, err := io.CopyN(io.Discard, conn, int64(binary.BigEndian.Uint32(hdr[4:]))-4); err != nil {
+		return err
+	}
+	return nil
+}
+
+// dnstapWrite writes a Frame Streams stream of the queued events to w
+// until the queue is closed at shutdown, which it reports, or a write
+// fails.
+func dnstapWrite(w io.Writer) bool {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(fstrmControl(fstrmStart)); err != nil {
+		return false
+	}
+	for {
+		var ev []byte
+		var ok bool
+		select {
+		case ev, ok = <-dnstapEvents:
+		default:
+			// Flush whenever the queue runs empty.
+			if err := bw.Flush(); err != nil {
+				errorf("dnstap: %v", err)
+				return false
+			}
+			ev, ok = <-dnstapEvents
+		}
+		if !ok {
+			bw.Write(fstrmControl(fstrmStop))
+			bw.Flush()
+			return true
+		}
+		bw.Write(binary.BigEndian.AppendUint32(nil, uint32(len(ev))))
+		if _, err := bw.Write(ev); err != nil {
+			errorf("dnstap: %v", err)
+			return false
+		}
+	}
+}
+
+// stopDnstap ends the stream at shutdown.
+func stopDnstap() {
+	if dnstapEvents == nil {
+		return
+	}
+	close(dnstapEvents)
+	select {
+	case <-dnstapStopped:
+	case <-time.After(time.Second):
+	}
+}
+
+// dnstapProtocol returns the dnstap transport of a query arriving on
+// conn, which is nil for UDP.
+func dnstapProtocol(conn net.Conn) int {
+	switch conn.(type) {
+	case nil:
+		return dnstapUDP
+	case *tls.Conn:
+		return dnstapDOT
+	}
+	return dnstapTCP
+}
+
+// tap queues a client query or response event. Events are dropped when
+// the queue is full rather than slowing down answers. The query message
+// and time are those of the query a response answers.
+func tap(typ, proto int, addr net.Addr, queryTime time.Time, query, reply []byte) {
+	if dnstapEvents == nil || stopping.Load() {
+		return
+	}
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	}
+	var m []byte
+	m = appendProtoVarint(m, 1, uint64(typ))
+	if ip4 := ip.To4(); ip4 != nil {
+		m = appendProtoVarint(m, 2, dnstapFamilyINET)
+		m = appendProtoBytes(m, 4, ip4)
+	} else if ip != nil {
+		m = appendProtoVarint(m, 2, dnstapFamilyINET6)
+		m = appendProtoBytes(m, 4, ip)
+	}
+	m = appendProtoVarint(m, 3, uint64(proto))
+	if ip != nil {
+		m = appendProtoVarint(m, 6, uint64(port))
+	}
+	m = appendProtoVarint(m, 8, uint64(queryTime.Unix()))
+	m = appendProtoFixed32(m, 9, uint32(queryTime.Nanosecond()))
+	if query != nil {
+		m = appendProtoBytes(m, 10, query)
+	}
+	if typ == dnstapClientResponse {
+		now := time.Now()
+		m = appendProtoVarint(m, 12, uint64(now.Unix()))
+		m = appendProtoFixed32(m, 13, uint32(now.Nanosecond()))
+		m = appendProtoBytes(m, 14, reply)
+	}
+
+	var ev []byte
+	ev = appendProtoBytes(ev, 1, []byte(*dnstapIdentity))
+	ev = appendProtoBytes(ev, 2, []byte("dns2tcp"))
+	ev = appendProtoBytes(ev, 14, m)
+	ev = appendProtoVarint(ev, 15, dnstapTypeMessage)
+	select {
+	case dnstapEvents <- ev:
+	default:
+	}
+}
+
+// Protocol Buffers wire format, enough for the dnstap messages.
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoFixed32(b []byte, field int, v uint32) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+var (
+	dohListen = flag.String("doh-listen", "", "serve DNS-over-HTTPS (RFC 8484) on this address, e.g. :443")
+	dohPath   = flag.String("doh-path", "/dns-query", "URL path of the DNS-over-HTTPS endpoint")
+)
+
+const dnsMessageType = "application/dns-message"
+
+func startDoH() {
+	if *dohListen == "" {
+		return
+	}
+	cfg, err := serverTLSConfig()
+	if err != nil {
+		log.Fatalf("DoH: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(*dohPath, dohHandler)
+	srv := &http.Server{
+		Handler:      mux,
+		TLSConfig:    cfg,
+		ReadTimeout:  *tcpIdleTimeout,
+		WriteTimeout: *queryTimeout + time.Second,
+		ErrorLog:     log.Default(),
+	}
+	l := listenTCP(*dohListen)
+	infof("Serving DNS-over-HTTPS on %s%s", *dohListen, *dohPath)
+	go func() {
+		if err := srv.ServeTLS(l, "", ""); err != nil && !stopping.Load() {
+			log.Fatalf("DoH: %v", err)
+		}
+	}()
+}
+
+// dohHandler answers GET requests with a base64url dns parameter and POST
+// requests with a DNS message body.
+func dohHandler(w http.ResponseWriter, r *http.Request) {
+	var data []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		data, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(r.Body, 65535))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(data) == 0 {
+		http.Error(w, "bad dns parameter", http.StatusBadRequest)
+		return
+	}
+
+	var client net.IP
+	var addr net.Addr
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		a := net.TCPAddrFromAddrPort(ap)
+		client, addr = a.IP, a
+	}
+	debugf("Data come in from: https %s", r.RemoteAddr)
+	if overloaded(addr) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		return
+	}
+	if !beginQuery() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	start := time.Now()
+	tap(dnstapClientQuery, dnstapDOH, addr, start, data, nil)
+	capturePacket(addr, local, data, true)
+	reply := dnsRequest(r.Context(), data, client, viewFor(client))
+	endQuery(reply != nil, start)
+	if reply != nil {
+		reply = padReply(data, reply)
+		tap(dnstapClientResponse, dnstapDOH, addr, start, data, reply)
+		capturePacket(addr, local, reply, false)
+	}
+	if reply == nil {
+		if _, err := parseDNSMsg(data); err != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+		} else {
+			http.Error(w, "query refused", http.StatusForbidden)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	if msg, err := parseDNSMsg(reply); err == nil {
+		// Let HTTP caches keep the answer no longer than its records.
+		if ttl, ok := minTTL(msg); ok {
+			w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl)))
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(reply)))
+	w.Write(reply)
+}
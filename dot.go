@@ -0,0 +1,23 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log"
+)
+
+var dotListen = flag.String("dot-listen", "", "serve DNS-over-TLS (RFC 7858) on this address, e.g. :853")
+
+func startDoT() {
+	if *dotListen == "" {
+		return
+	}
+	cfg, err := serverTLSConfig()
+	if err != nil {
+		log.Fatalf("DoT: %v", err)
+	}
+	cfg = cfg.Clone()
+	cfg.NextProtos = []string{"dot"}
+	infof("Serving DNS-over-TLS on %s", *dotListen)
+	go dnsListenTCP(tls.NewListener(listenTCP(*dotListen), cfg), nil)
+}
@@ -0,0 +1,64 @@
+//go:build !windows
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+var (
+	runUser   = flag.String("user", "", "switch to this user after binding the listening sockets")
+	runGroup  = flag.String("group", "", "switch to this group after binding the listening sockets, by default the primary group of -user")
+	runChroot = flag.String("chroot", "", "chroot to this directory after binding the listening sockets; files read later, such as hosts files and blocklists, must be inside it")
+)
+
+// dropPrivileges gives up root once every socket is bound, so that a bug
+// in the packet parsing cannot be used to take over the machine.
+func dropPrivileges() {
+	if *runUser == "" && *runGroup == "" && *runChroot == "" {
+		return
+	}
+	uid, gid := -1, -1
+	if *runUser != "" {
+		u, err := user.Lookup(*runUser)
+		if err != nil {
+			log.Fatalf("bad -user: %v", err)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if *runGroup != "" {
+		g, err := user.LookupGroup(*runGroup)
+		if err != nil {
+			log.Fatalf("bad -group: %v", err)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if *runChroot != "" {
+		if err := syscall.Chroot(*runChroot); err != nil {
+			log.Fatalf("chroot %s: %v", *runChroot, err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			log.Fatalf("chroot %s: %v", *runChroot, err)
+		}
+	}
+	// The group goes first: without root it can no longer be changed.
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			log.Fatalf("setgroups: %v", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			log.Fatalf("setgid %d: %v", gid, err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			log.Fatalf("setuid %d: %v", uid, err)
+		}
+	}
+	infof("Dropped privileges to uid %d, gid %d", syscall.Getuid(), syscall.Getgid())
+}
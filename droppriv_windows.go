@@ -0,0 +1,18 @@
+package main
+
+import (
+	"flag"
+	"log"
+)
+
+var (
+	runUser   = flag.String("user", "", "not supported on Windows; run the service under a restricted account instead")
+	runGroup  = flag.String("group", "", "not supported on Windows")
+	runChroot = flag.String("chroot", "", "not supported on Windows")
+)
+
+func dropPrivileges() {
+	if *runUser != "" || *runGroup != "" || *runChroot != "" {
+		log.Fatal("-user, -group and -chroot are not supported on Windows")
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The end-to-end tests run the whole proxy on loopback ports in front of
+// fake upstreams. The first upstream is a closed port, so every answer
+// also goes through failover.
+
+// fakeUpstream is a DNS over TCP server answering with fakeAnswer.
+type fakeUpstream struct {
+	ln      net.Listener
+	queries sync.Map // name -> *atomic.Int32
+}
+
+func startFakeUpstream(t testing.TB) *fakeUpstream {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeUpstream{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeUpstream) addr() string {
+	return f.ln.Addr().String()
+}
+
+// count returns how many queries for name the upstream got.
+func (f *fakeUpstream) count(name string) int32 {
+	n, _ := f.queries.LoadOrStore(name, new(atomic.Int32))
+	return n.(*atomic.Int32).Load()
+}
+
+func (f *fakeUpstream) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+		query, err := parseDNSMsg(data)
+		if err != nil || len(query.question) != 1 {
+			return
+		}
+		name := canonicalName(query.question[0].Name)
+		n, _ := f.queries.LoadOrStore(name, new(atomic.Int32))
+		n.(*atomic.Int32).Add(1)
+		reply, ok := fakeAnswer(query)
+		if !ok {
+			// Hold the query until the proxy gives up.
+			io.Copy(io.Discard, conn)
+			return
+		}
+		out := packDNSMsg(reply)
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...)); err != nil {
+			return
+		}
+	}
+}
+
+// fakeAnswer answers query by its name: names under nx.example.com do
+// not exist, those under slow.example.com get no answer, those under
+// random.example.com get randomAnswer, and all others have the addresses
+// 192.0.2.1 and 2001:db8::1.
+func fakeAnswer(query dnsMsg) (dnsMsg, bool) {
+	q := query.question[0]
+	name := canonicalName(q.Name)
+	switch {
+	case strings.HasSuffix(name, ".slow.example.com"):
+		return dnsMsg{}, false
+	case strings.HasSuffix(name, ".nx.example.com"):
+		return newReply(query, dnsRcodeNameError), true
+	case strings.HasSuffix(name, ".random.example.com"):
+		return randomAnswer(query), true
+	}
+	reply := newReply(query, dnsRcodeSuccess)
+	reply.recursion_available = true
+	switch q.Qtype {
+	case dnsTypeA:
+		reply.answer = addressRRs(q.Name, q.Qtype, []net.IP{net.ParseIP("192.0.2.1")})
+	case dnsTypeAAAA:
+		reply.answer = addressRRs(q.Name, q.Qtype, []net.IP{net.ParseIP("2001:db8::1")})
+	}
+	return reply, true
+}
+
+// freePort returns a port that is free for both UDP and TCP on loopback.
+func freePort(t testing.TB) string {
+	for range 10 {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := pc.LocalAddr().String()
+		ln, err := net.Listen("tcp", addr)
+		pc.Close()
+		if err == nil {
+			ln.Close()
+			return addr
+		}
+	}
+	t.Fatal("no free port")
+	return ""
+}
+
+var e2eProxy struct {
+	once     sync.Once
+	addr     string
+	upstream *fakeUpstream
+}
+
+// startProxy starts the proxy once for all the tests and returns its
+// address.
+func startProxy(t testing.TB) string {
+	e2eProxy.once.Do(func() {
+		e2eProxy.upstream = startFakeUpstream(t)
+		slow := startFakeUpstream(t)
+		dead := freePort(t)
+		e2eProxy.addr = freePort(t)
+		for name, value := range map[string]string{
+			"listen":            e2eProxy.addr,
+			"upstream":          dead + "," + e2eProxy.upstream.addr(),
+			"route":             "slow.example.com=" + slow.addr(),
+			"timeout":           "300ms",
+			"upstream-cooldown": "1m",
+			"mdns":              "false",
+			"log-level":         "error",
+		} {
+			if err := flag.Set(name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		go serve()
+		for range 50 {
+			if conn, err := net.Dial("tcp", e2eProxy.addr); err == nil {
+				conn.Close()
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("proxy did not start")
+	})
+	if e2eProxy.upstream == nil {
+		t.Skip("proxy failed to start")
+	}
+	return e2eProxy.addr
+}
+
+// ask sends a query for name over network, "udp" or "tcp", to the proxy
+// and returns the parsed reply.
+func ask(t testing.TB, network, name string, qtype uint16) dnsMsg {
+	t.Helper()
+	addr := startProxy(t)
+	var query dnsMsg
+	query.id = 0x5eed
+	query.recursion_desired = true
+	query.question = []dnsQuestion{{Name: name, Qtype: qtype, Qclass: dnsClassINET}}
+	data := packDNSMsg(query)
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	reply := make([]byte, 65535)
+	var n int
+	if network == "tcp" {
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(data))), data...)); err != nil {
+			t.Fatal(err)
+		}
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			t.Fatal(err)
+		}
+		n, err = io.ReadFull(conn, reply[:length])
+	} else {
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		n, err = conn.Read(reply)
+	}
+	if err != nil {
+		t.Fatalf("%s %s: %v", network, name, err)
+	}
+	msg, err := parseDNSMsg(reply[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.id != query.id || !msg.response {
+		t.Fatalf("reply id %#x response %v does not match the query", msg.id, msg.response)
+	}
+	return msg
+}
+
+func wantAddress(t *testing.T, msg dnsMsg, want string) {
+	t.Helper()
+	if msg.rcode != dnsRcodeSuccess || len(msg.answer) != 1 {
+		t.Fatalf("rcode %d with %d answers, want one address", msg.rcode, len(msg.answer))
+	}
+	if got := net.IP(msg.answer[0].Data).String(); got != want {
+		t.Errorf("answer %s, want %s", got, want)
+	}
+}
+
+func TestEndToEndUDP(t *testing.T) {
+	wantAddress(t, ask(t, "udp", "udp.example.com", dnsTypeA), "192.0.2.1")
+}
+
+func TestEndToEndTCP(t *testing.T) {
+	wantAddress(t, ask(t, "tcp", "tcp.example.com", dnsTypeAAAA), "2001:db8::1")
+}
+
+func TestEndToEndNXDOMAIN(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		if msg := ask(t, network, network+".nx.example.com", dnsTypeA); msg.rcode != dnsRcodeNameError {
+			t.Errorf("%s: rcode %d, want NXDOMAIN", network, msg.rcode)
+		}
+	}
+}
+
+// TestEndToEndRRSIG checks that a query for RRSIG records, an ordinary
+// data type, is forwarded.
+func TestEndToEndRRSIG(t *testing.T) {
+	msg := ask(t, "udp", "rrsig.example.com", dnsTypeRRSIG)
+	if msg.rcode != dnsRcodeSuccess {
+		t.Errorf("rcode %d, want NOERROR", msg.rcode)
+	}
+	if n := e2eProxy.upstream.count("rrsig.example.com"); n != 1 {
+		t.Errorf("upstream saw %d queries, want 1", n)
+	}
+}
+
+func TestEndToEndFailover(t *testing.T) {
+	wantAddress(t, ask(t, "udp", "failover.example.com", dnsTypeA), "192.0.2.1")
+	var down, up int
+	for _, u := range knownUpstreams() {
+		switch {
+		case u.addr == e2eProxy.upstream.addr():
+			if !u.status().Healthy {
+				t.Errorf("upstream %s answered but is not healthy", u.addr)
+			}
+			up++
+		case !u.status().Healthy:
+			down++
+		}
+	}
+	if up != 1 || down == 0 {
+		t.Errorf("%d working and %d failed upstreams, want the closed port to have failed over", up, down)
+	}
+}
+
+func TestEndToEndTimeout(t *testing.T) {
+	start := time.Now()
+	msg := ask(t, "udp", "timeout.slow.example.com", dnsTypeA)
+	if msg.rcode != dnsRcodeServerFailure {
+		t.Errorf("rcode %d, want SERVFAIL", msg.rcode)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("SERVFAIL took %v", d)
+	}
+}
+
+func TestEndToEndCache(t *testing.T) {
+	for range 3 {
+		wantAddress(t, ask(t, "udp", "cached.example.com", dnsTypeA), "192.0.2.1")
+	}
+	if n := e2eProxy.upstream.count("cached.example.com"); n != 1 {
+		t.Errorf("upstream asked %d times, want once", n)
+	}
+}
+
+// randomAnswer makes up a reply to query from the name asked for, so
+// that the test can make the same reply again to compare with what the
+// proxy passed on.
+func randomAnswer(query dnsMsg) dnsMsg {
+	q := query.question[0]
+	h := fnv.New64a()
+	h.Write([]byte(canonicalName(q.Name)))
+	r := rand.New(rand.NewPCG(h.Sum64(), 0))
+	reply := newReply(query, dnsRcodeSuccess)
+	reply.recursion_available = r.IntN(2) == 0
+	reply.authoritative = r.IntN(2) == 0
+	if r.IntN(4) == 0 {
+		reply.rcode = dnsRcodeNameError
+	}
+	rdata := func(t uint16) []byte {
+		switch t {
+		case dnsTypeA:
+			return []byte{192, 0, 2, byte(r.IntN(256))}
+		case dnsTypeAAAA:
+			ip := net.ParseIP("2001:db8::")
+			ip[15] = byte(r.IntN(256))
+			return ip
+		case dnsTypeMX:
+			return packDomainName(binary.BigEndian.AppendUint16(nil, uint16(r.IntN(100))), fmt.Sprintf("mx%d.%s", r.IntN(10), q.Name))
+		case dnsTypeNS:
+			return packDomainName(nil, fmt.Sprintf("ns%d.example.net", r.IntN(10)))
+		case dnsTypeSOA:
+			b := packDomainName(nil, "ns1.example.net")
+			b = packDomainName(b, "hostmaster.example.net")
+			for range 5 {
+				b = binary.BigEndian.AppendUint32(b, r.Uint32())
+			}
+			return b
+		}
+		b := make([]byte, r.IntN(40))
+		for i := range b {
+			b[i] = byte(r.IntN(256))
+		}
+		return b
+	}
+	add := func(rrs *[]dnsRR, name string, t uint16) {
+		*rrs = append(*rrs, dnsRR{Name: name, Rrtype: t, Class: dnsClassINET, Ttl: uint32(60 + r.IntN(3600)), Data: rdata(t)})
+	}
+	if reply.rcode == dnsRcodeSuccess {
+		for range r.IntN(5) {
+			add(&reply.answer, q.Name, q.Qtype)
+		}
+	}
+	if len(reply.answer) == 0 {
+		add(&reply.ns, "random.example.com", dnsTypeSOA)
+	} else if r.IntN(2) == 0 {
+		add(&reply.ns, "random.example.com", dnsTypeNS)
+		add(&reply.extra, fmt.Sprintf("host%d.random.example.com", r.IntN(10)), dnsTypeA)
+	}
+	return reply
+}
+
+// sameRRs reports how the records the proxy returned differ from those
+// the upstream sent, allowing for the time spent in the proxy.
+func sameRRs(section string, got, want []dnsRR) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("%s: %d records, want %d", section, len(got), len(want))
+	}
+	for i := range got {
+		g, w := got[i], want[i]
+		switch {
+		case !strings.EqualFold(g.Name, w.Name) || g.Rrtype != w.Rrtype || g.Class != w.Class:
+			return fmt.Errorf("%s record %d: %s %d %d, want %s %d %d", section, i, g.Name, g.Class, g.Rrtype, w.Name, w.Class, w.Rrtype)
+		case g.Ttl > w.Ttl || g.Ttl+2 < w.Ttl:
+			return fmt.Errorf("%s record %d: TTL %d, want %d", section, i, g.Ttl, w.Ttl)
+		case !bytes.Equal(g.Data, w.Data):
+			return fmt.Errorf("%s record %d: rdata %x, want %x", section, i, g.Data, w.Data)
+		}
+	}
+	return nil
+}
+
+// TestEndToEndDifferential sends queries for made-up replies through the
+// proxy and checks that the header bits, rcode and records the client
+// parses are the ones the upstream sent.
+func TestEndToEndDifferential(t *testing.T) {
+	types := []uint16{dnsTypeA, dnsTypeAAAA, dnsTypeMX, dnsTypeTXT, 65280}
+	for i := range 200 {
+		network := []string{"udp", "tcp"}[i%2]
+		var query dnsMsg
+		query.question = []dnsQuestion{{Name: fmt.Sprintf("q%d.random.example.com", i), Qtype: types[i%len(types)], Qclass: dnsClassINET}}
+		want := randomAnswer(query)
+		got := ask(t, network, query.question[0].Name, query.question[0].Qtype)
+		if got.truncated {
+			continue
+		}
+		var errs []error
+		if got.rcode != want.rcode || got.recursion_available != want.recursion_available || got.authoritative != want.authoritative {
+			errs = append(errs, fmt.Errorf("rcode %d ra %v aa %v, want rcode %d ra %v aa %v", got.rcode, got.recursion_available, got.authoritative, want.rcode, want.recursion_available, want.authoritative))
+		}
+		errs = append(errs, sameRRs("answer", got.answer, want.answer), sameRRs("authority", got.ns, want.ns), sameRRs("additional", got.extra, want.extra))
+		if err := errors.Join(errs...); err != nil {
+			t.Errorf("%s %s: %v", network, query.question[0].Name, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import "flag"
+
+var ednsBufSize = flag.Uint("edns-bufsize", 1232, "EDNS0 UDP payload size advertised to upstreams and clients, and the largest UDP reply sent")
+
+// Without EDNS0 a UDP message may not exceed 512 bytes (RFC 1035).
+const minUDPSize = 512
+
+// ednsOPT returns the OPT pseudo-record of msg, if it has one.
+func ednsOPT(msg dnsMsg) *dnsRR {
+	for i, rr := range msg.extra {
+		if rr.Rrtype == dnsTypeOPT {
+			return &msg.extra[i]
+		}
+	}
+	return nil
+}
+
+// newOPT returns an OPT record advertising our payload size. The class
+// field carries the size; the TTL field the extended rcode and flags.
+func newOPT() dnsRR {
+	return dnsRR{Name: "", Rrtype: dnsTypeOPT, Class: uint16(max(*ednsBufSize, minUDPSize))}
+}
+
+// udpLimit returns the largest reply the client that sent query accepts
+// over UDP.
+func udpLimit(query dnsMsg) int {
+	limit := minUDPSize
+	if opt := ednsOPT(query); opt != nil {
+		limit = max(limit, min(int(opt.Class), int(*ednsBufSize)))
+	}
+	return limit
+}
+
+// upstreamQuery returns the query to forward, carrying an OPT record
+// with our own payload size in place of the client's. A validating proxy
+// also asks for DNSSEC records and for bogus data not to be withheld, and
+// with -minimize-queries the client's EDNS options are left out.
+func upstreamQuery(query dnsMsg, data []byte) []byte {
+	q := query
+	q.extra = append([]dnsRR{}, query.extra...)
+	opt := ednsOPT(q)
+	if opt == nil {
+		q.extra = append(q.extra, newOPT())
+		opt = &q.extra[len(q.extra)-1]
+	} else if opt.Class == uint16(max(*ednsBufSize, minUDPSize)) && !*dnssecValidate && (!*minimizeQueries || len(opt.Data) == 0) && !hasCookie(*opt) {
+		return data
+	}
+	opt.Class = uint16(max(*ednsBufSize, minUDPSize))
+	if *minimizeQueries {
+		opt.Data, opt.Rdlength = nil, 0
+	} else if hasCookie(*opt) {
+		// The client's cookie is for us, not for the upstream.
+		opt.Data = setEDNSOption(opt.Data, ednsOptionCookie, nil)
+		opt.Rdlength = uint16(len(opt.Data))
+	}
+	if *dnssecValidate {
+		opt.Ttl |= ednsDO
+		q.checking_disabled = true
+	}
+	return packDNSMsg(q)
+}
+
+// fitEDNS makes the OPT record of reply match whether the client used
+// EDNS0: clients that did not must not see one, clients that did expect
+// one back (RFC 6891 section 7). It reports whether reply changed.
+func fitEDNS(query, reply dnsMsg) (dnsMsg, bool) {
+	want := ednsOPT(query) != nil
+	opt := ednsOPT(reply)
+	switch {
+	case want && opt == nil:
+		reply.extra = append(append([]dnsRR{}, reply.extra...), newOPT())
+		return reply, true
+	case !want && opt != nil:
+		extra := make([]dnsRR, 0, len(reply.extra))
+		for _, rr := range reply.extra {
+			if rr.Rrtype != dnsTypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		reply.extra = extra
+		return reply, true
+	}
+	return reply, false
+}
+
+// truncateUDP cuts a reply that does not fit the client's UDP limit down
+// to its header, question and OPT record with the TC bit set, so that the
+// client retries over TCP. The OPT record keeps its DNS cookie.
+func truncateUDP(query dnsMsg, reply []byte) []byte {
+	limit := udpLimit(query)
+	if len(reply) <= limit {
+		return reply
+	}
+	msg, err := parseDNSMsg(reply)
+	if err != nil {
+		msg = newReply(query, dnsRcodeSuccess)
+	}
+	var cookie []byte
+	if opt := ednsOPT(msg); opt != nil {
+		cookie, _ = ednsOption(opt.Data, ednsOptionCookie)
+	}
+	msg.truncated = true
+	msg.answer, msg.ns = nil, nil
+	msg.extra = nil
+	if opt := ednsOPT(query); opt != nil {
+		msg.extra = []dnsRR{newOPT()}
+		msg.extra[0].Data = setEDNSOption(nil, ednsOptionCookie, cookie)
+		msg.extra[0].Rdlength = uint16(len(msg.extra[0].Data))
+	}
+	return packDNSMsg(msg)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+var fallbackFlag = flag.String("fallback-upstream", "", "comma-separated plain DNS servers, ip or ip:port, to send queries to over UDP as a last resort while no upstream can be reached, e.g. behind a captive portal; the upstreams are used again as soon as they answer")
+
+var fallbackServers []string
+
+// inFallback is set while queries go to the fallback servers.
+var inFallback atomic.Bool
+
+func setupFallback() {
+	for _, s := range strings.Split(*fallbackFlag, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if net.ParseIP(s) != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		host, _, err := net.SplitHostPort(s)
+		if err != nil || net.ParseIP(host) == nil {
+			log.Fatalf("bad -fallback-upstream %q, want an IP address", s)
+		}
+		fallbackServers = append(fallbackServers, s)
+	}
+	if len(fallbackServers) > 0 {
+		infof("Falling back to plain DNS at %s when no upstream can be reached", strings.Join(fallbackServers, ", "))
+	}
+}
+
+// anyHealthy reports whether an upstream of g is not cooling down after
+// a failure.
+func (g upstreamGroup) anyHealthy() bool {
+	for _, u := range g {
+		if u.healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeOrFallback exchanges data with the upstreams g and, when none
+// of them answers, with the -fallback-upstream servers. While in
+// fallback the upstreams are skipped until one of them ends its cooldown
+// and gets tried again. Failing upstreams also set off the captive
+// portal probe.
+func exchangeOrFallback(ctx context.Context, g upstreamGroup, data []byte) ([]byte, error) {
+	if !inFallback.Load() || g.anyHealthy() {
+		reply, err := g.exchangeContext(ctx, data)
+		if err == nil {
+			captivePortalGone()
+			if inFallback.CompareAndSwap(true, false) {
+				warnf("Upstreams are reachable again, no longer using the plain UDP fallback %s", strings.Join(fallbackServers, ", "))
+			}
+			return reply, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		suspectCaptivePortal()
+		if len(fallbackServers) == 0 {
+			return nil, err
+		}
+		if inFallback.CompareAndSwap(false, true) {
+			errorf("No upstream can be reached (%v), sending queries to the plain UDP fallback %s until they recover", err, strings.Join(fallbackServers, ", "))
+		}
+	}
+	var err error
+	for _, server := range fallbackServers {
+		var reply []byte
+		if reply, err = udpExchange(server, data); err == nil {
+			debugf("Answered from the fallback %s", server)
+			return reply, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		warnf("Fallback %s failed: %v", server, err)
+	}
+	return nil, err
+}
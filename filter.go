@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+)
+
+var (
+	filterTypeFlags stringList
+	refuseTypeFlags stringList
+	allowTypeFlags  stringList
+	refuseAction    = flag.String("refuse-type-action", "refused", "answer to queries for refused types: refused, notimp or drop")
+)
+
+func init() {
+	flag.Var(&filterTypeFlags, "filter-type", "strip records of these types, comma-separated, from upstream answers; ANY answers ANY queries with a minimal RFC 8482 reply instead (repeatable)")
+	flag.Var(&refuseTypeFlags, "refuse-type", "refuse queries for these types, comma-separated, e.g. ANY or TYPE10, before they reach the upstreams (repeatable)")
+	flag.Var(&allowTypeFlags, "allow-type", "refuse queries for every type but these, comma-separated, e.g. A,AAAA,CNAME,MX,TXT,PTR,SRV,HTTPS (repeatable)")
+}
+
+// The record types stripped for the default view.
+var filteredTypes map[uint16]bool
+
+// The query types refused at the listeners, and those allowed if only
+// some are.
+var refusedTypes, allowedTypes map[uint16]bool
+
+// TTL of the HINFO record answering ANY queries, as suggested in RFC 8482
+// section 4.2.
+const rfc8482TTL = 3600
+
+// parseTypeList parses comma-separated record type names such as AAAA
+// or TYPE65.
+func parseTypeList(specs []string) (map[uint16]bool, error) {
+	types := make(map[uint16]bool)
+	for _, spec := range specs {
+		for _, s := range strings.Split(spec, ",") {
+			if s = strings.ToUpper(strings.TrimSpace(s)); s == "" {
+				continue
+			}
+			t, ok := parseType(s)
+			if !ok {
+				return nil, fmt.Errorf("unknown record type %q", s)
+			}
+			types[t] = true
+		}
+	}
+	return types, nil
+}
+
+func setupFilters() {
+	var err error
+	if filteredTypes, err = parseTypeList(filterTypeFlags); err != nil {
+		log.Fatalf("bad -filter-type: %v", err)
+	}
+	if len(filteredTypes) > 0 {
+		infof("Filtering %d record types from answers", len(filteredTypes))
+	}
+	if refusedTypes, err = parseTypeList(refuseTypeFlags); err != nil {
+		log.Fatalf("bad -refuse-type: %v", err)
+	}
+	if allowedTypes, err = parseTypeList(allowTypeFlags); err != nil {
+		log.Fatalf("bad -allow-type: %v", err)
+	}
+	switch *refuseAction {
+	case "refused", "notimp", "drop":
+	default:
+		log.Fatalf("bad -refuse-type-action %q, want refused, notimp or drop", *refuseAction)
+	}
+}
+
+// typeRefused reports whether the query type is refused by -refuse-type
+// or -allow-type, and the reply to send if it is. A nil reply means the
+// query is dropped.
+func typeRefused(query dnsMsg) ([]byte, bool) {
+	t := query.question[0].Qtype
+	if !refusedTypes[t] && (len(allowedTypes) == 0 || allowedTypes[t]) {
+		return nil, false
+	}
+	debugf("Refused %v by type policy", query.question)
+	switch *refuseAction {
+	case "notimp":
+		return packDNSMsg(newReply(query, dnsRcodeNotImplemented)), true
+	case "drop":
+		return nil, true
+	}
+	return packDNSMsg(newReply(query, dnsRcodeRefused)), true
+}
+
+// anyAnswer answers ANY queries with a single synthesized HINFO record
+// (RFC 8482) when the view filters ANY, rather than forwarding them.
+func anyAnswer(query dnsMsg, v *view) []byte {
+	if !v.filter[dnsTypeANY] || len(query.question) != 1 || query.question[0].Qtype != dnsTypeANY {
+		return nil
+	}
+	q := query.question[0]
+	msg := newReply(query, dnsRcodeSuccess)
+	data := []byte{7, 'R', 'F', 'C', '8', '4', '8', '2', 0}
+	msg.answer = []dnsRR{{Name: q.Name, Rrtype: dnsTypeHINFO, Class: dnsClassINET, Ttl: rfc8482TTL, Rdlength: uint16(len(data)), Data: data}}
+	return packDNSMsg(msg)
+}
+
+// filterTypes removes the records of the types the view filters from the
+// answer and additional sections of reply. It reports whether reply
+// changed.
+func filterTypes(v *view, reply dnsMsg) (dnsMsg, bool) {
+	if len(v.filter) == 0 {
+		return reply, false
+	}
+	strip := func(rrs []dnsRR) []dnsRR {
+		out := make([]dnsRR, 0, len(rrs))
+		for _, rr := range rrs {
+			if rr.Rrtype == dnsTypeOPT || !v.filter[rr.Rrtype] {
+				out = append(out, rr)
+			}
+		}
+		return out
+	}
+	n := len(reply.answer) + len(reply.extra)
+	reply.answer, reply.extra = strip(reply.answer), strip(reply.extra)
+	return reply, len(reply.answer)+len(reply.extra) != n
+}
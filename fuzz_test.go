@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// fuzzSeeds returns well-formed and malformed messages to start fuzzing
+// from.
+func fuzzSeeds(t testing.TB) [][]byte {
+	var query dnsMsg
+	query.id = 0xBEEF
+	query.recursion_desired = true
+	query.question = []dnsQuestion{{Name: "example.com", Qtype: dnsTypeAAAA, Qclass: dnsClassINET}}
+	opt := newOPT()
+	opt.Ttl = ednsDO
+	query.extra = []dnsRR{opt}
+
+	seeds := [][]byte{packDNSMsg(query)}
+	for _, h := range []string{
+		// www.example.com CNAME cdn.example.com, its address and the SOA,
+		// with names compressed in the records and their rdata.
+		"12348180000100020001000103777777076578616d706c6503636f6d0000010001c00c000500010000012c00060363646ec010c02d000100010000003c0004c0000201c0100006000100000e100026026e73c0100a686f73746d6173746572c01078a3f17500001c2000000e10001275000000012c00002904d0000080000000",
+		// A pointer to itself.
+		"000100000001000000000000c00c00010001",
+		// A label running past the end.
+		"0001000000010000000000003f6162",
+		// More records than the message holds.
+		"00018180ffffffffffffffff",
+		// A reserved label type.
+		"000100000001000000000000800000010001",
+	} {
+		b, err := hex.DecodeString(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeds = append(seeds, b)
+	}
+	return seeds
+}
+
+func FuzzGetDomainName(f *testing.F) {
+	for _, s := range fuzzSeeds(f) {
+		f.Add(s, uint16(12))
+	}
+	f.Fuzz(func(t *testing.T, data []byte, cursor uint16) {
+		if int(cursor) >= len(data) {
+			return
+		}
+		name, off, err := getDomainName(data, int(cursor))
+		if err != nil {
+			return
+		}
+		if off <= int(cursor) || off > len(data) {
+			t.Fatalf("offset %d after reading %q at %d of %d bytes", off, name, cursor, len(data))
+		}
+		wire := packDomainName(nil, name)
+		if len(wire) > maxNameLen {
+			t.Fatalf("%q packs into %d bytes", name, len(wire))
+		}
+		again, off, err := getDomainName(wire, 0)
+		if err != nil || again != name || off != len(wire) {
+			t.Fatalf("%q packed and read again is %q, %d, %v", name, again, off, err)
+		}
+	})
+}
+
+func FuzzParseDNSMsg(f *testing.F) {
+	for _, s := range fuzzSeeds(f) {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := parseDNSMsg(data)
+		if err != nil {
+			return
+		}
+		again, err := parseDNSMsg(packDNSMsg(msg))
+		if err != nil {
+			t.Fatalf("packed message does not parse: %v\n%+v", err, msg)
+		}
+		if !reflect.DeepEqual(msg, again) {
+			t.Fatalf("round trip changed the message:\n%+v\n%+v", msg, again)
+		}
+	})
+}
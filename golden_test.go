@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the tests")
+
+// dumpMsg describes a parsed message one line per record, with the names
+// in rdata decoded.
+func dumpMsg(msg dnsMsg) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "id=%d opcode=%d rcode=%d", msg.id, msg.opcode, msg.rcode)
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"qr", msg.response},
+		{"aa", msg.authoritative},
+		{"tc", msg.truncated},
+		{"rd", msg.recursion_desired},
+		{"ra", msg.recursion_available},
+		{"ad", msg.authenticated_data},
+		{"cd", msg.checking_disabled},
+	} {
+		if f.set {
+			b.WriteString(" " + f.name)
+		}
+	}
+	b.WriteString("\n")
+	for _, q := range msg.question {
+		fmt.Fprintf(&b, "question: %s. %d %s\n", q.Name, q.Qclass, typeName(q.Qtype))
+	}
+	for _, sec := range []struct {
+		name string
+		rrs  []dnsRR
+	}{{"answer", msg.answer}, {"authority", msg.ns}, {"additional", msg.extra}} {
+		for _, rr := range sec.rrs {
+			fmt.Fprintf(&b, "%s: %s. %d %d %s %s\n", sec.name, rr.Name, rr.Ttl, rr.Class, typeName(rr.Rrtype), dumpRdata(rr))
+		}
+	}
+	return b.String()
+}
+
+func dumpRdata(rr dnsRR) string {
+	d := rr.Data
+	names := func(off, n int) string {
+		var s []string
+		for range n {
+			name, next, err := getDomainName(d, off)
+			if err != nil {
+				return "bad name: " + err.Error()
+			}
+			s = append(s, name+".")
+			off = next
+		}
+		if off < len(d) {
+			s = append(s, hex.EncodeToString(d[off:]))
+		}
+		return strings.Join(s, " ")
+	}
+	switch rr.Rrtype {
+	case dnsTypeA, dnsTypeAAAA:
+		return net.IP(d).String()
+	case dnsTypeNS, dnsTypeCNAME, dnsTypePTR:
+		return names(0, 1)
+	case dnsTypeSOA:
+		return names(0, 2)
+	case dnsTypeMX:
+		if len(d) >= 2 {
+			return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(d), names(2, 1))
+		}
+	case dnsTypeSRV:
+		if len(d) >= 6 {
+			return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(d), binary.BigEndian.Uint16(d[2:]), binary.BigEndian.Uint16(d[4:]), names(6, 1))
+		}
+	}
+	return hex.EncodeToString(d)
+}
+
+// TestGoldenMessages parses the messages in testdata/golden/*.hex and
+// compares them with the .golden files next to them. Run with -update to
+// write those after a deliberate change.
+func TestGoldenMessages(t *testing.T) {
+	files, err := filepath.Glob("testdata/golden/*.hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no golden messages")
+	}
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".hex"), func(t *testing.T) {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := hex.DecodeString(strings.TrimSpace(string(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := parseDNSMsg(data)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			got := dumpMsg(msg)
+			golden := strings.TrimSuffix(file, ".hex") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("parsed message differs from %s:\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+			// Packing the message must keep everything that was parsed.
+			again, err := parseDNSMsg(packDNSMsg(msg))
+			if err != nil {
+				t.Fatalf("parse after pack: %v", err)
+			}
+			if dumped := dumpMsg(again); dumped != got {
+				t.Errorf("pack and parse changed the message:\n%s", dumped)
+			}
+		})
+	}
+}
+
+// BenchmarkParseDNSMsg parses each of the golden messages in turn.
+func BenchmarkParseDNSMsg(b *testing.B) {
+	files, err := filepath.Glob("testdata/golden/*.hex")
+	if err != nil || len(files) == 0 {
+		b.Fatal("no golden messages")
+	}
+	var msgs [][]byte
+	for _, file := range files {
+		h, err := os.ReadFile(file)
+		if err != nil {
+			b.Fatal(err)
+		}
+		data, err := hex.DecodeString(strings.TrimSpace(string(h)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		msgs = append(msgs, data)
+	}
+	i := 0
+	for b.Loop() {
+		if _, err := parseDNSMsg(msgs[i]); err != nil {
+			b.Fatal(err)
+		}
+		i = (i + 1) % len(msgs)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var groupFlags stringList
+
+func init() {
+	flag.Var(&groupFlags, "client-group", `define a client group as "name=N;clients=CIDR|IP|MAC,...;blocklist=FILE|URL,...;global-blocklist=false;upstream=ADDR,...;safe-search=true" (repeatable, the first group a client is in applies); MAC addresses are found in the ARP table and the -dhcp-leases`)
+}
+
+// A clientGroup gives a set of devices their own blocklists, upstreams
+// and safe search setting, e.g. for the kids' devices.
+type clientGroup struct {
+	name string
+	nets []*net.IPNet
+	macs map[string]bool
+
+	sources         []*blocklistSource
+	blocked         atomic.Pointer[blockMatcher]
+	globalBlocklist bool
+
+	upstreams  upstreamGroup
+	safeSearch bool
+
+	// The views of the group, derived from each view to use its
+	// upstreams.
+	views map[*view]*view
+}
+
+var clientGroups []*clientGroup
+
+func parseClientGroup(spec string) (*clientGroup, error) {
+	g := &clientGroup{macs: make(map[string]bool), globalBlocklist: true}
+	for _, kv := range strings.Split(spec, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("bad client group option %q, want key=value", kv)
+		}
+		var err error
+		switch key {
+		case "name":
+			g.name = value
+		case "clients":
+			for _, c := range strings.Split(value, ",") {
+				c = strings.TrimSpace(c)
+				if mac, err := net.ParseMAC(c); err == nil {
+					g.macs[mac.String()] = true
+					continue
+				}
+				if ip := net.ParseIP(c); ip != nil {
+					c += "/128"
+					if ip.To4() != nil {
+						c = ip.String() + "/32"
+					}
+				}
+				_, n, err := net.ParseCIDR(c)
+				if err != nil {
+					return nil, err
+				}
+				g.nets = append(g.nets, n)
+			}
+		case "blocklist":
+			for _, loc := range strings.Split(value, ",") {
+				g.sources = append(g.sources, &blocklistSource{loc: strings.TrimSpace(loc)})
+			}
+		case "global-blocklist":
+			g.globalBlocklist, err = strconv.ParseBool(value)
+		case "upstream":
+			g.upstreams, err = parseUpstreams([]string{value})
+		case "safe-search":
+			g.safeSearch, err = strconv.ParseBool(value)
+		default:
+			return nil, fmt.Errorf("unknown client group option %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if g.name == "" {
+		return nil, fmt.Errorf("client group %q has no name", spec)
+	}
+	return g, nil
+}
+
+// setupGroups must run after the views are set up, as a group with its
+// own upstreams gets a view derived from each of them.
+func setupGroups() {
+	for _, spec := range groupFlags {
+		g, err := parseClientGroup(spec)
+		if err != nil {
+			log.Fatalf("bad -client-group %q: %v", spec, err)
+		}
+		for _, src := range g.sources {
+			if _, err := src.load(); err != nil {
+				if !src.isURL() {
+					log.Fatal(err)
+				}
+				warnf("blocklist: %v", err)
+			}
+		}
+		g.rebuildBlocklist()
+		if len(g.sources) > 0 && *blockRefresh > 0 {
+			go refreshBlocklists(g.sources, g.rebuildBlocklist)
+		}
+		if g.upstreams != nil {
+			g.views = make(map[*view]*view)
+			for _, v := range append([]*view{defaultView}, views...) {
+				gv := *v
+				gv.upstreams, gv.ownUpstreams, gv.group = g.upstreams, true, g.name
+				g.views[v] = &gv
+			}
+		}
+		clientGroups = append(clientGroups, g)
+		ups := "of the view"
+		if g.upstreams != nil {
+			ups = g.upstreams.String()
+		}
+		infof("Client group %s: %d client ranges, %d MAC addresses, %d blocklist rules, upstreams %s, safe search %t",
+			g.name, len(g.nets), len(g.macs), g.blocked.Load().len(), ups, g.safeSearch)
+	}
+}
+
+func (g *clientGroup) rebuildBlocklist() {
+	m := newBlockMatcher()
+	for _, src := range g.sources {
+		for _, rule := range src.rules {
+			if err := m.add(rule); err != nil {
+				warnf("blocklist %s: %v", src.loc, err)
+			}
+		}
+	}
+	m.compile()
+	g.blocked.Store(m)
+}
+
+// viewOf returns the view of the group derived from v.
+func (g *clientGroup) viewOf(v *view) *view {
+	if gv, ok := g.views[v]; ok {
+		return gv
+	}
+	return v
+}
+
+// groupFor returns the first group client is in, or nil.
+func groupFor(client net.IP) *clientGroup {
+	if len(clientGroups) == 0 || client == nil {
+		return nil
+	}
+	mac := ""
+	for _, g := range clientGroups {
+		for _, n := range g.nets {
+			if n.Contains(client) {
+				return g
+			}
+		}
+		if len(g.macs) == 0 {
+			continue
+		}
+		if mac == "" {
+			if mac = macAddress(client); mac == "" {
+				mac = "unknown"
+			}
+		}
+		if g.macs[mac] {
+			return g
+		}
+	}
+	return nil
+}
+
+// neighbors caches the IPv4 ARP table of Linux, which maps the addresses
+// of LAN clients to their MAC addresses.
+var neighbors struct {
+	sync.Mutex
+	macs map[string]string
+	read time.Time
+}
+
+const neighborsTTL = 10 * time.Second
+
+// macAddress returns the MAC address of a LAN client from the ARP table,
+// or else its DHCP lease, or "" if neither knows it.
+func macAddress(ip net.IP) string {
+	neighbors.Lock()
+	if time.Since(neighbors.read) > neighborsTTL {
+		neighbors.macs = readARPTable()
+		neighbors.read = time.Now()
+	}
+	mac, ok := neighbors.macs[ip.String()]
+	neighbors.Unlock()
+	if ok {
+		return mac
+	}
+	if mac, ok := leaseMAC(ip); ok {
+		if hw, err := net.ParseMAC(mac); err == nil {
+			return hw.String()
+		}
+	}
+	return ""
+}
+
+func readARPTable() map[string]string {
+	macs := make(map[string]string)
+	data, err := os.ReadFile("/proc/net/arp")
+	if err != nil {
+		return macs
+	}
+	// IP address, HW type, Flags, HW address, Mask, Device
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[2] == "0x0" {
+			continue
+		}
+		if hw, err := net.ParseMAC(fields[3]); err == nil {
+			macs[fields[0]] = hw.String()
+		}
+	}
+	return macs
+}
+
+// The names safe search answers for, and the names of the restricted
+// services that answer in their place.
+var safeSearchSpecs = []string{
+	`/^(www\.)?google\.(com|[a-z]{2}|com?\.[a-z]{2})$/ forcesafesearch.google.com`,
+	`www.bing.com strict.bing.com`,
+	`bing.com strict.bing.com`,
+	`duckduckgo.com safe.duckduckgo.com`,
+	`www.duckduckgo.com safe.duckduckgo.com`,
+	`www.youtube.com restrictmoderate.youtube.com`,
+	`m.youtube.com restrictmoderate.youtube.com`,
+	`youtubei.googleapis.com restrictmoderate.youtube.com`,
+	`youtube.googleapis.com restrictmoderate.youtube.com`,
+	`www.youtube-nocookie.com restrictmoderate.youtube.com`,
+	`/^(www\.)?yandex\.(ru|com|by|kz|ua|com\.tr)$/ familysearch.yandex.ru`,
+}
+
+var safeSearchRules = sync.OnceValue(func() []*rewriteRule {
+	var rules []*rewriteRule
+	for _, spec := range safeSearchSpecs {
+		r, err := parseRewrite(spec)
+		if err != nil {
+			panic(err)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+})
+
+// safeSearchAnswer answers for search engines with the addresses of their
+// safe search service, for clients of groups with safe-search=true.
+func safeSearchAnswer(r *request) ([]byte, bool) {
+	if r.group == nil || !r.group.safeSearch || len(r.query.question) != 1 || isRewritten(r.ctx) {
+		return nil, false
+	}
+	name := canonicalName(r.query.question[0].Name)
+	for _, rule := range safeSearchRules() {
+		if rule.matches(name) {
+			debugf("Safe search for %s in group %s", name, r.group.name)
+			return rule.apply(r.ctx, r.query, r.data, r.client, r.view), true
+		}
+	}
+	return nil, false
+}
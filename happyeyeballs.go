@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	happyEyeballsDelay = flag.Duration("happy-eyeballs-delay", 250*time.Millisecond, "how long to wait for a connection to one address of an upstream host name before also trying the next")
+	upstreamReprobe    = flag.Duration("upstream-reprobe", 10*time.Minute, "how long to keep using the address of an upstream host name that connected first before racing its addresses again")
+)
+
+// pins remembers the address of each upstream host that won the last
+// race, so that later connections go straight to it.
+var pins struct {
+	sync.Mutex
+	m map[string]pin
+}
+
+type pin struct {
+	ip    net.IP
+	until time.Time
+}
+
+func pinned(host string) net.IP {
+	pins.Lock()
+	defer pins.Unlock()
+	if p, ok := pins.m[host]; ok && time.Now().Before(p.until) {
+		return p.ip
+	}
+	return nil
+}
+
+func setPin(host string, ip net.IP) {
+	pins.Lock()
+	defer pins.Unlock()
+	if ip == nil {
+		delete(pins.m, host)
+		return
+	}
+	if pins.m == nil {
+		pins.m = make(map[string]pin)
+	}
+	pins.m[host] = pin{ip, time.Now().Add(*upstreamReprobe)}
+}
+
+// setupDialing makes ODoH connections go through dialHost too.
+func setupDialing() {
+	base, ok := odohClient.Transport.(*http.Transport)
+	if !ok {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	t := base.Clone()
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialHost(ctx, outboundDialer("tcp"), network, addr)
+	}
+	odohClient.Transport = t
+}
+
+// dialHost dials addr with d. A host name is looked up with lookupHost
+// and its addresses raced with happy eyeballs (RFC 8305); the winner is
+// used for the host, over TCP and UDP, until -upstream-reprobe passes or
+// it fails.
+func dialHost(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	if ip := pinned(host); ip != nil {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+		debugf("%s: pinned address %s failed: %v", host, ip, err)
+		setPin(host, nil)
+	}
+	ips, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	if network == "udp" {
+		// Datagram sockets connect at once, so there is nothing to race.
+		return d.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+	}
+	conn, ip, err := happyEyeballs(ctx, d, network, interleaveFamilies(ips), port)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) > 1 {
+		debugf("%s: pinning %s", host, ip)
+	}
+	setPin(host, ip)
+	return conn, nil
+}
+
+// interleaveFamilies orders addresses IPv6 first, alternating between the
+// families (RFC 8305 section 4).
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	out := make([]net.IP, 0, len(ips))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			out, v6 = append(out, v6[0]), v6[1:]
+		}
+		if len(v4) > 0 {
+			out, v4 = append(out, v4[0]), v4[1:]
+		}
+	}
+	return out
+}
+
+// happyEyeballs connects to the first of ips that answers, starting a new
+// attempt every -happy-eyeballs-delay, or as soon as one fails, while
+// the earlier ones are still going.
+func happyEyeballs(ctx context.Context, d *net.Dialer, network string, ips []net.IP, port string) (net.Conn, net.IP, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		ip   net.IP
+		err  error
+	}
+	results := make(chan result)
+	pending, next := 0, 0
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			results <- result{conn, ip, err}
+		}()
+	}
+	start()
+	var errs []error
+	for pending > 0 {
+		var delay <-chan time.Time
+		if next < len(ips) {
+			delay = time.After(*happyEyeballsDelay)
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close the connections of the attempts that lost.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, r.ip, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(ips) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+	}
+	return nil, nil, errors.Join(errs...)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+var (
+	healthInterval = flag.Duration("health-check-interval", 0, "probe every upstream this often and skip the failing ones until they recover, 0 to disable")
+	healthName     = flag.String("health-check-name", ".", "name whose NS records are asked for by health checks")
+)
+
+func setupHealthChecks() {
+	if *healthInterval <= 0 {
+		return
+	}
+	infof("Checking upstream health every %v with %s NS queries", *healthInterval, *healthName)
+	go func() {
+		for {
+			for _, u := range knownUpstreams() {
+				go checkUpstream(u)
+			}
+			time.Sleep(*healthInterval)
+		}
+	}()
+}
+
+// knownUpstreams returns the upstreams of the default view, of the other
+// views, of the client groups and of the domain routes.
+func knownUpstreams() []*upstream {
+	all := append(upstreamGroup{}, upstreams...)
+	for _, v := range views {
+		all = append(all, v.upstreams...)
+	}
+	for _, g := range clientGroups {
+		all = append(all, g.upstreams...)
+	}
+	if t := routes.Load(); t != nil {
+		for _, g := range *t {
+			all = append(all, g...)
+		}
+	}
+	seen := make(map[*upstream]bool)
+	out := all[:0]
+	for _, u := range all {
+		if !seen[u] {
+			seen[u] = true
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+func checkUpstream(u *upstream) {
+	var q dnsMsg
+	q.id = uint16(rand.Uint32())
+	q.recursion_desired = true
+	q.question = []dnsQuestion{{Name: canonicalName(*healthName), Qtype: dnsTypeNS, Qclass: dnsClassINET}}
+	start := time.Now()
+	reply, err := u.exchange(context.Background(), packDNSMsg(q))
+	if err == nil {
+		var msg dnsMsg
+		if msg, err = parseDNSMsg(reply); err == nil && msg.rcode != dnsRcodeSuccess && msg.rcode != dnsRcodeNameError {
+			err = fmt.Errorf("health check answered with rcode %d", msg.rcode)
+		}
+	}
+	if err != nil {
+		u.markFailed(err)
+		return
+	}
+	u.markOK(time.Since(start))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var (
+	systemHosts   = flag.Bool("hosts", true, "answer from the system hosts file")
+	hostsInterval = flag.Duration("hosts-interval", 5*time.Second, "how often to check hosts files for changes")
+	hostsFiles    stringList
+)
+
+func init() {
+	flag.Var(&hostsFiles, "hosts-file", "answer from this hosts file too (repeatable)")
+}
+
+func systemHostsPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("SystemRoot"), "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+// parseHostsFile reads a file in hosts(5) format.
+func parseHostsFile(path string) ([]localAddr, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var addrs []localAddr
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, _, _ := strings.Cut(fields[0], "%")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			addrs = append(addrs, localAddr{name: name, ip: ip})
+		}
+	}
+	return addrs, s.Err()
+}
+
+func loadHostsFile(path string) {
+	addrs, err := parseHostsFile(path)
+	if err != nil {
+		warnf("hosts: %v", err)
+		return
+	}
+	localRecords.replace(path, addrs)
+	infof("hosts: loaded %d names from %s", len(addrs), path)
+}
+
+// setupHosts loads the hosts files and starts polling them so edits are
+// picked up without a restart.
+func setupHosts() {
+	paths := append([]string{}, hostsFiles...)
+	if *systemHosts {
+		paths = append([]string{systemHostsPath()}, paths...)
+	}
+	if len(paths) == 0 {
+		return
+	}
+	mtimes := make(map[string]time.Time)
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil {
+			mtimes[p] = fi.ModTime()
+		}
+		loadHostsFile(p)
+	}
+	if *hostsInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(*hostsInterval) {
+			for _, p := range paths {
+				fi, err := os.Stat(p)
+				if err != nil {
+					if _, ok := mtimes[p]; ok {
+						delete(mtimes, p)
+						localRecords.replace(p, nil)
+						warnf("hosts: %s removed", p)
+					}
+					continue
+				}
+				if !fi.ModTime().Equal(mtimes[p]) {
+					mtimes[p] = fi.ModTime()
+					loadHostsFile(p)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	dnsOpcodeQuery = 0
+
+	dnsTypeIXFR  = 251
+	dnsTypeAXFR  = 252
+	dnsTypeMAILB = 253
+	dnsTypeMAILA = 254
+
+	// Extended rcode 16 (RFC 6891 section 6.1.3), of which the OPT
+	// record carries the upper eight bits.
+	dnsRcodeBadVersion = 16
+)
+
+// badQuery checks that query is something the proxy may forward: a
+// query with the standard opcode, exactly one question for a data type,
+// and at most one OPT record of EDNS version 0. It returns the error
+// reply for queries that are not, or true with a nil reply for messages
+// that must not be answered at all.
+func badQuery(query dnsMsg, client net.IP) ([]byte, bool) {
+	// Answering responses could set off a loop between two servers.
+	if query.response {
+		debugf("Dropped a response from %s sent as a query", client)
+		return nil, true
+	}
+	if query.opcode != dnsOpcodeQuery {
+		debugf("Unsupported opcode %d from %s", query.opcode, client)
+		return packDNSMsg(newReply(query, dnsRcodeNotImplemented)), true
+	}
+	if len(query.question) != 1 {
+		debugf("Query with %d questions from %s", len(query.question), client)
+		return packDNSMsg(newReply(query, dnsRcodeFormatError)), true
+	}
+	switch query.question[0].Qtype {
+	case dnsTypeOPT:
+		return packDNSMsg(newReply(query, dnsRcodeFormatError)), true
+	case dnsTypeIXFR, dnsTypeAXFR, dnsTypeMAILB, dnsTypeMAILA:
+		// Zone transfers are not something a forwarder relays.
+		return packDNSMsg(newReply(query, dnsRcodeNotImplemented)), true
+	}
+	opts := 0
+	for _, rr := range query.extra {
+		if rr.Rrtype == dnsTypeOPT {
+			opts++
+		}
+	}
+	if opts > 1 {
+		return packDNSMsg(newReply(query, dnsRcodeFormatError)), true
+	}
+	if opt := ednsOPT(query); opt != nil && opt.Ttl>>16&0xFF != 0 {
+		reply := newReply(query, dnsRcodeBadVersion&0xF)
+		reply.extra[0].Ttl = dnsRcodeBadVersion >> 4 << 24
+		return packDNSMsg(reply), true
+	}
+	return nil, false
+}
+
+// formatError returns a FORMERR reply to a message that could not be
+// parsed, echoing only its ID and opcode, or nil if data is too short to
+// have a header or is not a query.
+func formatError(data []byte) []byte {
+	if len(data) < 12 || data[2]&0x80 != 0 {
+		return nil
+	}
+	reply := make([]byte, 12)
+	binary.BigEndian.PutUint16(reply, binary.BigEndian.Uint16(data))
+	reply[2] = 0x80 | data[2]&0x79 // QR, opcode and RD
+	reply[3] = 0x80 | dnsRcodeFormatError
+	return reply
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	leaseFiles    stringList
+	leaseDomain   = flag.String("dhcp-domain", "", "also answer for DHCP lease host names under this domain, e.g. lan for laptop.lan")
+	leaseInterval = flag.Duration("dhcp-leases-interval", 5*time.Second, "how often to check DHCP lease files for changes")
+)
+
+func init() {
+	flag.Var(&leaseFiles, "dhcp-leases", "answer for the host names in this dnsmasq or ISC dhcpd lease file, and their reverse lookups (repeatable)")
+}
+
+// A lease is a host name a DHCP client asked for and the address it got.
+type lease struct {
+	name    string
+	ip      net.IP
+	mac     string
+	expires time.Time // zero if the lease does not expire
+}
+
+// leaseMACs holds the MAC addresses of the current leases of each file
+// by IP address, for -client-group.
+var leaseMACs struct {
+	sync.RWMutex
+	m map[string]map[string]string
+}
+
+func leaseMAC(ip net.IP) (string, bool) {
+	leaseMACs.RLock()
+	defer leaseMACs.RUnlock()
+	for _, macs := range leaseMACs.m {
+		if mac, ok := macs[ip.String()]; ok {
+			return mac, true
+		}
+	}
+	return "", false
+}
+
+func parseLeaseFile(path string) ([]lease, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(string(data), "{") {
+		return parseISCLeases(string(data)), nil
+	}
+	return parseDnsmasqLeases(string(data)), nil
+}
+
+// parseDnsmasqLeases reads dnsmasq lease lines, "expiry mac ip name id",
+// where an expiry of 0 is an infinite lease and a name of * is none.
+func parseDnsmasqLeases(data string) []lease {
+	var leases []lease
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] == "duid" {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		ip := net.ParseIP(fields[2])
+		if err != nil || ip == nil {
+			continue
+		}
+		l := lease{name: fields[3], ip: ip}
+		// DHCPv6 leases have an IAID in place of the MAC address.
+		if _, err := net.ParseMAC(fields[1]); err == nil {
+			l.mac = strings.ToLower(fields[1])
+		}
+		if l.name == "*" {
+			l.name = ""
+		}
+		if expiry != 0 {
+			l.expires = time.Unix(expiry, 0)
+		}
+		leases = append(leases, l)
+	}
+	return leases
+}
+
+// parseISCLeases reads the lease blocks of a dhcpd.leases file. dhcpd
+// appends a new block when a lease changes, so the last block for an
+// address wins.
+func parseISCLeases(data string) []lease {
+	byAddr := make(map[string]lease)
+	var cur *lease
+	active := false
+	for _, line := range strings.Split(data, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(line), ";"))
+		switch {
+		case len(fields) == 3 && fields[0] == "lease" && fields[2] == "{":
+			cur, active = &lease{ip: net.ParseIP(fields[1])}, true
+		case cur == nil || len(fields) == 0:
+		case fields[0] == "}":
+			if cur.ip != nil {
+				if !active {
+					cur.name, cur.mac = "", ""
+				}
+				byAddr[cur.ip.String()] = *cur
+			}
+			cur = nil
+		case fields[0] == "hardware" && len(fields) == 3:
+			cur.mac = strings.ToLower(fields[2])
+		case fields[0] == "client-hostname" && len(fields) == 2:
+			cur.name = strings.Trim(fields[1], "\"")
+		case fields[0] == "binding" && len(fields) == 3 && fields[1] == "state":
+			active = fields[2] == "active"
+		case fields[0] == "ends" && len(fields) >= 3:
+			cur.expires = parseISCTime(fields[1:])
+		}
+	}
+	var leases []lease
+	for _, l := range byAddr {
+		if l.name != "" || l.mac != "" {
+			leases = append(leases, l)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].name < leases[j].name })
+	return leases
+}
+
+// parseISCTime parses the "never", "epoch N" and "W YYYY/MM/DD HH:MM:SS"
+// (UTC) forms of a lease time.
+func parseISCTime(fields []string) time.Time {
+	switch {
+	case fields[0] == "never":
+		return time.Time{}
+	case fields[0] == "epoch" && len(fields) >= 2:
+		if n, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			return time.Unix(n, 0)
+		}
+	case len(fields) >= 3:
+		if t, err := time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2]); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// validHostname reports whether a name a DHCP client sent is safe to
+// answer for: dot separated labels of letters, digits and hyphens.
+func validHostname(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// loadLeaseFile loads the current leases of path into the local table and
+// returns when the first of them expires.
+func loadLeaseFile(path string) time.Time {
+	leases, err := parseLeaseFile(path)
+	if err != nil {
+		warnf("dhcp: %v", err)
+		return time.Time{}
+	}
+	now := time.Now()
+	var next time.Time
+	var addrs []localAddr
+	macs := make(map[string]string)
+	for _, l := range leases {
+		if !l.expires.IsZero() {
+			if !l.expires.After(now) {
+				continue
+			}
+			if next.IsZero() || l.expires.Before(next) {
+				next = l.expires
+			}
+		}
+		if l.mac != "" {
+			macs[l.ip.String()] = l.mac
+		}
+		if l.name == "" {
+			continue
+		}
+		if !validHostname(l.name) {
+			debugf("dhcp: ignoring host name %q of %s", l.name, l.ip)
+			continue
+		}
+		// The first name of an address is its reverse name, so the
+		// qualified one goes first.
+		if *leaseDomain != "" && !strings.Contains(l.name, ".") {
+			addrs = append(addrs, localAddr{name: l.name + "." + canonicalName(*leaseDomain), ip: l.ip})
+		}
+		addrs = append(addrs, localAddr{name: l.name, ip: l.ip})
+	}
+	localRecords.replace(path, addrs)
+	leaseMACs.Lock()
+	if leaseMACs.m == nil {
+		leaseMACs.m = make(map[string]map[string]string)
+	}
+	leaseMACs.m[path] = macs
+	leaseMACs.Unlock()
+	infof("dhcp: loaded %d names from %s", len(addrs), path)
+	return next
+}
+
+// setupLeases loads the DHCP lease files and polls them, reloading a file
+// when it changes or one of its leases expires.
+func setupLeases() {
+	if len(leaseFiles) == 0 {
+		return
+	}
+	mtimes := make(map[string]time.Time)
+	expiries := make(map[string]time.Time)
+	for _, p := range leaseFiles {
+		if fi, err := os.Stat(p); err == nil {
+			mtimes[p] = fi.ModTime()
+		}
+		expiries[p] = loadLeaseFile(p)
+	}
+	if *leaseInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(*leaseInterval) {
+			for _, p := range leaseFiles {
+				fi, err := os.Stat(p)
+				if err != nil {
+					if _, ok := mtimes[p]; ok {
+						delete(mtimes, p)
+						localRecords.replace(p, nil)
+						warnf("dhcp: %s removed", p)
+					}
+					continue
+				}
+				expired := !expiries[p].IsZero() && time.Now().After(expiries[p])
+				if !fi.ModTime().Equal(mtimes[p]) || expired {
+					mtimes[p] = fi.ModTime()
+					expiries[p] = loadLeaseFile(p)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maxMemory        = flag.Int64("max-memory", 0, "soft memory limit in MiB, 0 for no limit")
+	maxGoroutines    = flag.Int("max-goroutines", 0, "shed queries above this many goroutines, 0 for no limit")
+	maxUpstreamConns = flag.Int("max-upstream-conns", 0, "maximum concurrent upstream connections, 0 for no limit")
+	logFile          = flag.String("log-file", "", "file for -log-output file")
+	logMaxSize       = flag.Int64("log-max-size", 10, "rotate the log file after this many MiB, 0 for no limit")
+)
+
+// When the heap grows past this fraction of -max-memory the proxy starts
+// trimming caches and shedding queries.
+const memoryHighWater = 0.9
+
+// How often the number of shed queries is logged, rather than every one
+// of them while the proxy is already struggling.
+const shedReportInterval = 10 * time.Second
+
+var (
+	upstreamSlots chan struct{}
+	memoryHigh    atomic.Bool
+	shedQueries   atomic.Int64
+	trimHooks     []func()
+	trimMu        sync.Mutex
+)
+
+// registerTrimHook adds a function that is called to release memory
+// (typically by shrinking a cache) when the memory limit is approached.
+func registerTrimHook(f func()) {
+	trimMu.Lock()
+	trimHooks = append(trimHooks, f)
+	trimMu.Unlock()
+}
+
+func setupLimits() {
+	if *maxUpstreamConns > 0 {
+		upstreamSlots = make(chan struct{}, *maxUpstreamConns)
+	}
+	if *maxMemory > 0 {
+		debug.SetMemoryLimit(*maxMemory << 20)
+		go watchMemory(*maxMemory << 20)
+	}
+	if *maxGoroutines > 0 || *maxMemory > 0 {
+		go reportShedQueries()
+	}
+}
+
+func reportShedQueries() {
+	var last int64
+	for range time.Tick(shedReportInterval) {
+		n := shedQueries.Load()
+		if n > last {
+			warnf("Overloaded, dropped %d queries in the last %v", n-last, shedReportInterval)
+		}
+		last = n
+	}
+}
+
+func watchMemory(limit int64) {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	for range time.Tick(time.Second) {
+		metrics.Read(sample)
+		used := int64(sample[0].Value.Uint64())
+		high := float64(used) > float64(limit)*memoryHighWater
+		if high && !memoryHigh.Load() {
+			warnf("memory usage %d MiB near limit, trimming caches", used>>20)
+			trimMu.Lock()
+			for _, f := range trimHooks {
+				f()
+			}
+			trimMu.Unlock()
+			runtime.GC()
+		}
+		memoryHigh.Store(high)
+	}
+}
+
+// overloaded reports whether a new query from addr should be shed, and
+// counts it if so.
+func overloaded(addr net.Addr) bool {
+	if !(*maxGoroutines > 0 && runtime.NumGoroutine() >= *maxGoroutines) && !memoryHigh.Load() {
+		return false
+	}
+	shedQueries.Add(1)
+	debugf("Overloaded, dropping query from %v", addr)
+	return true
+}
+
+// acquireUpstream waits for a free upstream connection, giving up when
+// ctx is done.
+func acquireUpstream(ctx context.Context) error {
+	if upstreamSlots == nil {
+		return nil
+	}
+	select {
+	case upstreamSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("no free upstream connection: %w", ctx.Err())
+	}
+}
+
+func releaseUpstream() {
+	if upstreamSlots != nil {
+		<-upstreamSlots
+	}
+}
+
+// rotatingFile is a log destination that keeps at most one backup, so the
+// logs never use more than twice the configured size on disk.
+type rotatingFile struct {
+	mu   sync.Mutex
+	path string
+	max  int64
+	size int64
+	f    *os.File
+}
+
+func newRotatingFile(path string, max int64) (*rotatingFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rotatingFile{path: path, max: max, size: fi.Size(), f: f}, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.max > 0 && r.size+int64(len(p)) > r.max {
+		r.f.Close()
+		flags := os.O_WRONLY | os.O_TRUNC | os.O_CREATE
+		rerr := os.Rename(r.path, r.path+".1")
+		if rerr != nil {
+			// Keep the file and try again after another max bytes.
+			flags = os.O_WRONLY | os.O_APPEND | os.O_CREATE
+		}
+		f, err := os.OpenFile(r.path, flags, 0644)
+		if err != nil {
+			return 0, err
+		}
+		r.f = f
+		r.size = 0
+		if rerr != nil {
+			// The log is written through here, so the error goes
+			// straight into the file in the same format.
+			fmt.Fprintf(f, "%s Could not rotate the log: %v\n", time.Now().Format("2006/01/02 15:04:05"), rerr)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+var (
+	localZonesForward = flag.String("local-zones-forward", "", "comma-separated locally served zones, or zones inside them, to forward upstream anyway")
+	localZonesExtra   = flag.String("local-zones-extra", "", "comma-separated zones to serve as empty zones in addition to the RFC 6303 set")
+)
+
+// rfc6303Zones returns the zones RFC 6303 section 4 says a resolver
+// should serve as empty zones, with the shared address space added to
+// them by RFC 7793, plus the special-use names test., invalid. and
+// localhost. from RFC 6761.
+func rfc6303Zones() []string {
+	z := []string{
+		"10.in-addr.arpa",
+		"168.192.in-addr.arpa",
+		"0.in-addr.arpa",
+		"127.in-addr.arpa",
+		"254.169.in-addr.arpa",
+		"2.0.192.in-addr.arpa",
+		"100.51.198.in-addr.arpa",
+		"113.0.203.in-addr.arpa",
+		"255.255.255.255.in-addr.arpa",
+		"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa",
+		"d.f.ip6.arpa",
+		"8.e.f.ip6.arpa",
+		"9.e.f.ip6.arpa",
+		"a.e.f.ip6.arpa",
+		"b.e.f.ip6.arpa",
+		"8.b.d.0.1.0.0.2.ip6.arpa",
+		"test",
+		"invalid",
+		"localhost",
+	}
+	for i := 16; i < 32; i++ {
+		z = append(z, fmt.Sprintf("%d.172.in-addr.arpa", i))
+	}
+	for i := 64; i < 128; i++ {
+		z = append(z, fmt.Sprintf("%d.100.in-addr.arpa", i))
+	}
+	return z
+}
+
+// localZones are served locally, except for the names under
+// forwardedZones.
+var localZones, forwardedZones map[string]bool
+
+func setupLocalZones() {
+	localZones = make(map[string]bool)
+	forwardedZones = make(map[string]bool)
+	for _, z := range rfc6303Zones() {
+		localZones[z] = true
+	}
+	for _, z := range strings.Split(*localZonesExtra, ",") {
+		if z = canonicalName(strings.TrimSpace(z)); z != "" {
+			localZones[z] = true
+		}
+	}
+	for _, z := range strings.Split(*localZonesForward, ",") {
+		if z = canonicalName(strings.TrimSpace(z)); z != "" {
+			if _, ok := findLocalZone(z); !ok {
+				log.Fatalf("-local-zones-forward: %s is not in a locally served zone", z)
+			}
+			delete(localZones, z)
+			forwardedZones[z] = true
+		}
+	}
+}
+
+// forwardedZone reports whether name is in a zone given to
+// -local-zones-forward.
+func forwardedZone(name string) bool {
+	for {
+		if forwardedZones[name] {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// findLocalZone returns the locally served zone containing name.
+func findLocalZone(name string) (string, bool) {
+	for {
+		if forwardedZones[name] {
+			return "", false
+		}
+		if localZones[name] {
+			return name, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return "", false
+		}
+		name = name[i+1:]
+	}
+}
+
+// localZoneAnswer answers for the locally served zones: the apex has an
+// SOA and NS record, localhost names resolve to the loopback address and
+// everything else does not exist.
+func localZoneAnswer(query dnsMsg) []byte {
+	if len(query.question) != 1 {
+		return nil
+	}
+	q := query.question[0]
+	name := canonicalName(q.Name)
+	zone, ok := findLocalZone(name)
+	if !ok {
+		return nil
+	}
+	reply := newReply(query, dnsRcodeSuccess)
+	reply.authoritative = true
+	rr := dnsRR{Name: q.Name, Rrtype: q.Qtype, Class: dnsClassINET, Ttl: negativeTTL}
+	switch {
+	case zone == "localhost" && q.Qtype == dnsTypeA:
+		rr.Data = net.IPv4(127, 0, 0, 1).To4()
+	case zone == "localhost" && q.Qtype == dnsTypeAAAA:
+		rr.Data = net.IPv6loopback
+	case zone == "localhost":
+	case name != zone:
+		reply.rcode = dnsRcodeNameError
+	case q.Qtype == dnsTypeSOA:
+		rr = syntheticSOA(zone)
+	case q.Qtype == dnsTypeNS:
+		rr.Data = packDomainName(nil, zone)
+	}
+	if rr.Data != nil {
+		rr.Rdlength = uint16(len(rr.Data))
+		reply.answer = []dnsRR{rr}
+	} else {
+		reply.ns = []dnsRR{syntheticSOA(zone)}
+	}
+	return packDNSMsg(reply)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	logLevelName   = flag.String("log-level", "info", "least severe messages to log: debug (every query and reply), info, warn or error")
+	logOutput      = flag.String("log-output", "", "where to log: stderr, file (-log-file), syslog or eventlog (Windows); by default the file if -log-file is given, else stderr")
+	syslogFacility = flag.String("syslog-facility", "daemon", "syslog facility for -log-output syslog, e.g. daemon or local0")
+	syslogTag      = flag.String("syslog-tag", "dns2tcp", "program name in syslog messages and source name in the Windows event log")
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevels = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+var minLogLevel = levelInfo
+
+// leveledLog is set for outputs that record the level of each message
+// themselves, such as syslog, instead of writing it through the log
+// package.
+var leveledLog func(l logLevel, msg string) error
+
+func setupLogging() {
+	l, ok := logLevels[strings.ToLower(*logLevelName)]
+	if !ok {
+		log.Fatalf("unknown -log-level %q", *logLevelName)
+	}
+	minLogLevel = l
+
+	output := *logOutput
+	if output == "" {
+		output = "stderr"
+		if *logFile != "" {
+			output = "file"
+		}
+	}
+	switch output {
+	case "stderr":
+		log.SetOutput(os.Stderr)
+	case "file":
+		if *logFile == "" {
+			log.Fatal("-log-output file needs -log-file")
+		}
+		w, err := newRotatingFile(*logFile, *logMaxSize<<20)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(w)
+	case "syslog":
+		if err := openSyslog(); err != nil {
+			log.Fatalf("syslog: %v", err)
+		}
+	case "eventlog":
+		if err := openEventLog(); err != nil {
+			log.Fatalf("event log: %v", err)
+		}
+	default:
+		log.Fatalf("unknown -log-output %q", output)
+	}
+}
+
+func logf(l logLevel, format string, v ...any) {
+	if l < minLogLevel {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	if leveledLog != nil {
+		leveledLog(l, msg)
+		return
+	}
+	log.Output(3, msg)
+}
+
+func debugf(format string, v ...any) { logf(levelDebug, format, v...) }
+func infof(format string, v ...any)  { logf(levelInfo, format, v...) }
+func warnf(format string, v ...any)  { logf(levelWarn, format, v...) }
+func errorf(format string, v ...any) { logf(levelError, format, v...) }
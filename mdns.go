@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	mdnsEnabled   = flag.Bool("mdns", false, "resolve .local names with multicast DNS instead of forwarding them")
+	mdnsTimeout   = flag.Duration("mdns-timeout", time.Second, "how long to wait for multicast DNS answers")
+	mdnsInterface = flag.String("mdns-interface", "", "send multicast DNS queries on this interface instead of the one of the default route")
+)
+
+var (
+	mdnsGroup  = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsGroup6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// The top bit of the class requests a unicast response in questions and
+// marks a cache flush in records (RFC 6762 sections 5.4 and 10.2).
+const mdnsClassMask = 0x7FFF
+
+func isMDNSQuery(query dnsMsg) bool {
+	if !*mdnsEnabled || len(query.question) != 1 {
+		return false
+	}
+	name := strings.ToLower(strings.TrimSuffix(query.question[0].Name, "."))
+	return name == "local" || strings.HasSuffix(name, ".local")
+}
+
+// mdnsQuery sends a one-shot multicast query for q. It returns the
+// matching records and any additional records the responders included.
+// Unless all is set it stops at the first responder with an answer;
+// otherwise it collects answers until the timeout. The rcode is
+// NXDOMAIN when no responder knew the name.
+func mdnsQuery(q dnsQuestion, all bool) (answer, extra []dnsRR, rcode uint, err error) {
+	var mq dnsMsg
+	mq.question = []dnsQuestion{{Name: q.Name, Qtype: q.Qtype, Qclass: q.Qclass | ^uint16(mdnsClassMask)}}
+	conns, err := mdnsSend(packDNSMsg(mq))
+	if err != nil {
+		return nil, nil, dnsRcodeServerFailure, err
+	}
+	type response struct {
+		msg  dnsMsg
+		addr net.Addr
+	}
+	responses := make(chan response)
+	done := make(chan struct{})
+	defer close(done)
+	deadline := time.Now().Add(*mdnsTimeout)
+	for _, conn := range conns {
+		defer conn.Close()
+		conn.SetReadDeadline(deadline)
+		go func() {
+			buf := make([]byte, 9000)
+			for {
+				n, addr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				msg, err := parseDNSMsg(buf[:n])
+				if err != nil || !msg.response || len(msg.answer) == 0 {
+					continue
+				}
+				select {
+				case responses <- response{msg, addr}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	rcode = dnsRcodeNameError
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+	for {
+		var r response
+		select {
+		case r = <-responses:
+		case <-timeout.C:
+			return answer, extra, rcode, nil
+		}
+		msg, addr := r.msg, r.addr
+		found := false
+		for _, rr := range append(msg.answer, msg.extra...) {
+			rr.Class &= mdnsClassMask
+			if !strings.EqualFold(rr.Name, strings.TrimSuffix(q.Name, ".")) {
+				extra = append(extra, rr)
+				continue
+			}
+			// The name exists, even if it has no records of this type.
+			rcode = dnsRcodeSuccess
+			if rr.Rrtype == q.Qtype || rr.Rrtype == dnsTypeCNAME {
+				answer = append(answer, rr)
+				found = true
+			}
+		}
+		if found {
+			debugf("mDNS: %s answered by %s", q.Name, addr)
+			if !all {
+				return answer, extra, rcode, nil
+			}
+		}
+	}
+}
+
+// mdnsSend sends a one-shot multicast query over IPv4 and IPv6, returning
+// the sockets to read the answers from. A family that cannot be used, for
+// want of an address or a route, is skipped.
+func mdnsSend(msg []byte) ([]*net.UDPConn, error) {
+	var ifi *net.Interface
+	var ifAddr4 net.IP
+	if *mdnsInterface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(*mdnsInterface); err != nil {
+			return nil, err
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				ifAddr4 = ipnet.IP.To4()
+				break
+			}
+		}
+	}
+	var conns []*net.UDPConn
+	var errs []error
+	for _, group := range []*net.UDPAddr{mdnsGroup, mdnsGroup6} {
+		network, dst := "udp6", *group
+		var lc net.ListenConfig
+		if group.IP.To4() != nil {
+			network = "udp4"
+			if ifi != nil {
+				if ifAddr4 == nil {
+					continue
+				}
+				lc.Control = func(network, address string, c syscall.RawConn) error {
+					return setMulticastInterface(c, ifAddr4)
+				}
+			}
+		} else if ifi != nil {
+			dst.Zone = ifi.Name
+		}
+		pc, err := lc.ListenPacket(context.Background(), network, ":0")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		conn := pc.(*net.UDPConn)
+		if _, err := conn.WriteTo(msg, &dst); err != nil {
+			conn.Close()
+			errs = append(errs, err)
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) == 0 {
+		if len(errs) == 0 {
+			return nil, fmt.Errorf("interface %s has no IPv4 or IPv6 address", *mdnsInterface)
+		}
+		return nil, errors.Join(errs...)
+	}
+	for _, err := range errs {
+		debugf("mDNS: %v", err)
+	}
+	return conns, nil
+}
+
+// mdnsRequest resolves the question in query over multicast DNS and
+// returns a unicast DNS reply.
+func mdnsRequest(query dnsMsg) []byte {
+	answer, _, rcode, err := mdnsQuery(query.question[0], false)
+	if err != nil {
+		warnf("mDNS: %v", err)
+	}
+	reply := newReply(query, rcode)
+	reply.answer = answer
+	return packDNSMsg(reply)
+}
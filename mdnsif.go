@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastInterface makes a socket send IPv4 multicast through the
+// interface with address ip.
+func setMulticastInterface(c syscall.RawConn, ip net.IP) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, [4]byte(ip.To4()))
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
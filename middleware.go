@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+)
+
+// A request is a query on its way through the middleware chain.
+type request struct {
+	ctx    context.Context
+	data   []byte
+	query  dnsMsg
+	client net.IP
+	view   *view
+
+	// The client group the client belongs to, if any.
+	group *clientGroup
+	// The upstreams chosen by a policy, instead of those of the view.
+	upstreams upstreamGroup
+}
+
+// A handler answers a request. A nil reply drops the query.
+type handler func(r *request) []byte
+
+// A middleware answers a request itself or hands it to next, which runs
+// the rest of the chain. It may change the request on the way in and the
+// reply on the way out.
+type middleware func(r *request, next handler) []byte
+
+type stage struct {
+	name string
+	m    middleware
+}
+
+// chain is the request path, in order.
+var chain []stage
+
+type registration struct {
+	name, before string
+	m            middleware
+}
+
+var registrations []registration
+
+// useMiddleware adds m to the chain ahead of the stage named before:
+// filter, policy, rewrite, local or forward, or another added middleware.
+// Files added to the package call it from init to hook in their own
+// logging or policy without touching the rest, e.g.
+//
+//	func init() {
+//		useMiddleware("audit", "forward", func(r *request, next handler) []byte {
+//			infof("%s asked for %v", r.client, r.query.question)
+//			return next(r)
+//		})
+//	}
+func useMiddleware(name, before string, m middleware) {
+	registrations = append(registrations, registration{name, before, m})
+}
+
+func setupMiddleware() {
+	chain = []stage{
+		{"filter", filterStage},
+		{"policy", policyStage},
+		{"rewrite", rewriteStage},
+		{"local", localStage},
+		{"forward", forwardStage},
+	}
+	for _, reg := range registrations {
+		i := 0
+		for i < len(chain) && chain[i].name != reg.before {
+			i++
+		}
+		if i == len(chain) {
+			log.Fatalf("middleware %s: no stage %q to go before", reg.name, reg.before)
+		}
+		chain = append(chain[:i], append([]stage{{reg.name, reg.m}}, chain[i:]...)...)
+	}
+	if len(registrations) > 0 {
+		names := make([]string, len(chain))
+		for i, st := range chain {
+			names[i] = st.name
+		}
+		infof("Middleware chain: %s", strings.Join(names, " -> "))
+	}
+}
+
+// runChain hands r to the stages from i on. Each stage is traced as a
+// span holding those of the stages after it.
+func runChain(r *request, i int) []byte {
+	if i == len(chain) {
+		return nil
+	}
+	var sp *span
+	r.ctx, sp = startSpan(r.ctx, chain[i].name, spanInternal)
+	defer sp.finish()
+	return chain[i].m(r, func(r *request) []byte {
+		return runChain(r, i+1)
+	})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hpke"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var odohProxy = flag.String("odoh-proxy", "", "URL of the Oblivious DoH proxy relaying queries to odoh:// upstreams, so that they never see our address")
+
+const (
+	odohMessageType = "application/oblivious-dns-message"
+	odohVersion     = 0x0001
+	odohQuery       = 0x01
+	odohResponse    = 0x02
+
+	// How long a target's public key is used before it is fetched again.
+	odohConfigTTL = time.Hour
+)
+
+// odohTarget is an Oblivious DoH (RFC 9230) upstream, given as
+// odoh://host/path. Queries are encrypted to the target's public key and
+// sent through -odoh-proxy, so the proxy sees who asks but not what, and
+// the target what is asked but not by whom.
+type odohTarget struct {
+	host, path string
+	client     *http.Client // odohClient unless the upstream has a proxy
+
+	mu      sync.Mutex
+	config  *odohConfig
+	fetched time.Time
+}
+
+// odohConfig is the target's ObliviousDoHConfigContents.
+type odohConfig struct {
+	kdf     hpke.KDF
+	aead    hpke.AEAD
+	pub     hpke.PublicKey
+	newHash func() hash.Hash
+	keyLen  int // Nk of the AEAD
+	keyID   []byte
+}
+
+var odohClient = &http.Client{}
+
+func parseODoHTarget(spec string) (*odohTarget, error) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("bad ODoH upstream %q", spec)
+	}
+	path := u.Path
+	if path == "" {
+		path = "/dns-query"
+	}
+	return &odohTarget{host: u.Host, path: path, client: odohClient}, nil
+}
+
+// getConfig returns the target's key configuration, fetching it from
+// /.well-known/odohconfigs when it is missing or old.
+func (t *odohTarget) getConfig(ctx context.Context) (*odohConfig, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.config != nil && time.Since(t.fetched) < odohConfigTTL {
+		return t.config, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+t.host+"/.well-known/odohconfigs", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching ODoH configs: %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseODoHConfigs(b)
+	if err != nil {
+		return nil, err
+	}
+	t.config, t.fetched = cfg, time.Now()
+	return cfg, nil
+}
+
+// forgetConfig drops the cached configuration, for when the target no
+// longer accepts it.
+func (t *odohTarget) forgetConfig() {
+	t.mu.Lock()
+	t.config = nil
+	t.mu.Unlock()
+}
+
+// parseODoHConfigs picks the first configuration with a ciphersuite we
+// support from an ObliviousDoHConfigs structure.
+func parseODoHConfigs(b []byte) (*odohConfig, error) {
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return nil, errors.New("bad ODoH configs")
+	}
+	for b = b[2:]; len(b) >= 4; {
+		version, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			break
+		}
+		contents := b[4 : 4+n]
+		b = b[4+n:]
+		if version != odohVersion {
+			continue
+		}
+		if cfg, err := parseODoHConfig(contents); err == nil {
+			return cfg, nil
+		}
+	}
+	return nil, errors.New("no usable ODoH config")
+}
+
+func parseODoHConfig(contents []byte) (*odohConfig, error) {
+	if len(contents) < 8 {
+		return nil, errors.New("short ODoH config")
+	}
+	kemID := binary.BigEndian.Uint16(contents)
+	kdfID := binary.BigEndian.Uint16(contents[2:])
+	aeadID := binary.BigEndian.Uint16(contents[4:])
+	n := int(binary.BigEndian.Uint16(contents[6:]))
+	if len(contents) != 8+n {
+		return nil, errors.New("bad ODoH config length")
+	}
+	cfg := &odohConfig{}
+	switch kdfID {
+	case 0x0001:
+		cfg.newHash = sha256.New
+	case 0x0002:
+		cfg.newHash = sha512.New384
+	case 0x0003:
+		cfg.newHash = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported KDF %d", kdfID)
+	}
+	// Responses are sealed outside HPKE, with the AEAD itself.
+	switch aeadID {
+	case 0x0001:
+		cfg.keyLen = 16
+	case 0x0002:
+		cfg.keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported AEAD %d", aeadID)
+	}
+	kem, err := hpke.NewKEM(kemID)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.pub, err = kem.NewPublicKey(contents[8:]); err != nil {
+		return nil, err
+	}
+	if cfg.kdf, err = hpke.NewKDF(kdfID); err != nil {
+		return nil, err
+	}
+	if cfg.aead, err = hpke.NewAEAD(aeadID); err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(cfg.newHash, contents, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.keyID, err = hkdf.Expand(cfg.newHash, prk, "odoh key id", cfg.newHash().Size()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func appendLP16(b, v []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(b, uint16(len(v))), v...)
+}
+
+// readLP16 splits a 16-bit length prefixed field off b.
+func readLP16(b []byte) (v, rest []byte, err error) {
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return nil, nil, errors.New("short ODoH message")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	return b[2 : 2+n], b[2+n:], nil
+}
+
+// exchange encrypts data for the target, posts it to the proxy (or the
+// target itself without -odoh-proxy) and decrypts the answer.
+func (t *odohTarget) exchange(ctx context.Context, data []byte) ([]byte, error) {
+	cfg, err := t.getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pad the query to a multiple of 128 bytes (RFC 8467), with the EDNS
+	// option if we may so that the target pads the answer too.
+	plain := appendLP16(nil, padQuery(data))
+	plain = appendLP16(plain, make([]byte, (128-(len(plain)+2)%128)%128))
+	enc, sender, err := hpke.NewSender(cfg.pub, cfg.kdf, cfg.aead, []byte("odoh query"))
+	if err != nil {
+		return nil, err
+	}
+	aad := appendLP16([]byte{odohQuery}, cfg.keyID)
+	sealed, err := sender.Seal(aad, plain)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := sender.Export("odoh response", cfg.keyLen)
+	if err != nil {
+		return nil, err
+	}
+	msg := appendLP16([]byte{odohQuery}, cfg.keyID)
+	msg = appendLP16(msg, append(enc, sealed...))
+
+	endpoint := "https://" + t.host + t.path
+	if *odohProxy != "" {
+		endpoint = *odohProxy + "?" + url.Values{"targethost": {t.host}, "targetpath": {t.path}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", odohMessageType)
+	req.Header.Set("Accept", odohMessageType)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		// The target rotated its key.
+		t.forgetConfig()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ODoH: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535+1024))
+	if err != nil {
+		return nil, err
+	}
+	reply, err := cfg.openResponse(plain, secret, body)
+	if err != nil {
+		return nil, err
+	}
+	return stripPadding(reply), nil
+}
+
+// openResponse decrypts an ObliviousDoHMessage answering the padded query
+// plain, with the secret exported from the query's HPKE context.
+func (cfg *odohConfig) openResponse(plain, secret, body []byte) ([]byte, error) {
+	if len(body) < 1 || body[0] != odohResponse {
+		return nil, errors.New("ODoH: not a response")
+	}
+	nonce, rest, err := readLP16(body[1:])
+	if err != nil {
+		return nil, err
+	}
+	sealed, _, err := readLP16(rest)
+	if err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(cfg.newHash, secret, appendLP16(bytes.Clone(plain), nonce))
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Expand(cfg.newHash, prk, "odoh key", cfg.keyLen)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hkdf.Expand(cfg.newHash, prk, "odoh nonce", 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	opened, err := gcm.Open(nil, iv, sealed, appendLP16([]byte{odohResponse}, nonce))
+	if err != nil {
+		return nil, fmt.Errorf("ODoH: %v", err)
+	}
+	reply, _, err := readLP16(opened)
+	return reply, err
+}
+
+// isODoH reports whether an upstream spec names an ODoH target.
+func isODoH(spec string) bool {
+	return strings.HasPrefix(spec, "odoh://")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+var (
+	outboundIP        = flag.String("outbound-ip", "", "source address for connections to the upstreams, on multi-homed hosts")
+	outboundInterface = flag.String("outbound-interface", "", "network interface for connections to the upstreams, e.g. wan0 (bound to the device on Linux, else to its first address)")
+	outboundMark      = flag.Int("outbound-mark", 0, "SO_MARK firewall mark of connections to the upstreams, for policy routing (Linux only)")
+)
+
+// outboundAddr is the source address upstream connections are bound to,
+// or nil.
+var outboundAddr net.IP
+
+func setupOutbound() {
+	if *outboundIP != "" {
+		if outboundAddr = net.ParseIP(*outboundIP); outboundAddr == nil {
+			log.Fatalf("bad -outbound-ip %q", *outboundIP)
+		}
+	}
+	if err := checkOutboundOptions(); err != nil {
+		log.Fatal(err)
+	}
+	if *outboundIP == "" && *outboundInterface == "" && *outboundMark == 0 {
+		return
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = outboundDialer("tcp").DialContext
+	odohClient.Transport = t
+	infof("Binding upstream connections: address %q, interface %q, mark %d", *outboundIP, *outboundInterface, *outboundMark)
+}
+
+// outboundDialer returns a dialer for upstream connections over network,
+// tcp or udp, honouring the -outbound options.
+func outboundDialer(network string) *net.Dialer {
+	d := &net.Dialer{Timeout: *queryTimeout, Control: outboundControl}
+	if outboundAddr != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: outboundAddr}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: outboundAddr}
+		}
+	}
+	return d
+}
+
+// Attempts at binding a random source port before giving up, for when
+// the ones picked are taken.
+const sourcePortTries = 5
+
+// dialRandomPort connects a UDP socket to server from a source port picked
+// at random out of the unprivileged range, rather than trusting the
+// system to pick ephemeral ports unpredictably.
+func dialRandomPort(server string) (net.Conn, error) {
+	var err error
+	for try := 0; try < sourcePortTries; try++ {
+		d := outboundDialer("udp")
+		d.LocalAddr = &net.UDPAddr{IP: outboundAddr, Port: 1024 + rand.IntN(65536-1024)}
+		var conn net.Conn
+		conn, err = dialHost(context.Background(), d, "udp", server)
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return conn, err
+		}
+	}
+	return nil, err
+}
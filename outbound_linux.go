@@ -0,0 +1,28 @@
+package main
+
+import "syscall"
+
+func checkOutboundOptions() error {
+	return nil
+}
+
+// outboundControl binds an upstream socket to -outbound-interface and
+// sets its -outbound-mark before it connects.
+func outboundControl(network, address string, c syscall.RawConn) error {
+	if *outboundInterface == "" && *outboundMark == 0 {
+		return nil
+	}
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if *outboundInterface != "" {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, *outboundInterface)
+		}
+		if err == nil && *outboundMark != 0 {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, *outboundMark)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// checkOutboundOptions binds to the address of -outbound-interface, as
+// there is no portable way to bind a socket to a device.
+func checkOutboundOptions() error {
+	if *outboundMark != 0 {
+		return errors.New("-outbound-mark is only supported on Linux")
+	}
+	if *outboundInterface == "" || outboundAddr != nil {
+		return nil
+	}
+	ifi, err := net.InterfaceByName(*outboundInterface)
+	if err != nil {
+		return err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+			outboundAddr = ipnet.IP
+			return nil
+		}
+	}
+	return fmt.Errorf("interface %s has no address to bind to", *outboundInterface)
+}
+
+func outboundControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
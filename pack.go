@@ -0,0 +1,127 @@
+package main
+
+import "encoding/binary"
+
+func Btoi(b bool) uint16 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// packDomainName appends name to b in uncompressed wire format. Dots and
+// backslashes escaped with a backslash are part of a label.
+func packDomainName(b []byte, name string) []byte {
+	var label []byte
+	flush := func() {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		if len(label) > 0 {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+		label = label[:0]
+	}
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c == '\\' && i+1 < len(name):
+			i++
+			label = append(label, name[i])
+		case c == '.':
+			flush()
+		default:
+			label = append(label, c)
+		}
+	}
+	flush()
+	return append(b, 0)
+}
+
+func packRR(b []byte, rr dnsRR) []byte {
+	b = packDomainName(b, rr.Name)
+	b = binary.BigEndian.AppendUint16(b, rr.Rrtype)
+	b = binary.BigEndian.AppendUint16(b, rr.Class)
+	b = binary.BigEndian.AppendUint32(b, rr.Ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rr.Data)))
+	return append(b, rr.Data...)
+}
+
+// packDNSMsg is the inverse of parseDNSMsg. The section counts are taken
+// from the slices, not from the header fields.
+func packDNSMsg(msg dnsMsg) []byte {
+	dnsmisc := Btoi(msg.response)<<15 |
+		uint16(msg.opcode&0x0F)<<11 |
+		Btoi(msg.authoritative)<<10 |
+		Btoi(msg.truncated)<<9 |
+		Btoi(msg.recursion_desired)<<8 |
+		Btoi(msg.recursion_available)<<7 |
+		Btoi(msg.authenticated_data)<<5 |
+		Btoi(msg.checking_disabled)<<4 |
+		uint16(msg.rcode&0x0F)
+
+	b := make([]byte, 0, 512)
+	b = binary.BigEndian.AppendUint16(b, msg.id)
+	b = binary.BigEndian.AppendUint16(b, dnsmisc)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(msg.question)))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(msg.answer)))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(msg.ns)))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(msg.extra)))
+	for _, q := range msg.question {
+		b = packDomainName(b, q.Name)
+		b = binary.BigEndian.AppendUint16(b, q.Qtype)
+		b = binary.BigEndian.AppendUint16(b, q.Qclass)
+	}
+	for _, rr := range msg.answer {
+		b = packRR(b, rr)
+	}
+	for _, rr := range msg.ns {
+		b = packRR(b, rr)
+	}
+	for _, rr := range msg.extra {
+		b = packRR(b, rr)
+	}
+	return b
+}
+
+// newReply returns an empty response to query, echoing its ID and
+// question section.
+func newReply(query dnsMsg, rcode uint) dnsMsg {
+	var msg dnsMsg
+	msg.id = query.id
+	msg.response = true
+	msg.opcode = query.opcode
+	msg.recursion_desired = query.recursion_desired
+	msg.recursion_available = true
+	msg.rcode = rcode
+	msg.question = query.question
+	if ednsOPT(query) != nil {
+		msg.extra = []dnsRR{newOPT()}
+	}
+	return msg
+}
+
+// negativeTTL is used for negative answers the proxy makes up itself.
+const negativeTTL = 10800
+
+// syntheticSOA returns an SOA record for a zone the proxy answers for
+// itself, to be placed in the authority section of negative answers so
+// that clients can cache them. The values are the ones of RFC 6303
+// section 3.
+func syntheticSOA(zone string) dnsRR {
+	b := packDomainName(nil, zone)
+	b = packDomainName(b, "nobody.invalid")
+	for _, v := range []uint32{1, 3600, 1200, 604800, negativeTTL} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return dnsRR{Name: zone, Rrtype: dnsTypeSOA, Class: dnsClassINET, Ttl: negativeTTL, Rdlength: uint16(len(b)), Data: b}
+}
+
+// negativeReply returns an NXDOMAIN or NODATA answer for a name inside
+// zone, with a synthetic SOA.
+func negativeReply(query dnsMsg, zone string, rcode uint) []byte {
+	reply := newReply(query, rcode)
+	reply.authoritative = true
+	reply.ns = []dnsRR{syntheticSOA(zone)}
+	return packDNSMsg(reply)
+}
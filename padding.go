@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+)
+
+var ednsPadding = flag.Bool("edns-padding", true, "pad replies to DoT and DoH clients that pad their queries, and queries to ODoH upstreams, with the EDNS padding option (RFC 7830)")
+
+const ednsOptionPadding = 12
+
+// Block sizes recommended by RFC 8467 section 4.1.
+const (
+	queryPadBlock = 128
+	replyPadBlock = 468
+)
+
+// splitPadding returns the EDNS options in the rdata of an OPT record
+// other than padding, and whether there was a padding option.
+func splitPadding(data []byte) ([]byte, bool) {
+	var out []byte
+	padded := false
+	for len(data) >= 4 {
+		code := binary.BigEndian.Uint16(data)
+		n := 4 + int(binary.BigEndian.Uint16(data[2:]))
+		if n > len(data) {
+			break
+		}
+		if code == ednsOptionPadding {
+			padded = true
+		} else {
+			out = append(out, data[:n]...)
+		}
+		data = data[n:]
+	}
+	return out, padded
+}
+
+// padMessage packs msg with a padding option bringing its size to a
+// multiple of block. msg must have an OPT record.
+func padMessage(msg dnsMsg, block int) []byte {
+	msg.extra = append([]dnsRR{}, msg.extra...)
+	opt := ednsOPT(msg)
+	opt.Data, _ = splitPadding(opt.Data)
+	opt.Rdlength = uint16(len(opt.Data))
+	n := len(packDNSMsg(msg)) + 4
+	pad := (block - n%block) % block
+	opt.Data = binary.BigEndian.AppendUint16(append([]byte{}, opt.Data...), ednsOptionPadding)
+	opt.Data = binary.BigEndian.AppendUint16(opt.Data, uint16(pad))
+	opt.Data = append(opt.Data, make([]byte, pad)...)
+	opt.Rdlength = uint16(len(opt.Data))
+	return packDNSMsg(msg)
+}
+
+// padReply pads a reply to an encrypted transport when the client padded
+// its query, as RFC 8467 asks.
+func padReply(query, reply []byte) []byte {
+	if !*ednsPadding {
+		return reply
+	}
+	q, err := parseDNSMsg(query)
+	if err != nil {
+		return reply
+	}
+	opt := ednsOPT(q)
+	if opt == nil {
+		return reply
+	}
+	if _, padded := splitPadding(opt.Data); !padded {
+		return reply
+	}
+	msg, err := parseDNSMsg(reply)
+	if err != nil || ednsOPT(msg) == nil {
+		return reply
+	}
+	return padMessage(msg, replyPadBlock)
+}
+
+// padQuery pads a query to an upstream, which asks it to pad the reply.
+func padQuery(data []byte) []byte {
+	if !*ednsPadding {
+		return data
+	}
+	msg, err := parseDNSMsg(data)
+	if err != nil || ednsOPT(msg) == nil {
+		return data
+	}
+	return padMessage(msg, queryPadBlock)
+}
+
+// stripPadding removes the padding from an upstream reply, which is of
+// no use past the encrypted hop.
+func stripPadding(reply []byte) []byte {
+	msg, err := parseDNSMsg(reply)
+	if err != nil {
+		return reply
+	}
+	opt := ednsOPT(msg)
+	if opt == nil {
+		return reply
+	}
+	data, padded := splitPadding(opt.Data)
+	if !padded {
+		return reply
+	}
+	msg.extra = append([]dnsRR{}, msg.extra...)
+	opt = ednsOPT(msg)
+	opt.Data, opt.Rdlength = data, uint16(len(data))
+	return packDNSMsg(msg)
+}
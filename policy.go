@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	policyFlags stringList
+	policyFile  = flag.String("policy-file", "", "read -policy rules from this file, one per line")
+)
+
+func init() {
+	flag.Var(&policyFlags, "policy", `per-query policy "CONDITION then ACTION" (repeatable, first match wins), e.g. "client in 10.0.0.0/8 and qname ends with .cn then upstream 192.0.2.53"; conditions are client in CIDR,..., qname is NAME, qname ends with SUFFIX, qname matches /regexp/, qtype is TYPE,..., view is NAME and true, combined with and, or, not and parentheses; actions are allow, refuse, nxdomain, drop and upstream ADDR,...`)
+}
+
+// A policy is a rule of -policy: the first one whose condition holds for
+// a query decides what happens to it.
+type policy struct {
+	text   string
+	cond   policyCond
+	action string
+	// The upstreams of the upstream action.
+	upstreams upstreamGroup
+}
+
+type policyCond func(r *request) bool
+
+var policies []*policy
+
+func setupPolicies() {
+	rules := append([]string{}, policyFlags...)
+	if *policyFile != "" {
+		f, err := os.Open(*policyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line, _, _ := strings.Cut(s.Text(), "#")
+			if line = strings.TrimSpace(line); line != "" {
+				rules = append(rules, line)
+			}
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, rule := range rules {
+		p, err := parsePolicy(rule)
+		if err != nil {
+			log.Fatalf("bad policy %q: %v", rule, err)
+		}
+		policies = append(policies, p)
+	}
+	if len(policies) > 0 {
+		infof("Applying %d query policies", len(policies))
+	}
+}
+
+// policyTokens splits a rule into words, with parentheses on their own.
+// A /regexp/ is one word whatever it holds, up to the next slash that is
+// not escaped with a backslash.
+func policyTokens(rule string) []string {
+	var toks []string
+	for i := 0; i < len(rule); {
+		switch c := rule[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, rule[i:i+1])
+			i++
+		case c == '/':
+			j := i + 1
+			for j < len(rule) && rule[j] != '/' {
+				if rule[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j+1, len(rule))
+			toks = append(toks, rule[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(rule) && !strings.ContainsRune(" \t()", rune(rule[j])) {
+				j++
+			}
+			toks = append(toks, rule[i:j])
+			i = j
+		}
+	}
+	return toks
+}
+
+// policyParser parses the condition of a rule by recursive descent:
+//
+//	expr   = term { "or" term }
+//	term   = factor { "and" factor }
+//	factor = "not" factor | "(" expr ")" | test
+type policyParser struct {
+	toks []string
+}
+
+func (p *policyParser) peek() string {
+	if len(p.toks) == 0 {
+		return ""
+	}
+	return strings.ToLower(p.toks[0])
+}
+
+func (p *policyParser) next() (string, error) {
+	if len(p.toks) == 0 {
+		return "", fmt.Errorf("unexpected end of rule")
+	}
+	t := p.toks[0]
+	p.toks = p.toks[1:]
+	return t, nil
+}
+
+func (p *policyParser) expect(words ...string) error {
+	for _, w := range words {
+		t, err := p.next()
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(t, w) {
+			return fmt.Errorf("want %q, got %q", w, t)
+		}
+	}
+	return nil
+}
+
+func (p *policyParser) expr() (policyCond, error) {
+	c, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.next()
+		d, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		c = func(c, d policyCond) policyCond {
+			return func(r *request) bool { return c(r) || d(r) }
+		}(c, d)
+	}
+	return c, nil
+}
+
+func (p *policyParser) term() (policyCond, error) {
+	c, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.next()
+		d, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		c = func(c, d policyCond) policyCond {
+			return func(r *request) bool { return c(r) && d(r) }
+		}(c, d)
+	}
+	return c, nil
+}
+
+func (p *policyParser) factor() (policyCond, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		c, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *request) bool { return !c(r) }, nil
+	case "(":
+		p.next()
+		c, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expect(")")
+	}
+	return p.test()
+}
+
+func (p *policyParser) test() (policyCond, error) {
+	subject, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(subject) {
+	case "true":
+		return func(*request) bool { return true }, nil
+	case "client":
+		if err := p.expect("in"); err != nil {
+			return nil, err
+		}
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		var nets []*net.IPNet
+		for _, s := range strings.Split(arg, ",") {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, n)
+		}
+		return func(r *request) bool {
+			for _, n := range nets {
+				if r.client != nil && n.Contains(r.client) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "qname":
+		op, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(op) {
+		case "is":
+			arg, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			name := canonicalName(arg)
+			return func(r *request) bool { return queryName(r) == name }, nil
+		case "ends":
+			if err := p.expect("with"); err != nil {
+				return nil, err
+			}
+			arg, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			suffix := strings.TrimPrefix(canonicalName(arg), ".")
+			return func(r *request) bool {
+				name := queryName(r)
+				return name == suffix || strings.HasSuffix(name, "."+suffix)
+			}, nil
+		case "matches":
+			arg, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			if !isPattern(arg) {
+				return nil, fmt.Errorf("want a /regexp/, got %q", arg)
+			}
+			re, err := regexp.Compile(arg[1 : len(arg)-1])
+			if err != nil {
+				return nil, err
+			}
+			return func(r *request) bool { return re.MatchString(queryName(r)) }, nil
+		}
+		return nil, fmt.Errorf("unknown qname test %q", op)
+	case "qtype":
+		if err := p.expect("is"); err != nil {
+			return nil, err
+		}
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		types, err := parseTypeList([]string{arg})
+		if err != nil {
+			return nil, err
+		}
+		return func(r *request) bool {
+			return len(r.query.question) == 1 && types[r.query.question[0].Qtype]
+		}, nil
+	case "view":
+		if err := p.expect("is"); err != nil {
+			return nil, err
+		}
+		name, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *request) bool { return r.view != nil && r.view.name == name }, nil
+	}
+	return nil, fmt.Errorf("unknown condition %q", subject)
+}
+
+func queryName(r *request) string {
+	if len(r.query.question) != 1 {
+		return ""
+	}
+	return canonicalName(r.query.question[0].Name)
+}
+
+func parsePolicy(rule string) (*policy, error) {
+	toks := policyTokens(rule)
+	then := -1
+	for i, t := range toks {
+		if strings.EqualFold(t, "then") {
+			then = i
+		}
+	}
+	if then < 0 {
+		return nil, fmt.Errorf("no then")
+	}
+	p := &policyParser{toks: toks[:then]}
+	cond, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.toks) > 0 {
+		return nil, fmt.Errorf("unexpected %q", p.toks[0])
+	}
+	action := toks[then+1:]
+	if len(action) == 0 {
+		return nil, fmt.Errorf("no action")
+	}
+	pol := &policy{text: rule, cond: cond, action: strings.ToLower(action[0])}
+	switch pol.action {
+	case "allow", "refuse", "nxdomain", "drop":
+		if len(action) != 1 {
+			return nil, fmt.Errorf("unexpected %q", action[1])
+		}
+	case "upstream":
+		if len(action) != 2 {
+			return nil, fmt.Errorf("want upstream ADDR,...")
+		}
+		if pol.upstreams, err = parseUpstreams(action[1:]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", action[0])
+	}
+	return pol, nil
+}
+
+// policyStage applies the first policy whose condition holds.
+func policyStage(r *request, next handler) []byte {
+	for _, p := range policies {
+		if !p.cond(r) {
+			continue
+		}
+		debugf("policy %q: %v from %s", p.text, r.query.question, r.client)
+		switch p.action {
+		case "refuse":
+			return packDNSMsg(newReply(r.query, dnsRcodeRefused))
+		case "nxdomain":
+			return packDNSMsg(newReply(r.query, dnsRcodeNameError))
+		case "drop":
+			return nil
+		case "upstream":
+			r.upstreams = p.upstreams
+		}
+		break
+	}
+	return next(r)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"math/rand/v2"
+)
+
+var (
+	minimizeQueries = flag.Bool("minimize-queries", false, "strip the client's EDNS options, such as client subnet and cookies, from forwarded queries")
+	qname0x20       = flag.Bool("qname-0x20", false, "randomize the capitalization of forwarded names and reject replies that do not echo it")
+)
+
+// randomizeCase flips the case of the letters in the question name of
+// the packed query data at random (draft-vixie-dnsext-dns0x20), and
+// returns the new query with the name as sent. Spoofed replies have to
+// guess the capitalization on top of the ID.
+func randomizeCase(data []byte) ([]byte, string) {
+	out := bytes.Clone(data)
+	for i := 12; i < len(out) && out[i] != 0 && out[i]&0xC0 == 0; i += int(out[i]) + 1 {
+		for j := i + 1; j <= i+int(out[i]) && j < len(out); j++ {
+			c := out[j] | 0x20
+			if c >= 'a' && c <= 'z' && rand.IntN(2) == 0 {
+				out[j] ^= 0x20
+			}
+		}
+	}
+	msg, err := parseDNSMsg(out)
+	if err != nil || len(msg.question) != 1 {
+		return data, ""
+	}
+	return out, msg.question[0].Name
+}
+
+// echoesCase reports whether reply carries the question name exactly as
+// it was sent.
+func echoesCase(reply dnsMsg, sent string) bool {
+	return sent == "" || len(reply.question) == 1 && reply.question[0].Name == sent
+}
+
+// restoreCase gives reply back the question of query, and the client's
+// capitalization to the records owned by the question name.
+func restoreCase(query, reply dnsMsg) dnsMsg {
+	sent := reply.question[0].Name
+	reply.question = query.question
+	for _, rrs := range []*[]dnsRR{&reply.answer, &reply.ns, &reply.extra} {
+		out := make([]dnsRR, len(*rrs))
+		for i, rr := range *rrs {
+			if rr.Name == sent {
+				rr.Name = query.question[0].Name
+			}
+			out[i] = rr
+		}
+		*rrs = out
+	}
+	return reply
+}
+
+// repliesInCase reports whether the packed reply echoes the name sent in
+// the capitalization it was sent in.
+func repliesInCase(reply []byte, sent string) bool {
+	if sent == "" {
+		return true
+	}
+	msg, err := parseDNSMsg(reply)
+	return err == nil && echoesCase(msg, sent)
+}
+
+// withClientCase gives the packed reply to a query sent with randomized
+// capitalization the question of the original query data.
+func withClientCase(data, reply []byte) []byte {
+	query, err := parseDNSMsg(data)
+	if err != nil {
+		return reply
+	}
+	msg, err := parseDNSMsg(reply)
+	if err != nil || len(msg.question) != 1 {
+		return reply
+	}
+	return packDNSMsg(restoreCase(query, msg))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// checkPrivilegedPort warns before binding when addr uses a port the
+// process is unlikely to be allowed to bind.
+func checkPrivilegedPort(addr string) {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port >= 1024 {
+		return
+	}
+	if ok, why := canBindPrivileged(port); !ok {
+		warnf("%s; binding %s will probably fail", why, addr)
+	}
+}
+
+// bindError wraps a listen error with instructions for fixing it when
+// it was caused by missing privileges.
+func bindError(addr string, err error) error {
+	if !errors.Is(err, syscall.EACCES) && !errors.Is(err, syscall.EPERM) {
+		return err
+	}
+	exe, _ := os.Executable()
+	if exe == "" {
+		exe = "dns2tcp"
+	}
+	return fmt.Errorf("%v\n%s", err, privilegedGuidance(exe, addr))
+}
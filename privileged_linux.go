@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const capNetBindService = 10
+
+// canBindPrivileged reports whether the process may bind port, either
+// as root, through CAP_NET_BIND_SERVICE or because the kernel lowered
+// net.ipv4.ip_unprivileged_port_start.
+func canBindPrivileged(port int) (bool, string) {
+	if os.Geteuid() == 0 {
+		return true, ""
+	}
+	if b, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); err == nil {
+		if start, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && port >= start {
+			return true, ""
+		}
+	}
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false, "cannot read capabilities"
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		v, ok := strings.CutPrefix(s.Text(), "CapEff:")
+		if !ok {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+		if err != nil {
+			break
+		}
+		if caps&(1<<capNetBindService) != 0 {
+			return true, ""
+		}
+		return false, "not running as root and CAP_NET_BIND_SERVICE is missing"
+	}
+	return false, "cannot read capabilities"
+}
+
+func privilegedGuidance(exe, addr string) string {
+	return fmt.Sprintf(`Binding %s needs root or CAP_NET_BIND_SERVICE. Either:
+  sudo setcap 'cap_net_bind_service=+ep' %s
+or run under systemd with AmbientCapabilities=CAP_NET_BIND_SERVICE,
+or listen on a port above 1023 with -listen.`, addr, exe)
+}
@@ -0,0 +1,26 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func canBindPrivileged(port int) (bool, string) {
+	// macOS lets unprivileged users bind low ports since 10.14.
+	if os.Geteuid() == 0 || runtime.GOOS == "darwin" {
+		return true, ""
+	}
+	return false, "not running as root"
+}
+
+func privilegedGuidance(exe, addr string) string {
+	hint := "run it as root"
+	switch runtime.GOOS {
+	case "freebsd":
+		hint = "lower net.inet.ip.portrange.reservedhigh with sysctl, or use mac_portacl"
+	}
+	return fmt.Sprintf("Binding %s with %s needs privileges: %s,\nor listen on a port above 1023 with -listen.", addr, exe, hint)
+}
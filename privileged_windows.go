@@ -0,0 +1,12 @@
+package main
+
+import "fmt"
+
+// Windows has no privileged port range.
+func canBindPrivileged(port int) (bool, string) {
+	return true, ""
+}
+
+func privilegedGuidance(exe, addr string) string {
+	return fmt.Sprintf("Binding %s with %s was denied; check that no other DNS service owns the port.", addr, exe)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var upstreamProxy = flag.String("upstream-proxy", "", "reach the upstreams through this proxy, socks5://[user:pass@]host:port or http://[user:pass@]host:port (HTTP CONNECT); an upstream's ?proxy= option overrides it, ?proxy=direct for none")
+
+// parseProxy parses a proxy URL. Empty and "direct" mean no proxy.
+func parseProxy(s string) (*url.URL, error) {
+	if s == "" || s == "direct" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy %q, want socks5:// or http://", s)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy %q has no port", s)
+	}
+	return u, nil
+}
+
+// proxiedHTTPClient returns an HTTP client like odohClient that connects
+// through proxy.
+func proxiedHTTPClient(proxy *url.URL) *http.Client {
+	base, ok := odohClient.Transport.(*http.Transport)
+	if !ok {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	t := base.Clone()
+	t.Proxy = http.ProxyURL(proxy)
+	return &http.Client{Transport: t}
+}
+
+// dialUpstream opens a TCP connection to addr, through proxy if it is
+// not nil.
+func dialUpstream(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	d := outboundDialer("tcp")
+	if proxy == nil {
+		return dialHost(ctx, d, "tcp", addr)
+	}
+	conn, err := dialHost(ctx, d, "tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(*queryTimeout)
+	}
+	conn.SetDeadline(deadline)
+	if proxy.Scheme == "http" {
+		err = httpConnect(conn, proxy, addr)
+	} else {
+		err = socks5Connect(conn, proxy, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", proxy.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// SOCKS5 (RFC 1928) with username/password authentication (RFC 1929).
+const (
+	socks5Version      = 5
+	socks5NoAuth       = 0
+	socks5UserPass     = 2
+	socks5CmdConnect   = 1
+	socks5AddrIPv4     = 1
+	socks5AddrDomain   = 3
+	socks5AddrIPv6     = 4
+	socks5UserPassAuth = 1
+)
+
+func socks5Connect(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad port in %q", addr)
+	}
+
+	methods := []byte{socks5NoAuth}
+	if proxy.User != nil {
+		methods = append(methods, socks5UserPass)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	switch {
+	case resp[0] != socks5Version:
+		return errors.New("not a SOCKS5 proxy")
+	case resp[1] == socks5UserPass && proxy.User != nil:
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		msg := append([]byte{socks5UserPassAuth, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(pass))), pass...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return err
+		}
+		if resp[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	case resp[1] != socks5NoAuth:
+		return errors.New("no acceptable authentication method")
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(append(req, socks5AddrDomain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, socks5AddrIPv4), ip4...)
+	} else {
+		req = append(append(req, socks5AddrIPv6), ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[1] != 0 {
+		return fmt.Errorf("connect to %s failed with SOCKS error %d", addr, hdr[1])
+	}
+	// Skip the bound address and port.
+	var n int
+	switch hdr[3] {
+	case socks5AddrIPv4:
+		n = net.IPv4len
+	case socks5AddrIPv6:
+		n = net.IPv6len
+	case socks5AddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return errors.New("bad SOCKS5 reply")
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(n+2))
+	return err
+}
+
+// httpConnect opens a tunnel to addr with an HTTP CONNECT request.
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	// The upstream only speaks when spoken to.
+	if br.Buffered() > 0 {
+		return errors.New("unexpected data after CONNECT response")
+	}
+	return nil
+}
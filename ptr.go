@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var lanRanges = flag.String("lan-ranges", "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,169.254.0.0/16,fc00::/7,fe80::/10",
+	"comma-separated private ranges whose reverse lookups are answered locally")
+
+var ptrTemplateFlags stringList
+
+func init() {
+	flag.Var(&ptrTemplateFlags, "ptr-template", "name the addresses of cidr without a local record after a template, as cidr=template with {ip} standing for the address with dashes, e.g. 192.168.1.0/24=host-{ip}.lan; names of that form resolve back to the address (repeatable)")
+}
+
+var lanNets []*net.IPNet
+
+// ptrTemplate names the addresses in a subnet, e.g. host-{ip}.lan gives
+// host-192-168-1-5.lan for 192.168.1.5.
+type ptrTemplate struct {
+	net            *net.IPNet
+	prefix, suffix string
+}
+
+var ptrTemplates []ptrTemplate
+
+func setupPTRTemplates() {
+	for _, spec := range ptrTemplateFlags {
+		cidr, tmpl, ok := strings.Cut(spec, "=")
+		if !ok {
+			log.Fatalf("-ptr-template %q: want cidr=template", spec)
+		}
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			log.Fatalf("-ptr-template %q: %v", spec, err)
+		}
+		prefix, suffix, ok := strings.Cut(canonicalName(strings.TrimSpace(tmpl)), "{ip}")
+		if !ok || strings.Contains(suffix, "{ip}") {
+			log.Fatalf("-ptr-template %q: the template needs exactly one {ip}", spec)
+		}
+		ptrTemplates = append(ptrTemplates, ptrTemplate{net: n, prefix: prefix, suffix: suffix})
+	}
+}
+
+// name returns the templated name of ip, or "" if ip is not in the subnet.
+func (t ptrTemplate) name(ip net.IP) string {
+	if !t.net.Contains(ip) {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	s := strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+	return t.prefix + s + t.suffix
+}
+
+// addr returns the address a templated name stands for.
+func (t ptrTemplate) addr(name string) (net.IP, bool) {
+	s, ok := strings.CutPrefix(name, t.prefix)
+	if !ok {
+		return nil, false
+	}
+	if s, ok = strings.CutSuffix(s, t.suffix); !ok {
+		return nil, false
+	}
+	sep := ":"
+	if t.net.IP.To4() != nil {
+		sep = "."
+	}
+	ip := net.ParseIP(strings.ReplaceAll(s, "-", sep))
+	if ip == nil || !t.net.Contains(ip) || t.name(ip) != name {
+		return nil, false
+	}
+	return ip, true
+}
+
+func templateName(ip net.IP) (string, bool) {
+	for _, t := range ptrTemplates {
+		if name := t.name(ip); name != "" {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func templateAddr(name string) (net.IP, bool) {
+	name = canonicalName(name)
+	for _, t := range ptrTemplates {
+		if ip, ok := t.addr(name); ok {
+			return ip, true
+		}
+	}
+	return nil, false
+}
+
+func setupLANRanges() {
+	lanNets = nil
+	for _, s := range strings.Split(*lanRanges, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lanNets = append(lanNets, n)
+	}
+}
+
+func inLAN(ip net.IP) bool {
+	for _, n := range lanNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseToIP converts a complete in-addr.arpa or ip6.arpa name back to
+// the address it describes.
+func reverseToIP(name string) (net.IP, bool) {
+	name = canonicalName(name)
+	if v4, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		labels := strings.Split(v4, ".")
+		if len(labels) != 4 {
+			return nil, false
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, l := range labels {
+			b, err := strconv.ParseUint(l, 10, 8)
+			if err != nil {
+				return nil, false
+			}
+			ip[3-i] = byte(b)
+		}
+		return ip, true
+	}
+	if v6, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		labels := strings.Split(v6, ".")
+		if len(labels) != 32 {
+			return nil, false
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, l := range labels {
+			n, err := strconv.ParseUint(l, 16, 4)
+			if err != nil || len(l) != 1 {
+				return nil, false
+			}
+			ip[15-i/2] |= byte(n) << (4 * (i % 2))
+		}
+		return ip, true
+	}
+	return nil, false
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of ip.
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	const hexDigits = "0123456789abcdef"
+	b := make([]byte, 0, 72)
+	ip = ip.To16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		b = append(b, hexDigits[ip[i]&0x0F], '.', hexDigits[ip[i]>>4], '.')
+	}
+	return string(b) + "ip6.arpa"
+}
+
+// localPTR answers reverse lookups for LAN addresses from the local
+// table, then from the -ptr-template names. Addresses in LAN ranges that
+// are not known get NXDOMAIN rather than being leaked upstream, unless
+// their zone is forwarded with -local-zones-forward.
+func localPTR(query dnsMsg) []byte {
+	q := query.question[0]
+	ip, ok := reverseToIP(q.Name)
+	if !ok {
+		return nil
+	}
+	name, found := localRecords.lookupAddr(ip)
+	if !found {
+		name, found = templateName(ip)
+	}
+	if !found && (!inLAN(ip) || forwardedZone(canonicalName(q.Name))) {
+		return nil
+	}
+	if !found {
+		zone, ok := findLocalZone(canonicalName(q.Name))
+		if !ok {
+			zone = canonicalName(q.Name)
+		}
+		return negativeReply(query, zone, dnsRcodeNameError)
+	}
+	reply := newReply(query, dnsRcodeSuccess)
+	reply.authoritative = true
+	rr := dnsRR{Name: q.Name, Rrtype: dnsTypePTR, Class: dnsClassINET, Ttl: localTTL}
+	rr.Data = packDomainName(nil, name)
+	rr.Rdlength = uint16(len(rr.Data))
+	reply.answer = []dnsRR{rr}
+	return packDNSMsg(reply)
+}
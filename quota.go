@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	dailyQuota  = flag.Int64("daily-quota", 0, "queries each client may send per day, counted from local midnight; 0 counts them without a limit")
+	quotaAction = flag.String("quota-action", "refused", "what to do with queries over the daily quota: drop or refused")
+)
+
+// The most clients whose queries are counted in a day. Past that, new
+// clients are over their quota until the next day, or with no quota go
+// uncounted.
+const maxUsageClients = 100000
+
+// usage counts the queries of each client, keyed like the rate limit
+// buckets, for today and yesterday.
+var usage = struct {
+	sync.Mutex
+	day, prevDay string
+	today, prev  map[string]int64
+	warned       map[string]bool
+	// full is set when today has maxUsageClients clients.
+	full bool
+}{today: make(map[string]int64), warned: make(map[string]bool)}
+
+func setupQuotas() {
+	switch *quotaAction {
+	case "drop", "refused":
+	default:
+		log.Fatalf("bad -quota-action %q, want drop or refused", *quotaAction)
+	}
+	if *dailyQuota > 0 {
+		infof("Limiting clients to %d queries a day", *dailyQuota)
+	}
+	registerTrimHook(func() {
+		usage.Lock()
+		usage.prev = nil
+		usage.Unlock()
+	})
+}
+
+// countQuery adds a query to the client's count for today, and reports
+// whether it is within the quota.
+func countQuery(client net.IP) bool {
+	if client == nil {
+		return true
+	}
+	key := rateKey(client)
+	day := time.Now().Format(time.DateOnly)
+	usage.Lock()
+	defer usage.Unlock()
+	if day != usage.day {
+		if usage.day != "" {
+			usage.prevDay, usage.prev = usage.day, usage.today
+		}
+		usage.day, usage.today = day, make(map[string]int64)
+		usage.full = false
+		clear(usage.warned)
+	}
+	if _, ok := usage.today[key]; !ok && len(usage.today) >= maxUsageClients {
+		if !usage.full {
+			// Make room by forgetting the clients seen only once, of
+			// which a flood from spoofed addresses leaves many.
+			for k, n := range usage.today {
+				if n == 1 {
+					delete(usage.today, k)
+				}
+			}
+			if len(usage.today) > maxUsageClients*3/4 {
+				if *dailyQuota > 0 {
+					warnf("Counting the queries of %d clients, refusing new ones until tomorrow", len(usage.today))
+				} else {
+					warnf("Counting the queries of %d clients, not counting new ones until tomorrow", len(usage.today))
+				}
+				usage.full = true
+			}
+		}
+		// A client that cannot be counted cannot be held to its quota
+		// either, so it does not get past one.
+		if usage.full {
+			return *dailyQuota <= 0
+		}
+	}
+	usage.today[key]++
+	if *dailyQuota <= 0 || usage.today[key] <= *dailyQuota {
+		return true
+	}
+	if !usage.warned[key] {
+		warnf("%s is over its daily quota of %d queries", key, *dailyQuota)
+		usage.warned[key] = true
+	}
+	return false
+}
+
+// overQuota reports whether query goes over the client's daily quota,
+// and the reply to send if it does. A nil reply means the query is
+// dropped.
+func overQuota(query dnsMsg, client net.IP) ([]byte, bool) {
+	if countQuery(client) {
+		return nil, false
+	}
+	if *quotaAction == "refused" {
+		return packDNSMsg(newReply(query, dnsRcodeRefused)), true
+	}
+	return nil, true
+}
+
+type clientUsage struct {
+	Day     string           `json:"day"`
+	Quota   int64            `json:"quota,omitempty"`
+	Clients map[string]int64 `json:"clients"`
+}
+
+// usageReport returns the query counts for today and, once the first
+// day is over, yesterday.
+func usageReport() []clientUsage {
+	usage.Lock()
+	defer usage.Unlock()
+	report := []clientUsage{{Day: usage.day, Quota: *dailyQuota, Clients: make(map[string]int64, len(usage.today))}}
+	for k, n := range usage.today {
+		report[0].Clients[k] = n
+	}
+	if usage.prev != nil {
+		prev := clientUsage{Day: usage.prevDay, Quota: *dailyQuota, Clients: make(map[string]int64, len(usage.prev))}
+		for k, n := range usage.prev {
+			prev.Clients[k] = n
+		}
+		report = append(report, prev)
+	}
+	return report
+}
+
+// resetUsage forgets today's count of one client, or of all of them
+// when key is empty, lifting their quota until they reach it again.
+func resetUsage(key string) bool {
+	usage.Lock()
+	defer usage.Unlock()
+	if key == "" {
+		clear(usage.today)
+		clear(usage.warned)
+		usage.full = false
+		return true
+	}
+	if _, ok := usage.today[key]; !ok {
+		return false
+	}
+	delete(usage.today, key)
+	delete(usage.warned, key)
+	return true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	rateLimit  = flag.Float64("rate-limit", 0, "queries per second allowed from each client, 0 for no limit")
+	rateBurst  = flag.Int("rate-burst", 20, "queries a client may send at once before -rate-limit applies")
+	rateAction = flag.String("rate-limit-action", "drop", "what to do with queries over the rate limit: drop or refused")
+)
+
+// bucket is the token bucket of one client.
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	limited bool
+}
+
+var buckets = struct {
+	sync.Mutex
+	m map[string]*bucket
+}{m: make(map[string]*bucket)}
+
+func setupRateLimit() {
+	if *rateLimit <= 0 {
+		return
+	}
+	switch *rateAction {
+	case "drop", "refused":
+	default:
+		log.Fatalf("bad -rate-limit-action %q, want drop or refused", *rateAction)
+	}
+	infof("Rate limiting clients to %g queries/s, bursts of %d", *rateLimit, *rateBurst)
+	registerTrimHook(func() {
+		buckets.Lock()
+		clear(buckets.m)
+		buckets.Unlock()
+	})
+	go func() {
+		// Forget clients whose buckets have filled up again.
+		for range time.Tick(time.Minute) {
+			buckets.Lock()
+			for k, b := range buckets.m {
+				if time.Since(b.last).Seconds()*(*rateLimit) >= float64(*rateBurst) {
+					delete(buckets.m, k)
+				}
+			}
+			buckets.Unlock()
+		}
+	}()
+}
+
+// rateKey groups IPv6 clients by /64, as a single host usually has a
+// whole prefix to pick addresses from.
+func rateKey(ip net.IP) string {
+	if ip.To4() == nil && len(ip) == net.IPv6len {
+		return ip.Mask(net.CIDRMask(64, 128)).String()
+	}
+	return ip.String()
+}
+
+// allowQuery takes a token from the bucket of client.
+func allowQuery(client net.IP) bool {
+	if *rateLimit <= 0 || client == nil {
+		return true
+	}
+	key := rateKey(client)
+	now := time.Now()
+	buckets.Lock()
+	defer buckets.Unlock()
+	b, ok := buckets.m[key]
+	if !ok {
+		b = &bucket{tokens: float64(*rateBurst), last: now}
+		buckets.m[key] = b
+	}
+	b.tokens = min(float64(*rateBurst), b.tokens+now.Sub(b.last).Seconds()*(*rateLimit))
+	b.last = now
+	if b.tokens < 1 {
+		if !b.limited {
+			warnf("Rate limiting %s", key)
+			b.limited = true
+		}
+		return false
+	}
+	b.tokens--
+	b.limited = false
+	return true
+}
+
+// rateLimited reports whether query goes over the client's rate, and the
+// reply to send if it does. A nil reply means the query is dropped.
+func rateLimited(query dnsMsg, client net.IP) ([]byte, bool) {
+	if allowQuery(client) {
+		return nil, false
+	}
+	if *rateAction == "refused" {
+		return packDNSMsg(newReply(query, dnsRcodeRefused)), true
+	}
+	return nil, true
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// TTL of answers synthesized from local data.
+const localTTL = 60
+
+var localRecordFlags stringList
+
+func init() {
+	flag.Var(&localRecordFlags, "local-record", "answer name=ip locally, name=ip@cidr only for clients in cidr, or a typed record like \"name CNAME target\" (repeatable)")
+}
+
+// staticRecords holds the typed -local-record entries other than A and
+// AAAA, which live in localRecords so that reverse lookups see them.
+var staticRecords = make(map[string][]dnsRR)
+
+// localAddr is an address for a local name. When view is set the address
+// is only handed to clients inside that subnet (split horizon).
+type localAddr struct {
+	name string
+	ip   net.IP
+	view *net.IPNet
+}
+
+// localTable holds the names the proxy answers itself, indexed both by
+// name and by address for reverse lookups. Entries are grouped by the
+// source they were loaded from so a source can be reloaded on its own.
+type localTable struct {
+	mu      sync.RWMutex
+	order   []string
+	sources map[string][]localAddr
+	forward map[string][]localAddr
+	reverse map[string]string
+}
+
+var localRecords = &localTable{
+	sources: make(map[string][]localAddr),
+	forward: make(map[string][]localAddr),
+	reverse: make(map[string]string),
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func (t *localTable) index(a localAddr) {
+	t.forward[a.name] = append(t.forward[a.name], a)
+	if _, ok := t.reverse[a.ip.String()]; !ok {
+		t.reverse[a.ip.String()] = a.name
+	}
+}
+
+func (t *localTable) add(source, name string, ip net.IP, view *net.IPNet) {
+	a := localAddr{canonicalName(name), ip, view}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.sources[source]; !ok {
+		t.order = append(t.order, source)
+	}
+	t.sources[source] = append(t.sources[source], a)
+	t.index(a)
+}
+
+// replace swaps all entries of source for addrs.
+func (t *localTable) replace(source string, addrs []localAddr) {
+	for i := range addrs {
+		addrs[i].name = canonicalName(addrs[i].name)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.sources[source]; !ok {
+		t.order = append(t.order, source)
+	}
+	t.sources[source] = addrs
+	t.forward = make(map[string][]localAddr)
+	t.reverse = make(map[string]string)
+	for _, src := range t.order {
+		for _, a := range t.sources[src] {
+			t.index(a)
+		}
+	}
+}
+
+// lookup returns the addresses of name as seen by client: those of the
+// most specific view containing the client, or else the ones without a
+// view.
+func (t *localTable) lookup(name string, client net.IP) ([]net.IP, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	addrs, ok := t.forward[canonicalName(name)]
+	if !ok {
+		return nil, false
+	}
+	var ips []net.IP
+	best := -1
+	for _, a := range addrs {
+		bits := -1
+		if a.view != nil {
+			if client == nil || !a.view.Contains(client) {
+				continue
+			}
+			bits, _ = a.view.Mask.Size()
+		}
+		if bits > best {
+			ips, best = nil, bits
+		}
+		if bits == best {
+			ips = append(ips, a.ip)
+		}
+	}
+	return ips, true
+}
+
+func (t *localTable) lookupAddr(ip net.IP) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	name, ok := t.reverse[ip.String()]
+	return name, ok
+}
+
+func setupLocalRecords() {
+	for _, r := range localRecordFlags {
+		if fields := zoneTokens(r); len(fields) > 2 {
+			if err := addStaticRecord(fields); err != nil {
+				log.Fatalf("bad -local-record %q: %v", r, err)
+			}
+			continue
+		}
+		name, addr, ok := strings.Cut(r, "=")
+		addr, cidr, hasView := strings.Cut(addr, "@")
+		ip := net.ParseIP(addr)
+		if !ok || ip == nil {
+			log.Fatalf("bad -local-record %q, want name=ip or name=ip@cidr", r)
+		}
+		var view *net.IPNet
+		if hasView {
+			var err error
+			if _, view, err = net.ParseCIDR(cidr); err != nil {
+				log.Fatalf("bad -local-record %q: %v", r, err)
+			}
+		}
+		localRecords.add("-local-record", name, ip, view)
+	}
+}
+
+// addStaticRecord adds a record given as name, type and rdata in master
+// file syntax.
+func addStaticRecord(fields []string) error {
+	name := canonicalName(fields[0])
+	rrtype, ok := parseType(fields[1])
+	if !ok || rrtype == dnsTypeSOA {
+		return fmt.Errorf("unsupported type %q", fields[1])
+	}
+	data, err := packRdata(rrtype, fields[2:], "")
+	if err != nil {
+		return err
+	}
+	switch rrtype {
+	case dnsTypeA, dnsTypeAAAA:
+		localRecords.add("-local-record", name, net.IP(data), nil)
+	default:
+		rr := dnsRR{Name: name, Rrtype: rrtype, Class: dnsClassINET, Ttl: localTTL, Rdlength: uint16(len(data)), Data: data}
+		staticRecords[name] = append(staticRecords[name], rr)
+	}
+	return nil
+}
+
+// staticAnswer answers queries for names with typed local records,
+// together with any local addresses they have. A CNAME is followed as
+// long as its target is local data too.
+func staticAnswer(query dnsMsg, client net.IP) []byte {
+	if len(query.question) != 1 {
+		return nil
+	}
+	q := query.question[0]
+	name := canonicalName(q.Name)
+	if _, ok := staticRecords[name]; !ok {
+		return nil
+	}
+	reply := newReply(query, dnsRcodeSuccess)
+	reply.authoritative = true
+	for i := 0; i < 8; i++ {
+		if ips, ok := localRecords.lookup(name, client); ok {
+			reply.answer = append(reply.answer, addressRRs(name, q.Qtype, ips)...)
+		}
+		var cname *dnsRR
+		rrs := staticRecords[name]
+		for j, rr := range rrs {
+			if rr.Rrtype == q.Qtype || q.Qtype == dnsTypeANY {
+				reply.answer = append(reply.answer, rr)
+			} else if rr.Rrtype == dnsTypeCNAME {
+				cname = &rrs[j]
+			}
+		}
+		if cname == nil || q.Qtype == dnsTypeCNAME {
+			break
+		}
+		reply.answer = append(reply.answer, *cname)
+		name, _, _ = getDomainName(cname.Data, 0)
+	}
+	return packDNSMsg(reply)
+}
+
+// addressRRs returns the records of type qtype among ips.
+func addressRRs(name string, qtype uint16, ips []net.IP) []dnsRR {
+	var rrs []dnsRR
+	for _, ip := range ips {
+		rr := dnsRR{Name: name, Class: dnsClassINET, Ttl: localTTL}
+		if ip4 := ip.To4(); ip4 != nil && qtype == dnsTypeA {
+			rr.Rrtype, rr.Data = dnsTypeA, ip4
+		} else if ip4 == nil && qtype == dnsTypeAAAA {
+			rr.Rrtype, rr.Data = dnsTypeAAAA, ip.To16()
+		} else {
+			continue
+		}
+		rr.Rdlength = uint16(len(rr.Data))
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// localAnswer answers A, AAAA and PTR queries from the local table and
+// the -ptr-template names. It returns nil when the query must go upstream.
+func localAnswer(query dnsMsg, client net.IP) []byte {
+	if len(query.question) != 1 {
+		return nil
+	}
+	q := query.question[0]
+	if q.Qtype == dnsTypePTR {
+		return localPTR(query)
+	}
+	ips, ok := localRecords.lookup(q.Name, client)
+	if !ok {
+		ip, ok := templateAddr(q.Name)
+		if !ok {
+			return nil
+		}
+		ips = []net.IP{ip}
+	}
+	reply := newReply(query, dnsRcodeSuccess)
+	reply.authoritative = true
+	reply.answer = addressRRs(q.Name, q.Qtype, ips)
+	return packDNSMsg(reply)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A recorded query, with the response seen at capture time if known.
+type replayQuery struct {
+	at       time.Time
+	query    []byte
+	expected []byte
+}
+
+// readQueryLog reads a text log with one "RFC3339-time name type" query
+// per line.
+func readQueryLog(r io.Reader) ([]replayQuery, error) {
+	var qs []replayQuery
+	s := bufio.NewScanner(r)
+	for lineno := 1; s.Scan(); lineno++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want time, name and type", lineno)
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		qtype, ok := parseType(fields[2])
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown type %q", lineno, fields[2])
+		}
+		var msg dnsMsg
+		msg.id = uint16(rand.Uint32())
+		msg.recursion_desired = true
+		msg.question = []dnsQuestion{{Name: fields[1], Qtype: qtype, Qclass: dnsClassINET}}
+		qs = append(qs, replayQuery{at: t, query: packDNSMsg(msg)})
+	}
+	return qs, s.Err()
+}
+
+// Link types of classic pcap files that readPcap understands.
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+)
+
+// pcapUDP extracts the UDP payload and ports from a captured frame.
+func pcapUDP(linktype uint32, frame []byte) (src, dst string, payload []byte, ok bool) {
+	switch linktype {
+	case linkNull:
+		if len(frame) < 4 {
+			return
+		}
+		frame = frame[4:]
+	case linkEthernet:
+		if len(frame) < 14 {
+			return
+		}
+		etype := binary.BigEndian.Uint16(frame[12:])
+		frame = frame[14:]
+		if etype == 0x8100 && len(frame) >= 4 {
+			frame = frame[4:]
+		}
+	case linkLinuxSLL:
+		if len(frame) < 16 {
+			return
+		}
+		frame = frame[16:]
+	case linkRaw, 12:
+	default:
+		return
+	}
+	if len(frame) < 1 {
+		return
+	}
+	var srcIP, dstIP net.IP
+	switch frame[0] >> 4 {
+	case 4:
+		ihl := int(frame[0]&0x0F) * 4
+		if len(frame) < ihl || ihl < 20 || frame[9] != 17 {
+			return
+		}
+		srcIP, dstIP = net.IP(frame[12:16]), net.IP(frame[16:20])
+		frame = frame[ihl:]
+	case 6:
+		if len(frame) < 40 || frame[6] != 17 {
+			return
+		}
+		srcIP, dstIP = net.IP(frame[8:24]), net.IP(frame[24:40])
+		frame = frame[40:]
+	default:
+		return
+	}
+	if len(frame) < 8 {
+		return
+	}
+	sport := binary.BigEndian.Uint16(frame)
+	dport := binary.BigEndian.Uint16(frame[2:])
+	src = net.JoinHostPort(srcIP.String(), fmt.Sprint(sport))
+	dst = net.JoinHostPort(dstIP.String(), fmt.Sprint(dport))
+	return src, dst, frame[8:], true
+}
+
+// readPcap reads DNS queries and their responses from a classic
+// (not pcapng) capture file.
+func readPcap(r io.Reader) ([]replayQuery, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	nano := false
+	switch binary.LittleEndian.Uint32(hdr[:]) {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xa1b23c4d:
+		order, nano = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0x4d3cb2a1:
+		order, nano = binary.BigEndian, true
+	default:
+		return nil, errors.New("not a pcap file")
+	}
+	linktype := order.Uint32(hdr[20:])
+
+	var qs []replayQuery
+	pending := make(map[string]int)
+	var rec [16]byte
+	for {
+		if _, err := io.ReadFull(r, rec[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		sec, frac := int64(order.Uint32(rec[:])), int64(order.Uint32(rec[4:]))
+		if !nano {
+			frac *= 1000
+		}
+		frame := make([]byte, order.Uint32(rec[8:]))
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+		src, dst, payload, ok := pcapUDP(linktype, frame)
+		if !ok || len(payload) < 12 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(payload)
+		if payload[2]&0x80 == 0 {
+			pending[fmt.Sprintf("%s>%s#%d", src, dst, id)] = len(qs)
+			qs = append(qs, replayQuery{at: time.Unix(sec, frac), query: payload})
+		} else if i, ok := pending[fmt.Sprintf("%s>%s#%d", dst, src, id)]; ok {
+			qs[i].expected = payload
+		}
+	}
+	return qs, nil
+}
+
+// answerSignature summarizes a response for comparison: rcode and the
+// sorted answer records without TTLs, which legitimately change.
+func answerSignature(b []byte) string {
+	msg, err := parseDNSMsg(b)
+	if err != nil {
+		return "unparsable"
+	}
+	var rrs []string
+	for _, rr := range msg.answer {
+		rrs = append(rrs, fmt.Sprintf("%s/%d/%x", canonicalName(rr.Name), rr.Rrtype, rr.Data))
+	}
+	sort.Strings(rrs)
+	return fmt.Sprintf("rcode=%d %s", msg.rcode, strings.Join(rrs, " "))
+}
+
+// replayMain implements the "replay" subcommand.
+func replayMain(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	server := fs.String("server", "127.0.0.1:53", "proxy to replay queries against")
+	speed := fs.Float64("speed", 1, "replay speed relative to the recording, 0 for as fast as possible")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for each response")
+	verbose := fs.Bool("v", false, "print every mismatching response")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dns2tcp replay [options] capture.pcap|queries.log")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	qs, err := readPcap(bytes.NewReader(data))
+	if err != nil {
+		qs, err = readQueryLog(bytes.NewReader(data))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(qs) == 0 {
+		fmt.Fprintln(os.Stderr, "no queries found")
+		os.Exit(1)
+	}
+
+	var (
+		mu                                   sync.Mutex
+		wg                                   sync.WaitGroup
+		answered, timeouts, compared, differ int
+		latencies                            []time.Duration
+	)
+	start := time.Now()
+	for _, q := range qs {
+		if *speed > 0 {
+			due := start.Add(time.Duration(float64(q.at.Sub(qs[0].at)) / *speed))
+			time.Sleep(time.Until(due))
+		}
+		wg.Add(1)
+		go func(q replayQuery) {
+			defer wg.Done()
+			sent := time.Now()
+			conn, err := net.Dial("udp", *server)
+			if err != nil {
+				mu.Lock()
+				timeouts++
+				mu.Unlock()
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(sent.Add(*timeout))
+			conn.Write(q.query)
+			buf := make([]byte, 65535)
+			n, err := conn.Read(buf)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				timeouts++
+				return
+			}
+			answered++
+			latencies = append(latencies, time.Since(sent))
+			if q.expected != nil {
+				compared++
+				got, want := answerSignature(buf[:n]), answerSignature(q.expected)
+				if got != want {
+					differ++
+					if *verbose {
+						fmt.Printf("mismatch:\n  want %s\n  got  %s\n", want, got)
+					}
+				}
+			}
+		}(q)
+	}
+	wg.Wait()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	pct := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	fmt.Printf("queries: %d answered: %d timeouts: %d\n", len(qs), answered, timeouts)
+	fmt.Printf("compared: %d differing: %d\n", compared, differ)
+	fmt.Printf("latency p50: %v p99: %v, took %v\n", pct(0.5), pct(0.99), time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+var reverseForwardFlags stringList
+
+func init() {
+	flag.Var(&reverseForwardFlags, "reverse-forward", "send reverse lookups for zone=server or cidr=server to that plain DNS server, e.g. 192.168.0.0/16=192.168.1.1 (repeatable)")
+}
+
+type reverseDelegation struct {
+	zone   string
+	server string
+}
+
+var reverseDelegations []reverseDelegation
+
+// cidrReverseZone returns the in-addr.arpa or ip6.arpa zone of a prefix
+// that ends on an octet (IPv4) or nibble (IPv6) boundary.
+func cidrReverseZone(n *net.IPNet) (string, error) {
+	ones, bits := n.Mask.Size()
+	full := strings.Split(reverseName(n.IP), ".")
+	if bits == 32 {
+		if ones%8 != 0 {
+			return "", fmt.Errorf("IPv4 prefix %s is not a multiple of 8 bits", n)
+		}
+		return strings.Join(full[4-ones/8:], "."), nil
+	}
+	if ones%4 != 0 {
+		return "", fmt.Errorf("IPv6 prefix %s is not a multiple of 4 bits", n)
+	}
+	return strings.Join(full[32-ones/4:], "."), nil
+}
+
+func setupReverseForward() {
+	for _, f := range reverseForwardFlags {
+		zone, server, ok := strings.Cut(f, "=")
+		if !ok {
+			log.Fatalf("bad -reverse-forward %q, want zone=server", f)
+		}
+		if _, n, err := net.ParseCIDR(zone); err == nil {
+			if zone, err = cidrReverseZone(n); err != nil {
+				log.Fatalf("bad -reverse-forward %q: %v", f, err)
+			}
+		}
+		zone = canonicalName(zone)
+		if !strings.HasSuffix(zone, ".in-addr.arpa") && !strings.HasSuffix(zone, ".ip6.arpa") {
+			log.Fatalf("bad -reverse-forward %q: %s is not a reverse zone", f, zone)
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		infof("Forwarding reverse zone %s to %s", zone, server)
+		reverseDelegations = append(reverseDelegations, reverseDelegation{zone, server})
+	}
+}
+
+// reverseForward relays reverse lookups under a delegated zone to its
+// server, unless the address is in the local table.
+func reverseForward(query dnsMsg, data []byte) []byte {
+	if len(reverseDelegations) == 0 || len(query.question) != 1 {
+		return nil
+	}
+	name := canonicalName(query.question[0].Name)
+	var best *reverseDelegation
+	for i, d := range reverseDelegations {
+		if (name == d.zone || strings.HasSuffix(name, "."+d.zone)) && (best == nil || len(d.zone) > len(best.zone)) {
+			best = &reverseDelegations[i]
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	if ip, ok := reverseToIP(name); ok {
+		if _, ok := localRecords.lookupAddr(ip); ok {
+			return nil
+		}
+	}
+	reply, err := udpExchange(best.server, data)
+	if err != nil {
+		warnf("reverse forward to %s: %v", best.server, err)
+		return packDNSMsg(newReply(query, dnsRcodeServerFailure))
+	}
+	return reply
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var rewriteFlags stringList
+
+func init() {
+	flag.Var(&rewriteFlags, "rewrite", "rewrite answers for a name, *.domain or /regexp/: \"pattern 10.0.0.1,fd00::1\" answers with fixed addresses, \"pattern other.example\" with the records of another name, and ttl=N overrides the TTLs (repeatable, first match wins)")
+}
+
+// rewriteRule changes the answers for the names it matches: it either
+// answers with fixed addresses or resolves another name in their place,
+// and may override the TTLs.
+type rewriteRule struct {
+	pattern string
+	re      *regexp.Regexp
+
+	ips    []net.IP
+	target string
+	ttl    int // -1 to keep the TTLs
+}
+
+var rewriteRules []*rewriteRule
+
+// rewriteKey marks the context of the query resolved in place of a
+// rewritten one, which is not rewritten again.
+type rewriteKey struct{}
+
+func setupRewrites() {
+	for _, spec := range rewriteFlags {
+		r, err := parseRewrite(spec)
+		if err != nil {
+			log.Fatalf("-rewrite %q: %v", spec, err)
+		}
+		rewriteRules = append(rewriteRules, r)
+	}
+	if len(rewriteRules) > 0 {
+		infof("Rewriting answers with %d rules", len(rewriteRules))
+	}
+}
+
+func parseRewrite(spec string) (*rewriteRule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("want a pattern and what to rewrite")
+	}
+	r := &rewriteRule{pattern: fields[0], ttl: -1}
+	if isPattern(r.pattern) {
+		re, err := regexp.Compile(r.pattern[1 : len(r.pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		r.re = re
+	} else {
+		r.pattern = canonicalName(r.pattern)
+	}
+	for _, f := range fields[1:] {
+		if v, ok := strings.CutPrefix(f, "ttl="); ok {
+			ttl, err := strconv.ParseUint(v, 10, 31)
+			if err != nil {
+				return nil, fmt.Errorf("bad TTL %q", v)
+			}
+			r.ttl = int(ttl)
+			continue
+		}
+		if r.ips != nil || r.target != "" {
+			return nil, fmt.Errorf("more than one answer in %q", f)
+		}
+		if net.ParseIP(strings.Split(f, ",")[0]) == nil {
+			r.target = canonicalName(f)
+			continue
+		}
+		for _, s := range strings.Split(f, ",") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address %q", s)
+			}
+			r.ips = append(r.ips, ip)
+		}
+	}
+	return r, nil
+}
+
+func (r *rewriteRule) matches(name string) bool {
+	switch {
+	case r.re != nil:
+		return r.re.MatchString(name)
+	case strings.HasPrefix(r.pattern, "*."):
+		return strings.HasSuffix(name, r.pattern[1:])
+	}
+	return name == r.pattern
+}
+
+func rewriteFor(name string) *rewriteRule {
+	name = canonicalName(name)
+	for _, r := range rewriteRules {
+		if r.matches(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+func isRewritten(ctx context.Context) bool {
+	return ctx.Value(rewriteKey{}) != nil
+}
+
+// rewriteAnswer answers query by the first rule matching its name. It
+// reports false when no rule does.
+func rewriteAnswer(ctx context.Context, query dnsMsg, data []byte, client net.IP, v *view) ([]byte, bool) {
+	if len(rewriteRules) == 0 || len(query.question) != 1 || isRewritten(ctx) {
+		return nil, false
+	}
+	r := rewriteFor(query.question[0].Name)
+	if r == nil {
+		return nil, false
+	}
+	return r.apply(ctx, query, data, client, v), true
+}
+
+// apply answers query, whose name r matches.
+func (r *rewriteRule) apply(ctx context.Context, query dnsMsg, data []byte, client net.IP, v *view) []byte {
+	q := query.question[0]
+	ttl := func(t uint32) uint32 {
+		if r.ttl >= 0 {
+			return uint32(r.ttl)
+		}
+		return t
+	}
+
+	if r.ips != nil {
+		reply := newReply(query, dnsRcodeSuccess)
+		reply.answer = addressRRs(q.Name, q.Qtype, r.ips)
+		for i := range reply.answer {
+			reply.answer[i].Ttl = ttl(localTTL)
+		}
+		debugf("Rewrote %s to %v", q.Name, r.ips)
+		return packDNSMsg(reply)
+	}
+
+	// Resolve the target, or the name itself to only change the TTLs,
+	// as any other query.
+	inner := query
+	if r.target != "" {
+		inner.question = []dnsQuestion{{Name: r.target, Qtype: q.Qtype, Qclass: q.Qclass}}
+		data = packDNSMsg(inner)
+	}
+	reply := dnsRequest(context.WithValue(ctx, rewriteKey{}, true), data, client, v)
+	if reply == nil {
+		return nil
+	}
+	msg, err := parseDNSMsg(reply)
+	if err != nil {
+		return reply
+	}
+	msg.question = query.question
+	if r.target != "" {
+		// Flatten the answer: the records found for the target, or at the
+		// end of its CNAME chain, are given the name asked for.
+		var answer []dnsRR
+		for _, rr := range msg.answer {
+			if rr.Rrtype == q.Qtype || q.Qtype == dnsTypeANY {
+				rr.Name = q.Name
+				answer = append(answer, rr)
+			}
+		}
+		msg.answer = answer
+		debugf("Rewrote %s to %s", q.Name, r.target)
+	}
+	msg.answer = adjustTTLs(msg.answer, ttl)
+	msg.ns = adjustTTLs(msg.ns, ttl)
+	msg.extra = adjustTTLs(msg.extra, ttl)
+	return packDNSMsg(msg)
+}
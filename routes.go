@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	routeFlags    stringList
+	routeFile     = flag.String("route-file", "", "read domain=upstream routes from this file, one per line, reloading it when it changes")
+	routeInterval = flag.Duration("route-interval", 5*time.Second, "how often to check the route file for changes")
+)
+
+func init() {
+	flag.Var(&routeFlags, "route", "send queries under domain to other upstreams, as domain=ADDR,... (repeatable)")
+}
+
+// routeTable maps domain suffixes to the upstreams that resolve them.
+type routeTable map[string]upstreamGroup
+
+var routes atomic.Pointer[routeTable]
+
+func parseRoute(spec string) (string, upstreamGroup, error) {
+	domain, servers, ok := strings.Cut(spec, "=")
+	if !ok {
+		return "", nil, fmt.Errorf("want domain=ADDR,...")
+	}
+	g, err := parseUpstreams([]string{servers})
+	if err != nil {
+		return "", nil, err
+	}
+	return canonicalName(strings.TrimSpace(domain)), g, nil
+}
+
+// loadRoutes builds the route table from the flags and the route file.
+// Routes from the file win over flags for the same domain.
+func loadRoutes() (routeTable, error) {
+	t := make(routeTable)
+	for _, spec := range routeFlags {
+		domain, g, err := parseRoute(spec)
+		if err != nil {
+			return nil, fmt.Errorf("bad -route %q: %v", spec, err)
+		}
+		t[domain] = g
+	}
+	if *routeFile == "" {
+		return t, nil
+	}
+	f, err := os.Open(*routeFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line, _, _ := strings.Cut(s.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		domain, g, err := parseRoute(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", *routeFile, lineno, err)
+		}
+		t[domain] = g
+	}
+	return t, s.Err()
+}
+
+func setupRoutes() {
+	t, err := loadRoutes()
+	if err != nil {
+		log.Fatal(err)
+	}
+	routes.Store(&t)
+	if len(t) > 0 {
+		infof("Routing %d domains to their own upstreams", len(t))
+	}
+	if *routeFile == "" || *routeInterval <= 0 {
+		return
+	}
+	go func() {
+		var mtime time.Time
+		if fi, err := os.Stat(*routeFile); err == nil {
+			mtime = fi.ModTime()
+		}
+		for range time.Tick(*routeInterval) {
+			fi, err := os.Stat(*routeFile)
+			if err != nil || fi.ModTime().Equal(mtime) {
+				continue
+			}
+			mtime = fi.ModTime()
+			t, err := loadRoutes()
+			if err != nil {
+				// Keep routing with the previous table.
+				warnf("routes: %v", err)
+				continue
+			}
+			routes.Store(&t)
+			infof("routes: reloaded %d domains from %s", len(t), *routeFile)
+		}
+	}()
+}
+
+// routeFor returns the upstreams of the longest routed suffix of name,
+// or nil when the name is not routed.
+func routeFor(name string) upstreamGroup {
+	t := routes.Load()
+	if t == nil || len(*t) == 0 {
+		return nil
+	}
+	name = canonicalName(name)
+	for {
+		if g, ok := (*t)[name]; ok {
+			return g
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			return nil
+		}
+		name = parent
+	}
+}
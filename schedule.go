@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var scheduleFlags stringList
+
+func init() {
+	flag.Var(&scheduleFlags, "scheduled-blocklist", `block the names of a blocklist file or URL only at certain times, as "LIST DAYS HH:MM-HH:MM [TIMEZONE] [group=NAME]", e.g. "social.txt sun-thu 22:00-07:00 Europe/Berlin group=kids"; DAYS is daily or a list of days and ranges like mon-fri,sun, and a window past midnight belongs to the day it starts on (repeatable)`)
+}
+
+// A scheduledList is a blocklist that only applies during a weekly time
+// window, to everyone or to the clients of one group.
+type scheduledList struct {
+	spec     string
+	src      *blocklistSource
+	days     [7]bool
+	from, to int // minutes since midnight
+	loc      *time.Location
+	group    *clientGroup
+
+	blocked atomic.Pointer[blockMatcher]
+}
+
+var scheduledLists []*scheduledList
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	if s == "daily" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			last = first
+		}
+		d1, ok1 := weekdays[first]
+		d2, ok2 := weekdays[last]
+		if !ok1 || !ok2 {
+			return days, fmt.Errorf("bad days %q", part)
+		}
+		for d := d1; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == d2 {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || hour > 24 || minute < 0 || minute > 59 || hour == 24 && minute != 0 {
+		return 0, fmt.Errorf("bad time %q, want HH:MM", s)
+	}
+	return hour*60 + minute, nil
+}
+
+func parseSchedule(spec string) (*scheduledList, error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("want LIST DAYS HH:MM-HH:MM")
+	}
+	s := &scheduledList{spec: spec, src: &blocklistSource{loc: fields[0]}, loc: time.Local}
+	var err error
+	if s.days, err = parseDays(fields[1]); err != nil {
+		return nil, err
+	}
+	from, to, ok := strings.Cut(fields[2], "-")
+	if !ok {
+		return nil, fmt.Errorf("bad window %q, want HH:MM-HH:MM", fields[2])
+	}
+	if s.from, err = parseClock(from); err != nil {
+		return nil, err
+	}
+	if s.to, err = parseClock(to); err != nil {
+		return nil, err
+	}
+	for _, f := range fields[3:] {
+		if name, ok := strings.CutPrefix(f, "group="); ok {
+			for _, g := range clientGroups {
+				if g.name == name {
+					s.group = g
+				}
+			}
+			if s.group == nil {
+				return nil, fmt.Errorf("no client group %q", name)
+			}
+			continue
+		}
+		if s.loc, err = time.LoadLocation(f); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// active reports whether the window is open at t.
+func (s *scheduledList) active(t time.Time) bool {
+	t = t.In(s.loc)
+	now, day := t.Hour()*60+t.Minute(), t.Weekday()
+	if s.from <= s.to {
+		return s.days[day] && now >= s.from && now < s.to
+	}
+	// The window goes past midnight: the evening belongs to the day, the
+	// morning to the day before.
+	return s.days[day] && now >= s.from || s.days[(day+6)%7] && now < s.to
+}
+
+func (s *scheduledList) rebuild() {
+	m := newBlockMatcher()
+	for _, rule := range s.src.rules {
+		if err := m.add(rule); err != nil {
+			warnf("blocklist %s: %v", s.src.loc, err)
+		}
+	}
+	m.compile()
+	s.blocked.Store(m)
+}
+
+// setupSchedules must run after the client groups are set up.
+func setupSchedules() {
+	for _, spec := range scheduleFlags {
+		s, err := parseSchedule(spec)
+		if err != nil {
+			log.Fatalf("bad -scheduled-blocklist %q: %v", spec, err)
+		}
+		if _, err := s.src.load(); err != nil {
+			if !s.src.isURL() {
+				log.Fatal(err)
+			}
+			warnf("blocklist: %v", err)
+		}
+		s.rebuild()
+		if *blockRefresh > 0 {
+			go refreshBlocklists([]*blocklistSource{s.src}, s.rebuild)
+		}
+		scheduledLists = append(scheduledLists, s)
+		infof("blocklist: %d rules from %s apply %s", len(s.src.rules), s.src.loc, strings.Join(strings.Fields(spec)[1:], " "))
+	}
+}
+
+// scheduleBlocked reports whether a scheduled blocklist that is in force
+// for the clients of group g covers the canonical name.
+func scheduleBlocked(name string, g *clientGroup) bool {
+	if len(scheduledLists) == 0 {
+		return false
+	}
+	now := time.Now()
+	for _, s := range scheduledLists {
+		if (s.group == nil || s.group == g) && s.active(now) && s.blocked.Load().match(name) {
+			debugf("%s blocked by the schedule %q", name, s.spec)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "log"
+
+func serviceMain(args []string) {
+	log.Fatal("the service subcommand is only available on Windows; use systemd, launchd or rc.d to run dns2tcp at boot")
+}
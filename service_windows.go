@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// serviceName names both the Windows service and its event log source.
+const serviceName = "dns2tcp"
+
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSourceW         = advapi32.NewProc("RegisterEventSourceW")
+	procReportEventW                 = advapi32.NewProc("ReportEventW")
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceAcceptStop     = 1
+	serviceAcceptShutdown = 4
+
+	serviceControlStop     = 1
+	serviceControlShutdown = 5
+
+	eventlogErrorType       = 1
+	eventlogWarningType     = 2
+	eventlogInformationType = 4
+)
+
+// serviceStatus is SERVICE_STATUS.
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// serviceTableEntry is SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+var (
+	serviceStatusHandle uintptr
+	serviceMainCallback = syscall.NewCallback(serviceEntry)
+	serviceCtrlCallback = syscall.NewCallback(serviceHandler)
+)
+
+const serviceUsage = "usage: dns2tcp service install [flags] | uninstall | start | stop"
+
+// serviceMain manages dns2tcp as a Windows service that starts at boot.
+// The flags given to install are the ones the service runs with.
+func serviceMain(args []string) {
+	if len(args) == 0 {
+		log.Fatal(serviceUsage)
+	}
+	switch args[0] {
+	case "install":
+		installService(args[1:])
+	case "uninstall":
+		sc("stop", serviceName)
+		if err := sc("delete", serviceName); err != nil {
+			log.Fatalf("Removing service: %v", err)
+		}
+		exec.Command("reg", "delete", eventSourceKey, "/f").Run()
+		log.Printf("Removed service %s", serviceName)
+	case "start", "stop":
+		if err := sc(args[0], serviceName); err != nil {
+			log.Fatalf("%s service: %v", args[0], err)
+		}
+	case "run":
+		runService(args[1:])
+	default:
+		log.Fatal(serviceUsage)
+	}
+}
+
+// sc runs the service control manager's command line tool.
+func sc(args ...string) error {
+	out, err := exec.Command("sc.exe", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// eventSourceKey registers the event log source. EventCreate.exe carries
+// a message table that passes the text through, so entries read well in
+// the Event Viewer without a message DLL of our own.
+const eventSourceKey = `HKLM\SYSTEM\CurrentControlSet\Services\EventLog\Application\` + serviceName
+
+func installService(args []string) {
+	// Check the flags now rather than when the service fails to start.
+	if err := flag.CommandLine.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if exe, err = filepath.Abs(exe); err != nil {
+		log.Fatal(err)
+	}
+	cmd := []string{syscall.EscapeArg(exe), "service", "run"}
+	for _, a := range args {
+		cmd = append(cmd, syscall.EscapeArg(a))
+	}
+	if err := sc("create", serviceName, "binPath=", strings.Join(cmd, " "), "start=", "auto", "DisplayName=", "dns2tcp DNS proxy"); err != nil {
+		log.Fatalf("Installing service: %v", err)
+	}
+	sc("description", serviceName, "Forwards DNS queries to upstream servers over TCP.")
+	exec.Command("reg", "add", eventSourceKey, "/v", "EventMessageFile", "/t", "REG_EXPAND_SZ",
+		"/d", `%SystemRoot%\System32\EventCreate.exe`, "/f").Run()
+	exec.Command("reg", "add", eventSourceKey, "/v", "TypesSupported", "/t", "REG_DWORD", "/d", "7", "/f").Run()
+	log.Printf("Installed service %s; start it with: dns2tcp service start", serviceName)
+}
+
+// runService is what the service manager starts. It hands the process
+// over to the service dispatcher, which calls serviceEntry.
+func runService(args []string) {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+	if *logOutput == "" {
+		*logOutput = "eventlog"
+	}
+	name, _ := syscall.UTF16PtrFromString(serviceName)
+	table := []serviceTableEntry{{name, serviceMainCallback}, {}}
+	if r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0]))); r == 0 {
+		log.Fatalf("Not started by the service manager: %v", err)
+	}
+}
+
+func serviceEntry(argc, argv uintptr) uintptr {
+	name, _ := syscall.UTF16PtrFromString(serviceName)
+	serviceStatusHandle, _, _ = procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(name)), serviceCtrlCallback, 0)
+	setServiceState(serviceStartPending)
+	done := make(chan struct{})
+	go func() {
+		serve()
+		close(done)
+	}()
+	setServiceState(serviceRunning)
+	<-done
+	setServiceState(serviceStopped)
+	return 0
+}
+
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		setServiceState(serviceStopPending)
+		select {
+		case stopRequests <- os.Interrupt:
+		default:
+		}
+	}
+	return 0
+}
+
+func setServiceState(state uint32) {
+	s := serviceStatus{serviceType: serviceWin32OwnProcess, currentState: state}
+	switch state {
+	case serviceRunning:
+		s.controlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	case serviceStartPending, serviceStopPending:
+		s.waitHint = uint32((*shutdownTimeout).Milliseconds()) + 1000
+	}
+	procSetServiceStatus.Call(serviceStatusHandle, uintptr(unsafe.Pointer(&s)))
+}
+
+// eventLog is a log writer that reports each line to the Windows event
+// log.
+type eventLog struct {
+	handle uintptr
+}
+
+func newEventLog(source string) (*eventLog, error) {
+	name, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(name)))
+	if h == 0 {
+		return nil, err
+	}
+	return &eventLog{h}, nil
+}
+
+// Write reports a line logged through the log package, guessing its
+// type from the text.
+func (e *eventLog) Write(p []byte) (int, error) {
+	text := strings.TrimRight(strings.ReplaceAll(string(p), "\x00", ""), "\n")
+	typ := eventlogInformationType
+	switch {
+	case strings.HasPrefix(text, "Warning"):
+		typ = eventlogWarningType
+	case strings.Contains(text, "failed"):
+		typ = eventlogErrorType
+	}
+	if err := e.report(typ, text); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (e *eventLog) report(typ int, text string) error {
+	msg, err := syscall.UTF16PtrFromString(strings.ReplaceAll(text, "\x00", ""))
+	if err != nil {
+		return err
+	}
+	strs := []*uint16{msg}
+	// Event ID 1 is a bare "%1" in EventCreate.exe's message table.
+	r, _, err := procReportEventW.Call(e.handle, uintptr(typ), 0, 1, 0, 1, 0, uintptr(unsafe.Pointer(&strs[0])), 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
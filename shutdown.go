@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "how long to wait for queries in flight when shutting down")
+
+var (
+	stopping      atomic.Bool
+	inflight      atomic.Int64
+	queriesServed atomic.Int64
+	startTime     = time.Now()
+
+	listenersMu  sync.Mutex
+	udpConns     []*net.UDPConn
+	tcpListeners []net.Listener
+
+	// stopRequests receives the signal that starts the shutdown; the
+	// Windows service handler sends os.Interrupt on it.
+	stopRequests = make(chan os.Signal, 1)
+)
+
+func trackUDP(conn *net.UDPConn) *net.UDPConn {
+	listenersMu.Lock()
+	udpConns = append(udpConns, conn)
+	listenersMu.Unlock()
+	return conn
+}
+
+func trackTCP(l net.Listener) net.Listener {
+	listenersMu.Lock()
+	tcpListeners = append(tcpListeners, l)
+	listenersMu.Unlock()
+	return l
+}
+
+// beginQuery registers a query as in flight. It returns false once
+// shutdown has started and the query should be ignored.
+func beginQuery() bool {
+	if stopping.Load() {
+		return false
+	}
+	inflight.Add(1)
+	return true
+}
+
+// endQuery unregisters a query that arrived at start.
+func endQuery(answered bool, start time.Time) {
+	if answered {
+		d := time.Since(start)
+		queriesServed.Add(1)
+		observeLatency(d)
+		statsdTiming(d)
+	}
+	inflight.Add(-1)
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then stops reading new
+// queries, gives the ones in flight until -shutdown-timeout to finish
+// and closes the sockets.
+func waitForShutdown() {
+	signal.Notify(stopRequests, os.Interrupt, syscall.SIGTERM)
+	s := <-stopRequests
+	infof("Received %v, shutting down", s)
+	stopping.Store(true)
+
+	listenersMu.Lock()
+	for _, l := range tcpListeners {
+		l.Close()
+	}
+	// Only stop reading: replies to queries in flight still go out on
+	// the UDP sockets.
+	for _, c := range udpConns {
+		c.SetReadDeadline(time.Now())
+	}
+	listenersMu.Unlock()
+
+	deadline := time.Now().Add(*shutdownTimeout)
+	for inflight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	listenersMu.Lock()
+	for _, c := range udpConns {
+		c.Close()
+	}
+	listenersMu.Unlock()
+	infof("Shut down after %v: %d queries answered, %d abandoned in flight",
+		time.Since(startTime).Round(time.Second), queriesServed.Load(), inflight.Load())
+	stopDnstap()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+)
+
+var (
+	sinkholeV4  = flag.String("sinkhole-ipv4", "", "answer every A query with this address and forward nothing")
+	sinkholeV6  = flag.String("sinkhole-ipv6", "", "answer every AAAA query with this address and forward nothing")
+	sinkholeTTL = flag.Uint("sinkhole-ttl", 10, "TTL of sinkholed answers")
+)
+
+var sinkholeIPv4, sinkholeIPv6 net.IP
+
+func setupSinkhole() {
+	if *sinkholeV4 != "" {
+		if sinkholeIPv4 = net.ParseIP(*sinkholeV4).To4(); sinkholeIPv4 == nil {
+			log.Fatalf("bad -sinkhole-ipv4 %q", *sinkholeV4)
+		}
+	}
+	if *sinkholeV6 != "" {
+		if sinkholeIPv6 = net.ParseIP(*sinkholeV6); sinkholeIPv6 == nil || sinkholeIPv6.To4() != nil {
+			log.Fatalf("bad -sinkhole-ipv6 %q", *sinkholeV6)
+		}
+	}
+	if sinkholeIPv4 != nil || sinkholeIPv6 != nil {
+		infof("Sinkhole mode: answering all queries with %s %s", sinkholeIPv4, sinkholeIPv6)
+	}
+}
+
+// sinkholeAnswer answers every query when sinkhole mode is on: A and
+// AAAA get the configured address, anything else an empty answer.
+func sinkholeAnswer(query dnsMsg) []byte {
+	if sinkholeIPv4 == nil && sinkholeIPv6 == nil || len(query.question) != 1 {
+		return nil
+	}
+	q := query.question[0]
+	reply := newReply(query, dnsRcodeSuccess)
+	rr := dnsRR{Name: q.Name, Rrtype: q.Qtype, Class: dnsClassINET, Ttl: uint32(*sinkholeTTL)}
+	switch {
+	case q.Qtype == dnsTypeA && sinkholeIPv4 != nil:
+		rr.Data = sinkholeIPv4
+	case q.Qtype == dnsTypeAAAA && sinkholeIPv6 != nil:
+		rr.Data = sinkholeIPv6.To16()
+	}
+	if rr.Data != nil {
+		rr.Rdlength = uint16(len(rr.Data))
+		reply.answer = []dnsRR{rr}
+	}
+	return packDNSMsg(reply)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+)
+
+var (
+	specialTLDs     = flag.String("special-tlds", "onion,internal,home.arpa,local", "comma-separated domains that are never forwarded upstream")
+	specialResponse = flag.String("special-response", "nxdomain", "answer for special-use domains: nxdomain or nodata")
+)
+
+var (
+	specialDomains []string
+	specialRcode   uint
+)
+
+func setupSpecialTLDs() {
+	switch *specialResponse {
+	case "nxdomain":
+		specialRcode = dnsRcodeNameError
+	case "nodata":
+		specialRcode = dnsRcodeSuccess
+	default:
+		log.Fatalf("bad -special-response %q, want nxdomain or nodata", *specialResponse)
+	}
+	specialDomains = nil
+	for _, d := range strings.Split(*specialTLDs, ",") {
+		if d = canonicalName(strings.TrimSpace(d)); d != "" {
+			specialDomains = append(specialDomains, d)
+		}
+	}
+}
+
+// specialAnswer answers names under special-use domains (RFC 6761, RFC
+// 7686, RFC 8375) that must not leak to the upstream resolver.
+func specialAnswer(query dnsMsg, domains []string) []byte {
+	if len(query.question) != 1 {
+		return nil
+	}
+	name := canonicalName(query.question[0].Name)
+	for _, d := range domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return negativeReply(query, d, specialRcode)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Stamp protocol identifiers, see https://dnscrypt.info/stamps-specifications
+const (
+	stampPlain         = 0x00
+	stampDNSCrypt      = 0x01
+	stampDoH           = 0x02
+	stampTLS           = 0x03
+	stampDoQ           = 0x04
+	stampODoHTarget    = 0x05
+	stampDNSCryptRelay = 0x81
+	stampODoHRelay     = 0x85
+)
+
+const (
+	stampPropDNSSEC   = 1 << 0
+	stampPropNoLog    = 1 << 1
+	stampPropNoFilter = 1 << 2
+)
+
+var stampProtoNames = map[byte]string{
+	stampPlain:         "plain",
+	stampDNSCrypt:      "dnscrypt",
+	stampDoH:           "doh",
+	stampTLS:           "dot",
+	stampDoQ:           "doq",
+	stampODoHTarget:    "odoh-target",
+	stampDNSCryptRelay: "dnscrypt-relay",
+	stampODoHRelay:     "odoh-relay",
+}
+
+type serverStamp struct {
+	Proto     byte
+	Props     uint64
+	Addr      string
+	PK        []byte
+	Provider  string
+	Hashes    [][]byte
+	Hostname  string
+	Path      string
+	Bootstrap []string
+}
+
+var errStampTruncated = errors.New("stamp: truncated")
+
+type stampReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *stampReader) lp() ([]byte, error) {
+	if r.pos >= len(r.b) {
+		return nil, errStampTruncated
+	}
+	n := int(r.b[r.pos])
+	r.pos++
+	if r.pos+n > len(r.b) {
+		return nil, errStampTruncated
+	}
+	v := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return v, nil
+}
+
+func (r *stampReader) vlp() ([][]byte, error) {
+	var vs [][]byte
+	for {
+		if r.pos >= len(r.b) {
+			return nil, errStampTruncated
+		}
+		n := int(r.b[r.pos])
+		r.pos++
+		more := n&0x80 != 0
+		n &= 0x7f
+		if r.pos+n > len(r.b) {
+			return nil, errStampTruncated
+		}
+		if n > 0 {
+			vs = append(vs, r.b[r.pos:r.pos+n])
+		}
+		r.pos += n
+		if !more {
+			return vs, nil
+		}
+	}
+}
+
+func decodeStamp(s string) (*serverStamp, error) {
+	enc, ok := strings.CutPrefix(s, "sdns://")
+	if !ok {
+		return nil, errors.New("stamp: missing sdns:// prefix")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, fmt.Errorf("stamp: %v", err)
+	}
+	if len(b) < 1 {
+		return nil, errStampTruncated
+	}
+	st := &serverStamp{Proto: b[0]}
+	r := &stampReader{b: b, pos: 1}
+	if st.Proto != stampDNSCryptRelay {
+		if len(b) < 9 {
+			return nil, errStampTruncated
+		}
+		st.Props = binary.LittleEndian.Uint64(b[1:])
+		r.pos = 9
+	}
+
+	var v []byte
+	switch st.Proto {
+	case stampPlain, stampDNSCryptRelay:
+		if v, err = r.lp(); err != nil {
+			return nil, err
+		}
+		st.Addr = string(v)
+	case stampDNSCrypt:
+		if v, err = r.lp(); err != nil {
+			return nil, err
+		}
+		st.Addr = string(v)
+		if st.PK, err = r.lp(); err != nil {
+			return nil, err
+		}
+		if v, err = r.lp(); err != nil {
+			return nil, err
+		}
+		st.Provider = string(v)
+	case stampDoH, stampTLS, stampDoQ, stampODoHRelay:
+		if v, err = r.lp(); err != nil {
+			return nil, err
+		}
+		st.Addr = string(v)
+		if st.Hashes, err = r.vlp(); err != nil {
+			return nil, err
+		}
+		if v, err = r.lp(); err != nil {
+			return nil, err
+		}
+		st.Hostname = string(v)
+		if st.Proto == stampDoH || st.Proto == stampODoHRelay {
+			if v, err = r.lp(); err != nil {
+				return nil, err
+			}
+			st.Path = string(v)
+		}
+		if r.pos < len(b) {
+			bs, err := r.vlp()
+			if err != nil {
+				return nil, err
+			}
+			for _, b := range bs {
+				st.Bootstrap = append(st.Bootstrap, string(b))
+			}
+		}
+	case stampODoHTarget:
+		if v, err = r.lp(); err != nil {
+			return nil, err
+		}
+		st.Hostname = string(v)
+		if v, err = r.lp(); err != nil {
+			return nil, err
+		}
+		st.Path = string(v)
+	default:
+		return nil, fmt.Errorf("stamp: unknown protocol 0x%02x", st.Proto)
+	}
+	return st, nil
+}
+
+func appendLP(b []byte, v []byte) []byte {
+	b = append(b, byte(len(v)))
+	return append(b, v...)
+}
+
+func appendVLP(b []byte, vs [][]byte) []byte {
+	if len(vs) == 0 {
+		return append(b, 0)
+	}
+	for i, v := range vs {
+		n := byte(len(v))
+		if i < len(vs)-1 {
+			n |= 0x80
+		}
+		b = append(b, n)
+		b = append(b, v...)
+	}
+	return b
+}
+
+func (st *serverStamp) String() string {
+	b := []byte{st.Proto}
+	if st.Proto != stampDNSCryptRelay {
+		b = binary.LittleEndian.AppendUint64(b, st.Props)
+	}
+	switch st.Proto {
+	case stampPlain, stampDNSCryptRelay:
+		b = appendLP(b, []byte(st.Addr))
+	case stampDNSCrypt:
+		b = appendLP(b, []byte(st.Addr))
+		b = appendLP(b, st.PK)
+		b = appendLP(b, []byte(st.Provider))
+	case stampDoH, stampTLS, stampDoQ, stampODoHRelay:
+		b = appendLP(b, []byte(st.Addr))
+		b = appendVLP(b, st.Hashes)
+		b = appendLP(b, []byte(st.Hostname))
+		if st.Proto == stampDoH || st.Proto == stampODoHRelay {
+			b = appendLP(b, []byte(st.Path))
+		}
+		if len(st.Bootstrap) > 0 {
+			var bs [][]byte
+			for _, s := range st.Bootstrap {
+				bs = append(bs, []byte(s))
+			}
+			b = appendVLP(b, bs)
+		}
+	case stampODoHTarget:
+		b = appendLP(b, []byte(st.Hostname))
+		b = appendLP(b, []byte(st.Path))
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (st *serverStamp) print() {
+	name, ok := stampProtoNames[st.Proto]
+	if !ok {
+		name = fmt.Sprintf("0x%02x", st.Proto)
+	}
+	fmt.Printf("protocol:  %s\n", name)
+	if st.Proto != stampDNSCryptRelay {
+		fmt.Printf("dnssec:    %t\n", st.Props&stampPropDNSSEC != 0)
+		fmt.Printf("nolog:     %t\n", st.Props&stampPropNoLog != 0)
+		fmt.Printf("nofilter:  %t\n", st.Props&stampPropNoFilter != 0)
+	}
+	if st.Addr != "" {
+		fmt.Printf("address:   %s\n", st.Addr)
+	}
+	if st.Provider != "" {
+		fmt.Printf("provider:  %s\n", st.Provider)
+	}
+	if st.PK != nil {
+		fmt.Printf("pk:        %s\n", hex.EncodeToString(st.PK))
+	}
+	if st.Hostname != "" {
+		fmt.Printf("hostname:  %s\n", st.Hostname)
+	}
+	if st.Path != "" {
+		fmt.Printf("path:      %s\n", st.Path)
+	}
+	for _, h := range st.Hashes {
+		fmt.Printf("hash:      %s\n", hex.EncodeToString(h))
+	}
+	for _, b := range st.Bootstrap {
+		fmt.Printf("bootstrap: %s\n", b)
+	}
+}
+
+// stampMain implements the "stamp decode" and "stamp encode" subcommands.
+func stampMain(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: dns2tcp stamp decode sdns://...")
+		fmt.Fprintln(os.Stderr, "       dns2tcp stamp encode -proto dnscrypt -addr ... [options]")
+		os.Exit(2)
+	}
+	if len(args) < 1 {
+		usage()
+	}
+	switch args[0] {
+	case "decode":
+		if len(args) != 2 {
+			usage()
+		}
+		st, err := decodeStamp(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		st.print()
+	case "encode":
+		fs := flag.NewFlagSet("stamp encode", flag.ExitOnError)
+		proto := fs.String("proto", "dnscrypt", "plain, dnscrypt, doh, dot, doq, odoh-target, dnscrypt-relay or odoh-relay")
+		addr := fs.String("addr", "", "server address")
+		pk := fs.String("pk", "", "DNSCrypt provider public key in hex")
+		provider := fs.String("provider", "", "DNSCrypt provider name")
+		hostname := fs.String("hostname", "", "server host name")
+		path := fs.String("path", "", "URL path for DoH and ODoH")
+		hashes := fs.String("hashes", "", "comma-separated certificate hashes in hex")
+		bootstrap := fs.String("bootstrap", "", "comma-separated bootstrap resolvers")
+		dnssec := fs.Bool("dnssec", false, "server validates DNSSEC")
+		nolog := fs.Bool("nolog", false, "server does not log")
+		nofilter := fs.Bool("nofilter", false, "server does not filter")
+		fs.Parse(args[1:])
+
+		st := &serverStamp{Addr: *addr, Provider: *provider, Hostname: *hostname, Path: *path}
+		found := false
+		for p, name := range stampProtoNames {
+			if name == *proto {
+				st.Proto, found = p, true
+			}
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "unknown protocol %q\n", *proto)
+			os.Exit(2)
+		}
+		if *dnssec {
+			st.Props |= stampPropDNSSEC
+		}
+		if *nolog {
+			st.Props |= stampPropNoLog
+		}
+		if *nofilter {
+			st.Props |= stampPropNoFilter
+		}
+		var err error
+		if st.PK, err = hex.DecodeString(strings.ReplaceAll(*pk, ":", "")); err != nil {
+			fmt.Fprintf(os.Stderr, "bad -pk: %v\n", err)
+			os.Exit(2)
+		}
+		if st.Proto == stampDNSCrypt && len(st.PK) != 32 {
+			fmt.Fprintln(os.Stderr, "-pk must be 32 bytes")
+			os.Exit(2)
+		}
+		if *hashes != "" {
+			for _, h := range strings.Split(*hashes, ",") {
+				b, err := hex.DecodeString(strings.ReplaceAll(h, ":", ""))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "bad -hashes: %v\n", err)
+					os.Exit(2)
+				}
+				st.Hashes = append(st.Hashes, b)
+			}
+		}
+		if *bootstrap != "" {
+			st.Bootstrap = strings.Split(*bootstrap, ",")
+		}
+		fmt.Println(st)
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var statsInterval = flag.Duration("stats-interval", 0, "log a one-line summary of queries, cache hits, failures and latency this often, e.g. 5m; 0 to disable")
+
+// How many recent answer times the latency percentiles are taken from.
+const latencySamples = 4096
+
+var stats struct {
+	cacheHits        atomic.Int64
+	cacheMisses      atomic.Int64
+	upstreamFailures atomic.Int64
+
+	mu        sync.Mutex
+	latencies [latencySamples]time.Duration
+	next      int
+	full      bool
+}
+
+// statsSnapshot holds the counters, to report the changes over an
+// interval.
+type statsSnapshot struct {
+	queries, hits, misses, failures int64
+}
+
+func takeStats() statsSnapshot {
+	return statsSnapshot{
+		queries:  queriesServed.Load(),
+		hits:     stats.cacheHits.Load(),
+		misses:   stats.cacheMisses.Load(),
+		failures: stats.upstreamFailures.Load(),
+	}
+}
+
+func (s statsSnapshot) sub(old statsSnapshot) statsSnapshot {
+	return statsSnapshot{s.queries - old.queries, s.hits - old.hits, s.misses - old.misses, s.failures - old.failures}
+}
+
+// hitRate returns the percentage of cacheable queries answered from the
+// cache.
+func (s statsSnapshot) hitRate() float64 {
+	if s.hits+s.misses == 0 {
+		return 0
+	}
+	return 100 * float64(s.hits) / float64(s.hits+s.misses)
+}
+
+func observeLatency(d time.Duration) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.latencies[stats.next] = d
+	stats.next = (stats.next + 1) % latencySamples
+	if stats.next == 0 {
+		stats.full = true
+	}
+}
+
+// latencyPercentiles returns the given percentiles of the recent answer
+// times.
+func latencyPercentiles(ps ...float64) []time.Duration {
+	stats.mu.Lock()
+	n := stats.next
+	if stats.full {
+		n = latencySamples
+	}
+	sorted := slices.Clone(stats.latencies[:n])
+	stats.mu.Unlock()
+	slices.Sort(sorted)
+	out := make([]time.Duration, len(ps))
+	if len(sorted) == 0 {
+		return out
+	}
+	for i, p := range ps {
+		out[i] = sorted[min(len(sorted)-1, int(p/100*float64(len(sorted))))]
+	}
+	return out
+}
+
+func setupStats() {
+	watchStatsSignal()
+	if *statsInterval <= 0 {
+		return
+	}
+	go func() {
+		last := takeStats()
+		for range time.Tick(*statsInterval) {
+			now := takeStats()
+			d := now.sub(last)
+			last = now
+			p := latencyPercentiles(50, 99)
+			infof("Stats: %d queries in %v, %.1f%% cache hits, %d upstream failures, latency p50 %v p99 %v",
+				d.queries, *statsInterval, d.hitRate(), d.failures, p[0].Round(time.Microsecond), p[1].Round(time.Microsecond))
+		}
+	}()
+}
+
+// dumpStats logs everything there is to know about the proxy's health,
+// on SIGUSR1.
+func dumpStats() {
+	s := takeStats()
+	p := latencyPercentiles(50, 90, 99, 100)
+	for i := range p {
+		p[i] = p[i].Round(time.Microsecond)
+	}
+	blockedMu.RLock()
+	nblocked := blocked.len()
+	blockedMu.RUnlock()
+	infof("Stats: up %v, %d queries answered, %d in flight", time.Since(startTime).Round(time.Second), s.queries, inflight.Load())
+	infof("Stats: cache %d entries, %d hits, %d misses (%.1f%% hits)", cache.len(), s.hits, s.misses, s.hitRate())
+	infof("Stats: latency p50 %v p90 %v p99 %v max %v", p[0], p[1], p[2], p[3])
+	infof("Stats: %d upstream failures, %d blocklist rules", s.failures, nblocked)
+	for _, u := range knownUpstreams() {
+		st := u.status()
+		infof("Stats: upstream %s healthy=%v disabled=%v failures=%d rtt %.1fms", st.Addr, st.Healthy, st.Disabled, st.Failures, st.RTT)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	statsdAddr     = flag.String("statsd", "", "send query counts, answer times and cache stats to this StatsD server, host:port over UDP")
+	statsdPrefix   = flag.String("statsd-prefix", "dns2tcp.", "prefix of the StatsD metric names")
+	statsdTags     = flag.String("statsd-tags", "", "comma-separated DogStatsD tags added to every metric, e.g. env:home,host:pi")
+	statsdInterval = flag.Duration("statsd-interval", 10*time.Second, "how often to send the metrics to -statsd")
+)
+
+// The most answer times sent per interval; past that they are sampled.
+const statsdMaxTimings = 1000
+
+// The largest datagram sent, to stay clear of fragmentation.
+const statsdPacketSize = 1432
+
+var statsd struct {
+	conn net.Conn
+	tags string
+
+	mu      sync.Mutex
+	timings []time.Duration
+	seen    int
+}
+
+func setupStatsd() {
+	if *statsdAddr == "" {
+		return
+	}
+	if *statsdInterval <= 0 {
+		log.Fatalf("bad -statsd-interval %v", *statsdInterval)
+	}
+	conn, err := net.Dial("udp", *statsdAddr)
+	if err != nil {
+		log.Fatalf("statsd: %v", err)
+	}
+	statsd.conn = conn
+	if *statsdTags != "" {
+		statsd.tags = "|#" + strings.ReplaceAll(*statsdTags, " ", "")
+	}
+	go func() {
+		last := takeStats()
+		for range time.Tick(*statsdInterval) {
+			now := takeStats()
+			sendStatsd(now.sub(last))
+			last = now
+		}
+	}()
+	infof("Sending metrics to StatsD at %s every %v", *statsdAddr, *statsdInterval)
+}
+
+// statsdTiming records the answer time of a query for the next send.
+func statsdTiming(d time.Duration) {
+	if statsd.conn == nil {
+		return
+	}
+	statsd.mu.Lock()
+	defer statsd.mu.Unlock()
+	statsd.seen++
+	if len(statsd.timings) < statsdMaxTimings {
+		statsd.timings = append(statsd.timings, d)
+	}
+}
+
+// sendStatsd sends the counters of the interval d, the gauges and the
+// answer times recorded since the last send.
+func sendStatsd(d statsSnapshot) {
+	statsd.mu.Lock()
+	timings, seen := statsd.timings, statsd.seen
+	statsd.timings, statsd.seen = nil, 0
+	statsd.mu.Unlock()
+
+	var lines []string
+	metric := func(name string, value any, kind string) {
+		lines = append(lines, fmt.Sprintf("%s%s:%v|%s%s", *statsdPrefix, name, value, kind, statsd.tags))
+	}
+	metric("queries", d.queries, "c")
+	metric("cache.hits", d.hits, "c")
+	metric("cache.misses", d.misses, "c")
+	metric("upstream.failures", d.failures, "c")
+	metric("cache.entries", cache.len(), "g")
+	metric("queries.inflight", inflight.Load(), "g")
+	rate := ""
+	if seen > len(timings) {
+		rate = fmt.Sprintf("|@%.3f", float64(len(timings))/float64(seen))
+	}
+	for _, t := range timings {
+		metric("latency", fmt.Sprintf("%.3f", float64(t)/float64(time.Millisecond)), "ms"+rate)
+	}
+
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdPacketSize {
+			statsdWrite(packet)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		statsdWrite(packet)
+	}
+}
+
+func statsdWrite(packet []byte) {
+	if _, err := statsd.conn.Write(packet); err != nil {
+		debugf("statsd: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchStatsSignal dumps the statistics whenever SIGUSR1 arrives.
+func watchStatsSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			dumpStats()
+		}
+	}()
+}
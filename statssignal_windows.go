@@ -0,0 +1,4 @@
+package main
+
+// Windows has no SIGUSR1; the admin API's /stats serves the same numbers.
+func watchStatsSignal() {}
@@ -0,0 +1,66 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/syslog"
+	"strings"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// openSyslog sends the logs to the local syslog daemon, at the severity
+// of each message.
+func openSyslog() error {
+	facility, ok := syslogFacilities[strings.ToLower(*syslogFacility)]
+	if !ok {
+		return fmt.Errorf("unknown facility %q", *syslogFacility)
+	}
+	w, err := syslog.New(facility|syslog.LOG_INFO, *syslogTag)
+	if err != nil {
+		return err
+	}
+	// syslog adds its own timestamps.
+	log.SetFlags(0)
+	log.SetOutput(w)
+	leveledLog = func(l logLevel, msg string) error {
+		switch l {
+		case levelDebug:
+			return w.Debug(msg)
+		case levelWarn:
+			return w.Warning(msg)
+		case levelError:
+			return w.Err(msg)
+		}
+		return w.Info(msg)
+	}
+	return nil
+}
+
+func openEventLog() error {
+	return errors.New("the event log is only available on Windows")
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+func openSyslog() error {
+	return errors.New("not available on Windows, use -log-output eventlog")
+}
+
+// openEventLog sends the logs to the Windows event log, as information,
+// warning or error events by the level of each message.
+func openEventLog() error {
+	w, err := newEventLog(*syslogTag)
+	if err != nil {
+		return err
+	}
+	log.SetFlags(0)
+	log.SetOutput(w)
+	leveledLog = func(l logLevel, msg string) error {
+		switch l {
+		case levelWarn:
+			return w.report(eventlogWarningType, msg)
+		case levelError:
+			return w.report(eventlogErrorType, msg)
+		}
+		return w.report(eventlogInformationType, msg)
+	}
+	return nil
+}
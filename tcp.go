@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var tcpIdleTimeout = flag.Duration("tcp-idle-timeout", 10*time.Second, "close idle inbound TCP connections after this long")
+
+func listenTCP(addr string) net.Listener {
+	checkPrivilegedPort(addr)
+	l, err := net.Listen(listenNetwork("tcp"), addr)
+	if err != nil {
+		log.Fatal(bindError(addr, err))
+	}
+	return trackTCP(l)
+}
+
+// dnsListenTCP accepts DNS-over-TCP connections (RFC 7766) on l.
+// Listeners not bound to a view pass a nil v.
+func dnsListenTCP(l net.Listener, v *view) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if stopping.Load() {
+				return
+			}
+			warnf("Accept: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go dnsServeTCP(conn, v)
+	}
+}
+
+// dnsServeTCP reads length-prefixed queries from conn until it is closed
+// or idle. Queries are answered concurrently and replies may come back
+// out of order, which clients match by message ID.
+func dnsServeTCP(conn net.Conn, v *view) {
+	defer conn.Close()
+	addr := conn.RemoteAddr()
+	client := addrIP(addr)
+	if *aclAction == "drop" && !clientAllowed(client) {
+		debugf("Rejected connection from %s by ACL", addr)
+		return
+	}
+	if v == nil {
+		v = viewFor(client)
+	}
+	proto := dnstapProtocol(conn)
+	var wmu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn.SetReadDeadline(time.Now().Add(*tcpIdleTimeout))
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+		debugf("Data come in from: tcp %s", clientLabel(addr))
+		if overloaded(addr) {
+			continue
+		}
+		if !beginQuery() {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			tap(dnstapClientQuery, proto, addr, start, data, nil)
+			capturePacket(addr, conn.LocalAddr(), data, true)
+			// Cookies are for the plain DNS listener; TLS already keeps
+			// spoofed replies out.
+			ctx := context.Background()
+			if proto == dnstapTCP {
+				ctx = withCookies(ctx, false)
+			}
+			reply := dnsRequest(ctx, data, client, v)
+			defer endQuery(reply != nil, start)
+			if reply == nil {
+				return
+			}
+			if proto == dnstapDOT {
+				reply = padReply(data, reply)
+			}
+			tap(dnstapClientResponse, proto, addr, start, data, reply)
+			capturePacket(addr, conn.LocalAddr(), reply, false)
+			wmu.Lock()
+			defer wmu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(*queryTimeout))
+			msg := binary.BigEndian.AppendUint16(nil, uint16(len(reply)))
+			if _, err := conn.Write(append(msg, reply...)); err != nil {
+				warnf("Reply to %s: %v", addr, err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	tlsCert = flag.String("tls-cert", "", "PEM certificate file for the encrypted listeners, self-signed if empty")
+	tlsKey  = flag.String("tls-key", "", "PEM private key file for the encrypted listeners")
+)
+
+var serverTLS struct {
+	once sync.Once
+	cfg  *tls.Config
+	err  error
+}
+
+// serverTLSConfig returns the TLS configuration shared by the DoH and
+// DoT listeners. Without -tls-cert a self-signed certificate is made up,
+// which clients have to be told to trust or pin.
+func serverTLSConfig() (*tls.Config, error) {
+	serverTLS.once.Do(func() {
+		var cert tls.Certificate
+		var err error
+		switch {
+		case *tlsCert != "" && *tlsKey != "":
+			cert, err = tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		case *tlsCert != "" || *tlsKey != "":
+			err = fmt.Errorf("-tls-cert and -tls-key must be given together")
+		default:
+			cert, err = selfSignedCert()
+		}
+		if err != nil {
+			serverTLS.err = err
+			return
+		}
+		serverTLS.cfg = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	})
+	return serverTLS.cfg, serverTLS.err
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	names := []string{"localhost"}
+	if host, err := os.Hostname(); err == nil && host != "localhost" {
+		names = append(names, host)
+	}
+	if *ddrTarget != "" {
+		names = append(names, *ddrTarget)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[len(names)-1]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	infof("Using a self-signed certificate for %v, SHA-256 fingerprint %X", names, sha256.Sum256(der))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
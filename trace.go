@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	otlpEndpoint = flag.String("otlp-endpoint", "", "send OpenTelemetry traces of the request path to this OTLP/HTTP collector, e.g. http://localhost:4318 (JSON encoding; /v1/traces is added when the URL has no path)")
+	otlpSample   = flag.Float64("otlp-sample", 1, "fraction of queries to trace with -otlp-endpoint, from 0 to 1")
+)
+
+// The OTLP span kinds used.
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+// How many finished spans wait to be exported before new ones are dropped,
+// and how many go in one request at most.
+const (
+	spanQueueSize = 4096
+	spanBatchSize = 512
+	spanFlush     = 5 * time.Second
+)
+
+// A span is one step of answering a query, timed for tracing.
+type span struct {
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   []otlpKeyValue
+	err     string
+}
+
+type spanKey struct{}
+
+var (
+	traceURL string
+	spans    chan *span
+)
+
+func setupTracing() {
+	if *otlpEndpoint == "" {
+		return
+	}
+	u, err := url.Parse(*otlpEndpoint)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		log.Fatalf("bad -otlp-endpoint %q, want an http or https URL", *otlpEndpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	traceURL = u.String()
+	spans = make(chan *span, spanQueueSize)
+	go exportSpans()
+	infof("Sending traces of %.0f%% of queries to %s", 100**otlpSample, traceURL)
+}
+
+// startSpan starts a span named name as a child of the span of ctx and
+// returns a context carrying it. A span of kind spanServer starts a new
+// trace for the queries that are sampled; other spans are only made
+// inside a trace. The span returned is nil when there is nothing to
+// trace, and its methods do nothing then.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if spans == nil {
+		return ctx, nil
+	}
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil && (kind != spanServer || rand.Float64() >= *otlpSample) {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now()}
+	if parent != nil {
+		s.traceID, s.parent = parent.traceID, parent.id
+	} else {
+		for i := 0; i < len(s.traceID); i += 8 {
+			u := rand.Uint64()
+			for j := range 8 {
+				s.traceID[i+j] = byte(u >> (8 * j))
+			}
+		}
+	}
+	u := rand.Uint64()
+	for j := range s.id {
+		s.id[j] = byte(u >> (8 * j))
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// set adds an attribute, a string, bool or integer, to the span.
+func (s *span) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	var v otlpValue
+	switch x := value.(type) {
+	case bool:
+		v.BoolValue = &x
+	case int:
+		v.IntValue = strconv.Itoa(x)
+	case string:
+		v.StringValue = &x
+	default:
+		str := fmt.Sprint(x)
+		v.StringValue = &str
+	}
+	s.attrs = append(s.attrs, otlpKeyValue{Key: key, Value: v})
+}
+
+// fail marks the span as failed with err.
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err.Error()
+}
+
+// setReply records the rcode of a packed reply, or that the query was
+// dropped.
+func (s *span) setReply(reply []byte) {
+	switch {
+	case s == nil:
+	case reply == nil:
+		s.set("dns.dropped", true)
+	case len(reply) >= 4:
+		s.set("dns.rcode", int(reply[3]&0xF))
+	}
+}
+
+// finish ends the span and queues it for export.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case spans <- s:
+	default:
+	}
+}
+
+// The OTLP/HTTP JSON encoding of spans, of which IDs are hex strings and
+// 64-bit integers decimal strings.
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    string  `json:"intValue,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (s *span) otlp() otlpSpan {
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.id[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parent != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != "" {
+		o.Status = &otlpStatus{Code: 2, Message: s.err}
+	}
+	return o
+}
+
+// exportSpans sends the finished spans to the collector in batches.
+func exportSpans() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	tick := time.NewTicker(spanFlush)
+	var batch []otlpSpan
+	for {
+		select {
+		case s := <-spans:
+			if batch = append(batch, s.otlp()); len(batch) < spanBatchSize {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		postSpans(client, batch)
+		batch = nil
+	}
+}
+
+func postSpans(client *http.Client, batch []otlpSpan) {
+	service := "dns2tcp"
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpKeyValue{{Key: "service.name", Value: otlpValue{StringValue: &service}}},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "dns2tcp"},
+				"spans": batch,
+			}},
+		}},
+	})
+	if err != nil {
+		warnf("otlp: %v", err)
+		return
+	}
+	resp, err := client.Post(traceURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		warnf("otlp: dropped %d spans: %v", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		warnf("otlp: dropped %d spans: %s", len(batch), resp.Status)
+	}
+}
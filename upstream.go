@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	upstreamFlags    stringList
+	upstreamCooldown = flag.Duration("upstream-cooldown", 30*time.Second, "how long to skip an upstream after it fails")
+	lbStrategy       = flag.String("lb-strategy", "failover", "how to use several upstreams: failover (in order), round-robin, weighted, latency (fastest first) or race (query several at once)")
+	raceCount        = flag.Int("race-count", 2, "how many upstreams the race strategy queries at once")
+	upstreamRetries  = flag.Int("retries", 0, "how many times to retry a failed exchange with the same upstream before failing over")
+	retryBackoff     = flag.Duration("retry-backoff", 100*time.Millisecond, "wait before the first retry, doubled for each one after")
+)
+
+func init() {
+	flag.Var(&upstreamFlags, "upstream", "upstream DNS server host:port[*weight][?timeout=D&retries=N&backoff=D&proxy=URL] or odoh://host/path[*weight][?...], repeatable or comma-separated (default "+DNSSERVER+")")
+}
+
+// upstream is one resolver queries can be forwarded to, with the health
+// state used for failover and the round trip time used for balancing.
+type upstream struct {
+	addr   string
+	weight int
+	odoh   *odohTarget
+	proxy  *url.URL
+
+	// The exchange policy, from the flags unless the spec overrides it.
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	deadUntil time.Time
+	rtt       time.Duration
+	disabled  bool
+}
+
+// Weight of the latest round trip in the moving average.
+const rttSmoothing = 0.3
+
+var roundRobin atomic.Uint64
+
+func (u *upstream) healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.disabled && time.Now().After(u.deadUntil)
+}
+
+// setDisabled takes u out of use, or puts it back, from the admin API.
+func (u *upstream) setDisabled(disabled bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.disabled = disabled
+}
+
+func (u *upstream) isDisabled() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.disabled
+}
+
+func (u *upstream) markFailed(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures++
+	wasHealthy := time.Now().After(u.deadUntil)
+	u.deadUntil = time.Now().Add(*upstreamCooldown)
+	if wasHealthy {
+		warnf("Upstream %s failed: %v, skipping it for %v", u.addr, err, *upstreamCooldown)
+	}
+}
+
+func (u *upstream) markOK(rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.failures > 0 {
+		infof("Upstream %s is back", u.addr)
+	}
+	u.failures = 0
+	u.deadUntil = time.Time{}
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = time.Duration(rttSmoothing*float64(rtt) + (1-rttSmoothing)*float64(u.rtt))
+	}
+}
+
+func (u *upstream) latency() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.rtt
+}
+
+// exchange sends data to u and returns its reply, giving each attempt
+// the upstream's timeout and retrying with exponential backoff.
+func (u *upstream) exchange(ctx context.Context, data []byte) ([]byte, error) {
+	var err error
+	backoff := u.backoff
+	for try := 0; try <= u.retries; try++ {
+		if try > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+		actx, cancel := context.WithTimeout(ctx, u.timeout)
+		var reply []byte
+		if u.odoh != nil {
+			reply, err = u.odoh.exchange(actx, data)
+		} else {
+			reply, err = dnsExchangeContext(actx, u.proxy, u.addr, data)
+		}
+		cancel()
+		if err == nil && !matchesQuery(data, reply) {
+			err = errReplyMismatch
+		}
+		if err == nil || ctx.Err() != nil {
+			return reply, err
+		}
+	}
+	return nil, err
+}
+
+var errReplyMismatch = errors.New("reply does not match the query")
+
+// matchesQuery reports whether reply answers query: it must be a response
+// with the same ID and question, although the name may differ in case.
+// Error replies may leave the question out.
+func matchesQuery(query, reply []byte) bool {
+	q, err := parseDNSMsg(query)
+	if err != nil {
+		return false
+	}
+	r, err := parseDNSMsg(reply)
+	if err != nil || !r.response || r.id != q.id {
+		return false
+	}
+	if len(r.question) == 0 && r.rcode != dnsRcodeSuccess {
+		return true
+	}
+	if len(r.question) != len(q.question) {
+		return false
+	}
+	for i, rq := range r.question {
+		qq := q.question[i]
+		if rq.Qtype != qq.Qtype || rq.Qclass != qq.Qclass || !strings.EqualFold(rq.Name, qq.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseUpstreamOptions applies the ?timeout=D&retries=N&backoff=D&proxy=URL
+// options of an upstream spec to u.
+func parseUpstreamOptions(u *upstream, query string) error {
+	opts, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	for key, values := range opts {
+		value := values[len(values)-1]
+		switch key {
+		case "timeout":
+			u.timeout, err = time.ParseDuration(value)
+		case "retries":
+			u.retries, err = strconv.Atoi(value)
+		case "backoff":
+			u.backoff, err = time.ParseDuration(value)
+		case "proxy":
+			u.proxy, err = parseProxy(value)
+		default:
+			err = fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return fmt.Errorf("upstream %s: %v", u.addr, err)
+		}
+	}
+	if u.timeout <= 0 || u.retries < 0 || u.backoff < 0 {
+		return fmt.Errorf("upstream %s: bad timeout, retries or backoff", u.addr)
+	}
+	if u.odoh != nil && u.proxy != nil {
+		u.odoh.client = proxiedHTTPClient(u.proxy)
+	}
+	return nil
+}
+
+// upstreamGroup is an ordered list of upstreams with failover.
+type upstreamGroup []*upstream
+
+// The upstreams of the default view.
+var upstreams upstreamGroup
+
+func parseUpstreams(specs []string) (upstreamGroup, error) {
+	var g upstreamGroup
+	for _, spec := range specs {
+		for _, addr := range strings.Split(spec, ",") {
+			addr = strings.TrimSpace(addr)
+			if addr == "" {
+				continue
+			}
+			addr, query, _ := strings.Cut(addr, "?")
+			weight := 1
+			if a, w, ok := strings.Cut(addr, "*"); ok {
+				n, err := strconv.Atoi(w)
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("bad weight in upstream %q", addr)
+				}
+				addr, weight = a, n
+			}
+			proxy, err := parseProxy(*upstreamProxy)
+			if err != nil {
+				return nil, err
+			}
+			u := &upstream{addr: addr, weight: weight, proxy: proxy, timeout: *queryTimeout, retries: *upstreamRetries, backoff: *retryBackoff}
+			if isODoH(addr) {
+				t, err := parseODoHTarget(addr)
+				if err != nil {
+					return nil, err
+				}
+				u.odoh = t
+			} else if _, _, err := net.SplitHostPort(addr); err != nil {
+				u.addr = net.JoinHostPort(addr, "53")
+			}
+			if err := parseUpstreamOptions(u, query); err != nil {
+				return nil, err
+			}
+			g = append(g, u)
+		}
+	}
+	if len(g) == 0 {
+		return nil, errors.New("no upstream servers")
+	}
+	return g, nil
+}
+
+func setupUpstreams() {
+	switch *lbStrategy {
+	case "failover", "round-robin", "weighted", "latency", "race":
+	default:
+		log.Fatalf("bad -lb-strategy %q", *lbStrategy)
+	}
+	specs := upstreamFlags
+	if len(specs) == 0 {
+		specs = stringList{DNSSERVER}
+	}
+	var err error
+	if upstreams, err = parseUpstreams(specs); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (g upstreamGroup) String() string {
+	addrs := make([]string, len(g))
+	for i, u := range g {
+		addrs[i] = u.addr
+	}
+	return strings.Join(addrs, ",")
+}
+
+// exchange sends data to the healthy upstreams according to
+// -lb-strategy. Failed upstreams are skipped until their cooldown ends;
+// if every upstream is cooling down they are all tried anyway, except
+// the ones disabled through the admin API.
+func (g upstreamGroup) exchange(data []byte) ([]byte, error) {
+	return g.exchangeContext(context.Background(), data)
+}
+
+// exchangeContext is exchange that gives up when ctx is done.
+func (g upstreamGroup) exchangeContext(ctx context.Context, data []byte) ([]byte, error) {
+	var order upstreamGroup
+	for _, u := range g {
+		if u.healthy() {
+			order = append(order, u)
+		}
+	}
+	if len(order) == 0 {
+		for _, u := range g {
+			if !u.isDisabled() {
+				order = append(order, u)
+			}
+		}
+	}
+	if len(order) == 0 {
+		return nil, errors.New("all upstreams are disabled")
+	}
+	if len(order) > 1 {
+		order.balance()
+	}
+	if *lbStrategy == "race" && len(order) > 1 && *raceCount > 1 {
+		return order.race(ctx, data)
+	}
+	return order.failover(ctx, data)
+}
+
+// balance reorders the upstreams g is about to try according to
+// -lb-strategy. The ones after the first are still used for failover.
+func (g upstreamGroup) balance() {
+	switch *lbStrategy {
+	case "round-robin":
+		n := int(roundRobin.Add(1) % uint64(len(g)))
+		rotated := append(append(upstreamGroup{}, g[n:]...), g[:n]...)
+		copy(g, rotated)
+	case "weighted":
+		// Pick each position at random in proportion to the weights of
+		// the upstreams left.
+		for i := range g {
+			total := 0
+			for _, u := range g[i:] {
+				total += u.weight
+			}
+			r := rand.IntN(total)
+			for j, u := range g[i:] {
+				if r -= u.weight; r < 0 {
+					g[i], g[i+j] = g[i+j], g[i]
+					break
+				}
+			}
+		}
+	case "latency":
+		// Upstreams not measured yet come first so they get measured.
+		sort.SliceStable(g, func(i, j int) bool {
+			return g[i].latency() < g[j].latency()
+		})
+	}
+}
+
+// failover tries the upstreams in order until one answers.
+func (g upstreamGroup) failover(ctx context.Context, data []byte) ([]byte, error) {
+	var err error
+	for _, u := range g {
+		var reply []byte
+		start := time.Now()
+		reply, err = u.exchange(ctx, data)
+		if err == nil {
+			u.markOK(time.Since(start))
+			return reply, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		u.markFailed(err)
+	}
+	return nil, err
+}
+
+// race sends data to the first -race-count upstreams at once and returns
+// the first answer, cancelling the other exchanges. If they all fail the
+// remaining upstreams are tried in order.
+func (g upstreamGroup) race(parent context.Context, data []byte) ([]byte, error) {
+	n := min(*raceCount, len(g))
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	type result struct {
+		reply []byte
+		err   error
+	}
+	results := make(chan result, n)
+	for _, u := range g[:n] {
+		go func() {
+			start := time.Now()
+			reply, err := u.exchange(ctx, data)
+			switch {
+			case err == nil:
+				u.markOK(time.Since(start))
+			case ctx.Err() == nil:
+				u.markFailed(err)
+			}
+			results <- result{reply, err}
+		}()
+	}
+	var err error
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.err == nil {
+			return r.reply, nil
+		}
+		err = r.err
+	}
+	if n < len(g) {
+		return g[n:].failover(parent, data)
+	}
+	return nil, err
+}
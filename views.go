@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+var viewFlags stringList
+
+func init() {
+	flag.Var(&viewFlags, "view", `define a view as "name=N;clients=CIDR,...;listen=ADDR;upstream=ADDR,...;zone=FILE;special=DOMAIN,...;filter=TYPE,..." (repeatable)`)
+}
+
+// A view is a virtual resolver with its own local zones, special-use
+// domains and upstreams. Queries use the view of the listener they came
+// in on, or else the most specific view whose clients contain the
+// source address, or else the default view built from the global flags.
+type view struct {
+	name      string
+	clients   []*net.IPNet
+	listen    string
+	upstreams upstreamGroup
+	zones     []*zone
+	special   []string
+	filter    map[uint16]bool
+
+	// ownUpstreams is set when the view does not use the global
+	// upstreams, which also keeps the global -route rules from applying
+	// to it.
+	ownUpstreams bool
+
+	// The client group whose upstreams a view derived for it uses, which
+	// keeps its own cache entries.
+	group string
+}
+
+var (
+	defaultView *view
+	views       []*view
+)
+
+func parseView(spec string) (*view, error) {
+	v := &view{upstreams: upstreams, zones: zones, special: specialDomains, filter: filteredTypes}
+	ownZones := false
+	for _, kv := range strings.Split(spec, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("bad view option %q, want key=value", kv)
+		}
+		switch key {
+		case "name":
+			v.name = value
+		case "clients":
+			for _, c := range strings.Split(value, ",") {
+				_, n, err := net.ParseCIDR(strings.TrimSpace(c))
+				if err != nil {
+					return nil, err
+				}
+				v.clients = append(v.clients, n)
+			}
+		case "listen":
+			v.listen = value
+		case "upstream":
+			g, err := parseUpstreams([]string{value})
+			if err != nil {
+				return nil, err
+			}
+			v.upstreams, v.ownUpstreams = g, true
+		case "zone":
+			origin, path, ok := strings.Cut(value, "=")
+			if !ok {
+				origin, path = "", value
+			}
+			z, err := loadZone(path, origin)
+			if err != nil {
+				return nil, err
+			}
+			if !ownZones {
+				v.zones, ownZones = nil, true
+			}
+			v.zones = append(v.zones, z)
+		case "special":
+			v.special = nil
+			for _, d := range strings.Split(value, ",") {
+				if d = canonicalName(strings.TrimSpace(d)); d != "" {
+					v.special = append(v.special, d)
+				}
+			}
+		case "filter":
+			types, err := parseTypeList([]string{value})
+			if err != nil {
+				return nil, err
+			}
+			v.filter = types
+		default:
+			return nil, fmt.Errorf("unknown view option %q", key)
+		}
+	}
+	if v.name == "" {
+		return nil, fmt.Errorf("view %q has no name", spec)
+	}
+	return v, nil
+}
+
+// setupViews must run after the global zones, special-use domains and
+// type filters are set up, as views inherit them unless overridden.
+func setupViews() {
+	defaultView = &view{name: "default", upstreams: upstreams, zones: zones, special: specialDomains, filter: filteredTypes}
+	for _, spec := range viewFlags {
+		v, err := parseView(spec)
+		if err != nil {
+			log.Fatalf("bad -view %q: %v", spec, err)
+		}
+		infof("View %s: %d client ranges, %d zones, upstreams %s", v.name, len(v.clients), len(v.zones), v.upstreams)
+		views = append(views, v)
+	}
+}
+
+// viewFor returns the view for a query from client arriving on a
+// listener that is not bound to a view.
+func viewFor(client net.IP) *view {
+	best, bestBits := defaultView, -1
+	for _, v := range views {
+		for _, n := range v.clients {
+			if bits, _ := n.Mask.Size(); client != nil && n.Contains(client) && bits > bestBits {
+				best, bestBits = v, bits
+			}
+		}
+	}
+	return best
+}
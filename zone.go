@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var zoneFlags stringList
+
+func init() {
+	flag.Var(&zoneFlags, "zone", "serve an RFC 1035 zone file authoritatively, as file or origin=file (repeatable)")
+}
+
+// zone is a small authoritative zone loaded from a master file.
+type zone struct {
+	origin  string
+	soa     dnsRR
+	records map[string][]dnsRR
+}
+
+var zones []*zone
+
+func setupZones() {
+	for _, z := range zoneFlags {
+		origin, path, ok := strings.Cut(z, "=")
+		if !ok {
+			origin, path = "", z
+		}
+		zn, err := loadZone(path, origin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		infof("Loaded zone %s from %s", zn.origin, path)
+		zones = append(zones, zn)
+	}
+}
+
+// zoneTokens splits a master file line into fields, honouring quotes and
+// dropping comments. Parentheses are returned as separate tokens.
+func zoneTokens(line string) []string {
+	var toks []string
+	var cur strings.Builder
+	quoted := false
+	flush := func() {
+		if cur.Len() > 0 {
+			toks = append(toks, cur.String())
+			cur.Reset()
+		}
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+		case c == '"':
+			if quoted {
+				toks = append(toks, "\""+cur.String())
+				cur.Reset()
+			} else {
+				flush()
+			}
+			quoted = !quoted
+		case quoted:
+			cur.WriteByte(c)
+		case c == ';':
+			flush()
+			return toks
+		case c == '(' || c == ')':
+			flush()
+			toks = append(toks, string(c))
+		case c == ' ' || c == '\t':
+			flush()
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	flush()
+	return toks
+}
+
+// parseTTL accepts plain seconds as well as BIND style units like 1h30m.
+func parseTTL(s string) (uint32, bool) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), true
+	}
+	var total, n uint64
+	digits := false
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			n = n*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		if !digits {
+			return 0, false
+		}
+		switch c {
+		case 's':
+		case 'm':
+			n *= 60
+		case 'h':
+			n *= 3600
+		case 'd':
+			n *= 86400
+		case 'w':
+			n *= 604800
+		default:
+			return 0, false
+		}
+		total += n
+		n, digits = 0, false
+	}
+	if digits {
+		return 0, false
+	}
+	return uint32(total), true
+}
+
+func absName(name, origin string) string {
+	if name == "@" {
+		return origin
+	}
+	if strings.HasSuffix(name, ".") {
+		return canonicalName(name)
+	}
+	if origin == "" {
+		return canonicalName(name)
+	}
+	return canonicalName(name + "." + origin)
+}
+
+// packRdata encodes the presentation form of a record into wire format.
+func packRdata(rrtype uint16, args []string, origin string) ([]byte, error) {
+	need := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("want %d rdata fields, got %d", n, len(args))
+		}
+		return nil
+	}
+	u16 := func(s string) (uint16, error) {
+		n, err := strconv.ParseUint(s, 10, 16)
+		return uint16(n), err
+	}
+	switch rrtype {
+	case dnsTypeA, dnsTypeAAAA:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(args[0])
+		if ip == nil {
+			return nil, fmt.Errorf("bad address %q", args[0])
+		}
+		if rrtype == dnsTypeA {
+			if ip = ip.To4(); ip == nil {
+				return nil, fmt.Errorf("bad IPv4 address %q", args[0])
+			}
+			return ip, nil
+		}
+		return ip.To16(), nil
+	case dnsTypeNS, dnsTypeCNAME, dnsTypePTR:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		return packDomainName(nil, absName(args[0], origin)), nil
+	case dnsTypeMX:
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		pref, err := u16(args[0])
+		if err != nil {
+			return nil, err
+		}
+		b := binary.BigEndian.AppendUint16(nil, pref)
+		return packDomainName(b, absName(args[1], origin)), nil
+	case dnsTypeSRV:
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		var b []byte
+		for _, a := range args[:3] {
+			n, err := u16(a)
+			if err != nil {
+				return nil, err
+			}
+			b = binary.BigEndian.AppendUint16(b, n)
+		}
+		return packDomainName(b, absName(args[3], origin)), nil
+	case dnsTypeTXT:
+		if len(args) == 0 {
+			return nil, fmt.Errorf("empty TXT record")
+		}
+		var b []byte
+		for _, a := range args {
+			a = strings.TrimPrefix(a, "\"")
+			for len(a) > 255 {
+				b = append(b, 255)
+				b = append(b, a[:255]...)
+				a = a[255:]
+			}
+			b = append(b, byte(len(a)))
+			b = append(b, a...)
+		}
+		return b, nil
+	case dnsTypeSOA:
+		if err := need(7); err != nil {
+			return nil, err
+		}
+		b := packDomainName(nil, absName(args[0], origin))
+		b = packDomainName(b, absName(args[1], origin))
+		for _, a := range args[2:] {
+			n, ok := parseTTL(a)
+			if !ok {
+				return nil, fmt.Errorf("bad SOA field %q", a)
+			}
+			b = binary.BigEndian.AppendUint32(b, n)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", typeName(rrtype))
+}
+
+func parenDepth(toks []string) int {
+	depth := 0
+	for _, t := range toks {
+		switch t {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+	}
+	return depth
+}
+
+func loadZone(path, origin string) (*zone, error) {
+	z := &zone{origin: canonicalName(origin), records: make(map[string][]dnsRR)}
+	if err := z.read(path, z.origin, 3600, 0); err != nil {
+		return nil, err
+	}
+	if z.origin == "" {
+		return nil, fmt.Errorf("%s: no origin, use $ORIGIN or -zone origin=file", path)
+	}
+	if z.soa.Rrtype != dnsTypeSOA || z.soa.Name != z.origin {
+		return nil, fmt.Errorf("%s: zone %q has no SOA record at its origin", path, z.origin)
+	}
+	return z, nil
+}
+
+// maxIncludeDepth bounds the nesting of $INCLUDE, which also stops loops.
+const maxIncludeDepth = 8
+
+// read parses the master file at path into z. The origin and TTL set by
+// $ORIGIN and $TTL in a file included with $INCLUDE do not carry over to
+// the including file (RFC 1035 section 5.1).
+func (z *zone) read(path, origin string, ttl uint32, depth int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	owner := origin
+	s := bufio.NewScanner(f)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := s.Text()
+		toks := zoneTokens(line)
+		// Join records spread over several lines with parentheses.
+		open := parenDepth(toks)
+		for open > 0 && s.Scan() {
+			lineno++
+			more := zoneTokens(s.Text())
+			open += parenDepth(more)
+			toks = append(toks, more...)
+		}
+		fields := toks[:0:0]
+		for _, t := range toks {
+			if t != "(" && t != ")" {
+				fields = append(fields, t)
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		errf := func(format string, a ...any) error {
+			return fmt.Errorf("%s:%d: %s", path, lineno, fmt.Sprintf(format, a...))
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) != 2 {
+				return errf("bad $ORIGIN")
+			}
+			origin = absName(fields[1], origin)
+			if depth == 0 {
+				z.origin = origin
+			}
+			owner = origin
+			continue
+		case "$TTL":
+			var ok bool
+			if len(fields) != 2 {
+				return errf("bad $TTL")
+			}
+			if ttl, ok = parseTTL(fields[1]); !ok {
+				return errf("bad $TTL %q", fields[1])
+			}
+			continue
+		case "$INCLUDE":
+			if len(fields) < 2 || len(fields) > 3 {
+				return errf("bad $INCLUDE")
+			}
+			if depth == maxIncludeDepth {
+				return errf("$INCLUDE nested too deeply")
+			}
+			file := fields[1]
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(filepath.Dir(path), file)
+			}
+			incOrigin := origin
+			if len(fields) == 3 {
+				incOrigin = absName(fields[2], origin)
+			}
+			if err := z.read(file, incOrigin, ttl, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			owner = absName(fields[0], origin)
+			fields = fields[1:]
+		}
+		rrttl := ttl
+		var rrtype uint16
+		for len(fields) > 0 {
+			tok := strings.ToUpper(fields[0])
+			fields = fields[1:]
+			if tok == "IN" {
+				continue
+			}
+			if n, ok := parseTTL(tok); ok {
+				rrttl = n
+				continue
+			}
+			t, ok := parseType(tok)
+			if !ok {
+				return errf("unknown type or class %q", tok)
+			}
+			rrtype = t
+			break
+		}
+		if rrtype == 0 {
+			return errf("missing record type")
+		}
+		data, err := packRdata(rrtype, fields, origin)
+		if err != nil {
+			return errf("%v", err)
+		}
+		rr := dnsRR{Name: owner, Rrtype: rrtype, Class: dnsClassINET, Ttl: rrttl, Rdlength: uint16(len(data)), Data: data}
+		if rrtype == dnsTypeSOA {
+			z.soa = rr
+		}
+		z.records[owner] = append(z.records[owner], rr)
+	}
+	return s.Err()
+}
+
+func inZone(name, origin string) bool {
+	return origin == "" || name == origin || strings.HasSuffix(name, "."+origin)
+}
+
+// findZone returns the most specific of zs containing name.
+func findZone(name string, zs []*zone) *zone {
+	name = canonicalName(name)
+	var best *zone
+	for _, z := range zs {
+		if inZone(name, z.origin) && (best == nil || len(z.origin) > len(best.origin)) {
+			best = z
+		}
+	}
+	return best
+}
+
+// soaMinimum returns the negative caching TTL of an SOA record.
+func soaMinimum(soa dnsRR) uint32 {
+	if len(soa.Data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(soa.Data[len(soa.Data)-4:])
+}
+
+// hasChildren reports whether name is an empty non-terminal, which
+// exists even though it owns no records.
+func (z *zone) hasChildren(name string) bool {
+	for owner := range z.records {
+		if strings.HasSuffix(owner, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneAnswer answers queries for names inside one of zs, returning nil
+// for names that are not covered.
+func zoneAnswer(query dnsMsg, zs []*zone) []byte {
+	if len(query.question) != 1 {
+		return nil
+	}
+	q := query.question[0]
+	z := findZone(q.Name, zs)
+	if z == nil {
+		return nil
+	}
+	reply := newReply(query, dnsRcodeSuccess)
+	reply.authoritative = true
+
+	name := canonicalName(q.Name)
+	for i := 0; i < 8; i++ {
+		rrs, ok := z.records[name]
+		if !ok && !z.hasChildren(name) {
+			if len(reply.answer) == 0 {
+				reply.rcode = dnsRcodeNameError
+			}
+			break
+		}
+		var cname *dnsRR
+		for j, rr := range rrs {
+			if rr.Rrtype == q.Qtype || q.Qtype == dnsTypeANY {
+				reply.answer = append(reply.answer, rr)
+			} else if rr.Rrtype == dnsTypeCNAME {
+				cname = &rrs[j]
+			}
+		}
+		if cname == nil || q.Qtype == dnsTypeCNAME {
+			break
+		}
+		// Follow the alias while it stays inside the zone.
+		reply.answer = append(reply.answer, *cname)
+		name, _, _ = getDomainName(cname.Data, 0)
+		if !inZone(name, z.origin) {
+			break
+		}
+	}
+	reply.extra = z.additional(reply.answer)
+	if len(reply.answer) == 0 || reply.rcode == dnsRcodeNameError {
+		soa := z.soa
+		soa.Ttl = min(soa.Ttl, soaMinimum(soa))
+		reply.ns = []dnsRR{soa}
+	}
+	return packDNSMsg(reply)
+}
+
+// additional returns the addresses the zone has for the hosts named by
+// NS, MX and SRV records in answer, which saves the client a lookup.
+func (z *zone) additional(answer []dnsRR) []dnsRR {
+	var extra []dnsRR
+	seen := make(map[string]bool)
+	for _, rr := range answer {
+		var off int
+		switch rr.Rrtype {
+		case dnsTypeNS:
+		case dnsTypeMX:
+			off = 2
+		case dnsTypeSRV:
+			off = 6
+		default:
+			continue
+		}
+		if off > len(rr.Data) {
+			continue
+		}
+		host, _, err := getDomainName(rr.Data, off)
+		if err != nil || seen[host] {
+			continue
+		}
+		seen[host] = true
+		for _, a := range z.records[canonicalName(host)] {
+			if a.Rrtype == dnsTypeA || a.Rrtype == dnsTypeAAAA {
+				extra = append(extra, a)
+			}
+		}
+	}
+	return extra
+}